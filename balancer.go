@@ -0,0 +1,101 @@
+package wizard
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancer is interface for selecting one slave node from the cluster
+type Balancer interface {
+	Select([]*Node) *Node
+}
+
+// RandomBalancer randomly selects the node
+type RandomBalancer struct{}
+
+// NewRandomBalancer returns initialized RandomBalancer
+func NewRandomBalancer() *RandomBalancer {
+	return &RandomBalancer{}
+}
+
+// Select randomly returns one of the nodes
+func (b *RandomBalancer) Select(nodes []*Node) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[rand.Intn(len(nodes))]
+}
+
+// RoundRobinBalancer selects the node in turn
+type RoundRobinBalancer struct {
+	counter uint64
+}
+
+// NewRoundRobinBalancer returns initialized RoundRobinBalancer
+func NewRoundRobinBalancer() *RoundRobinBalancer {
+	return &RoundRobinBalancer{}
+}
+
+// Select returns the next node of the previous selected one
+func (b *RoundRobinBalancer) Select(nodes []*Node) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	i := atomic.AddUint64(&b.counter, 1) - 1
+	return nodes[i%uint64(len(nodes))]
+}
+
+// WeightedBalancer randomly selects the node in proportion to its weight
+type WeightedBalancer struct{}
+
+// NewWeightedBalancer returns initialized WeightedBalancer
+func NewWeightedBalancer() *WeightedBalancer {
+	return &WeightedBalancer{}
+}
+
+// Select randomly returns one of the nodes by the weight
+// the node with zero or minus weight is never selected
+func (b *WeightedBalancer) Select(nodes []*Node) *Node {
+	total := 0
+	for _, n := range nodes {
+		if n.Weight() > 0 {
+			total += n.Weight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	r := rand.Intn(total)
+	for _, n := range nodes {
+		if n.Weight() <= 0 {
+			continue
+		}
+		r -= n.Weight()
+		if r < 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// LeastInFlightBalancer selects the node which has the least in-flight queries
+// the in-flight queries are counted by Node.Acquire() and Node.Release() of the caller,
+// e.g. orm/xorm counts the open sessions of the slaves.
+type LeastInFlightBalancer struct{}
+
+// NewLeastInFlightBalancer returns initialized LeastInFlightBalancer
+func NewLeastInFlightBalancer() *LeastInFlightBalancer {
+	return &LeastInFlightBalancer{}
+}
+
+// Select returns the node with the least in-flight queries
+func (b *LeastInFlightBalancer) Select(nodes []*Node) *Node {
+	var selected *Node
+	for _, n := range nodes {
+		if selected == nil || n.InFlight() < selected.InFlight() {
+			selected = n
+		}
+	}
+	return selected
+}
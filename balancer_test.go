@@ -0,0 +1,87 @@
+package wizard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCreateNodes(dbs ...interface{}) []*Node {
+	var nodes []*Node
+	for _, db := range dbs {
+		nodes = append(nodes, NewNode(db))
+	}
+	return nodes
+}
+
+func TestRandomBalancerSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewRandomBalancer()
+	assert.Nil(b.Select(nil))
+
+	nodes := testCreateNodes("db1", "db2", "db3")
+	for i := 0; i < 10; i++ {
+		assert.Contains(nodes, b.Select(nodes))
+	}
+}
+
+func TestRoundRobinBalancerSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewRoundRobinBalancer()
+	assert.Nil(b.Select(nil))
+
+	nodes := testCreateNodes("db1", "db2", "db3")
+	assert.Equal("db1", b.Select(nodes).DB())
+	assert.Equal("db2", b.Select(nodes).DB())
+	assert.Equal("db3", b.Select(nodes).DB())
+	assert.Equal("db1", b.Select(nodes).DB())
+}
+
+func TestWeightedBalancerSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewWeightedBalancer()
+	assert.Nil(b.Select(nil))
+
+	nodes := testCreateNodes("db1", "db2")
+	nodes[0].weight = 0
+	for i := 0; i < 10; i++ {
+		assert.Equal("db2", b.Select(nodes).DB(), "zero weight node should not be selected")
+	}
+
+	nodes[1].weight = 0
+	assert.Nil(b.Select(nodes), "nil is returned when all weights are zero")
+
+	nodes[0].weight = 1
+	nodes[1].weight = 99
+	counts := make(map[interface{}]int)
+	for i := 0; i < 1000; i++ {
+		counts[b.Select(nodes).DB()]++
+	}
+	assert.True(counts["db2"] > counts["db1"], "heavier node should be selected more")
+}
+
+func TestLeastInFlightBalancerSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewLeastInFlightBalancer()
+	assert.Nil(b.Select(nil))
+
+	nodes := testCreateNodes("db1", "db2")
+	n1 := b.Select(nodes)
+	assert.Equal("db1", n1.DB())
+	assert.EqualValues(0, n1.InFlight(), "Select() does not count the query")
+	n1.Acquire()
+
+	n2 := b.Select(nodes)
+	assert.Equal("db2", n2.DB())
+	n2.Acquire()
+	n2.Acquire()
+
+	n1.Release()
+	assert.EqualValues(0, n1.InFlight())
+	assert.Equal("db1", b.Select(nodes).DB())
+	assert.Equal("db1", b.Select(nodes).DB(), "the node is not counted until it's acquired")
+}
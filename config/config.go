@@ -0,0 +1,293 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/evalphobia/wizard"
+	"github.com/evalphobia/wizard/errors"
+)
+
+// cluster types
+const (
+	TypeStandard = "standard"
+	TypeShard    = "shard"
+)
+
+// shard strategies
+const (
+	StrategyModulo   = "modulo"
+	StrategyHashRing = "hash_ring"
+)
+
+// balancer names
+const (
+	BalancerRandom        = "random"
+	BalancerRoundRobin    = "round_robin"
+	BalancerWeighted      = "weighted"
+	BalancerLeastInFlight = "least_in_flight"
+)
+
+// ConnectFunc creates the database connection (e.g. *xorm.Engine) from the driver name and dsn
+type ConnectFunc func(driver, dsn string) (interface{}, error)
+
+// Config is the topology of the database clusters
+type Config struct {
+	Driver   string                    `json:"driver" yaml:"driver"` // default driver name
+	Strict   bool                      `json:"strict" yaml:"strict"`
+	Default  string                    `json:"default" yaml:"default"` // cluster name for catchall
+	Clusters map[string]*ClusterConfig `json:"clusters" yaml:"clusters"`
+	Tables   map[string]string         `json:"tables" yaml:"tables"` // table name (e.g. struct type name "models.User") => cluster name
+}
+
+// NodesConfig is the master and slaves of StandardCluster
+type NodesConfig struct {
+	Driver   string         `json:"driver" yaml:"driver"`
+	Master   string         `json:"master" yaml:"master"` // dsn
+	Slaves   []*SlaveConfig `json:"slaves" yaml:"slaves"`
+	Balancer string         `json:"balancer" yaml:"balancer"`
+	MaxLag   string         `json:"max_lag" yaml:"max_lag"` // e.g. "5s"
+}
+
+// SlaveConfig is the slave node
+type SlaveConfig struct {
+	DSN    string `json:"dsn" yaml:"dsn"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// ClusterConfig is the cluster, [StandardCluster | ShardCluster]
+type ClusterConfig struct {
+	NodesConfig `yaml:",inline"`
+
+	Type     string         `json:"type" yaml:"type"`         // "standard" (default) or "shard"
+	Strategy string         `json:"strategy" yaml:"strategy"` // "modulo" (default) or "hash_ring"
+	SlotSize int64          `json:"slot_size" yaml:"slot_size"`
+	Replicas int            `json:"replicas" yaml:"replicas"`
+	Shards   []*ShardConfig `json:"shards" yaml:"shards"`
+}
+
+// ShardConfig is the shard of ShardCluster
+// min and max are used for modulo strategy, name is used for hash ring strategy
+type ShardConfig struct {
+	NodesConfig `yaml:",inline"`
+
+	Name string `json:"name" yaml:"name"`
+	Min  int64  `json:"min" yaml:"min"`
+	Max  int64  `json:"max" yaml:"max"`
+}
+
+// Build creates Wizard from the config
+// connect is called for every master and slave.
+// when error occurs, the created connections implementing io.Closer are closed.
+func (c *Config) Build(connect ConnectFunc) (*wizard.Wizard, error) {
+	b := &builder{
+		config:  c,
+		connect: connect,
+	}
+	wiz, err := b.build()
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	return wiz, nil
+}
+
+// builder creates clusters from the config
+type builder struct {
+	config  *Config
+	connect ConnectFunc
+	dbs     []interface{}
+}
+
+func (b *builder) build() (*wizard.Wizard, error) {
+	clusters := make(map[string]wizard.Cluster)
+	for _, name := range b.clusterNames() {
+		c, err := b.buildCluster(name, b.config.Clusters[name])
+		if err != nil {
+			return nil, err
+		}
+		clusters[name] = c
+	}
+
+	wiz := wizard.NewWizard()
+	if b.config.Default != "" {
+		c, ok := clusters[b.config.Default]
+		if !ok {
+			return nil, errors.NewErrConfigUnknownCluster(b.config.Default)
+		}
+		wiz.SetDefault(c)
+	}
+
+	for _, table := range b.tableNames() {
+		name := b.config.Tables[table]
+		c, ok := clusters[name]
+		if !ok {
+			return nil, errors.NewErrConfigUnknownCluster(name)
+		}
+		err := wiz.RegisterTables(c, table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if b.config.Strict {
+		wiz.SetStrict(true)
+		err := wiz.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wiz, nil
+}
+
+func (b *builder) buildCluster(name string, conf *ClusterConfig) (wizard.Cluster, error) {
+	if conf == nil {
+		return nil, errors.NewErrConfigInvalid(name, "empty cluster")
+	}
+
+	switch conf.Type {
+	case "", TypeStandard:
+		return b.buildStandardCluster(name, conf.NodesConfig)
+	case TypeShard:
+		return b.buildShardCluster(name, conf)
+	default:
+		return nil, errors.NewErrConfigInvalid(name, "unknown type: "+conf.Type)
+	}
+}
+
+func (b *builder) buildShardCluster(name string, conf *ClusterConfig) (*wizard.ShardCluster, error) {
+	var c *wizard.ShardCluster
+	switch conf.Strategy {
+	case "", StrategyModulo:
+		if conf.SlotSize < 1 {
+			return nil, errors.NewErrConfigInvalid(name, "slot_size must be positive")
+		}
+		c = wizard.NewShardCluster(wizard.NewModuloStrategy(conf.SlotSize))
+	case StrategyHashRing:
+		c = wizard.NewShardCluster(wizard.NewHashRingStrategy(conf.Replicas))
+	default:
+		return nil, errors.NewErrConfigInvalid(name, "unknown strategy: "+conf.Strategy)
+	}
+
+	for i, shard := range conf.Shards {
+		if shard == nil {
+			return nil, errors.NewErrConfigInvalid(name, fmt.Sprintf("empty shard at %d", i))
+		}
+		shardName := shard.Name
+		if shardName == "" {
+			shardName = fmt.Sprintf("%d-%d", shard.Min, shard.Max)
+		}
+		nodes := shard.NodesConfig
+		if nodes.Driver == "" {
+			nodes.Driver = conf.Driver
+		}
+
+		s, err := b.buildStandardCluster(name+"."+shardName, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		if conf.Strategy == StrategyHashRing {
+			err = c.RegisterNamedShard(shardName, s)
+		} else {
+			err = c.RegisterShard(shard.Min, shard.Max, s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (b *builder) buildStandardCluster(name string, conf NodesConfig) (*wizard.StandardCluster, error) {
+	if conf.Master == "" {
+		return nil, errors.NewErrConfigInvalid(name, "master is empty")
+	}
+	driver := conf.Driver
+	if driver == "" {
+		driver = b.config.Driver
+	}
+
+	db, err := b.open(name+".master", driver, conf.Master)
+	if err != nil {
+		return nil, err
+	}
+	c := wizard.NewCluster(db)
+
+	for i, slave := range conf.Slaves {
+		if slave == nil || slave.DSN == "" {
+			return nil, errors.NewErrConfigInvalid(name, fmt.Sprintf("slave dsn is empty at %d", i))
+		}
+		db, err := b.open(fmt.Sprintf("%s.slave%d", name, i), driver, slave.DSN)
+		if err != nil {
+			return nil, err
+		}
+		if slave.Weight != 0 {
+			c.RegisterSlaveWithWeight(db, slave.Weight)
+		} else {
+			c.RegisterSlave(db)
+		}
+	}
+
+	switch conf.Balancer {
+	case "":
+	case BalancerRandom:
+		c.SetBalancer(wizard.NewRandomBalancer())
+	case BalancerRoundRobin:
+		c.SetBalancer(wizard.NewRoundRobinBalancer())
+	case BalancerWeighted:
+		c.SetBalancer(wizard.NewWeightedBalancer())
+	case BalancerLeastInFlight:
+		c.SetBalancer(wizard.NewLeastInFlightBalancer())
+	default:
+		return nil, errors.NewErrConfigInvalid(name, "unknown balancer: "+conf.Balancer)
+	}
+
+	if conf.MaxLag != "" {
+		d, err := time.ParseDuration(conf.MaxLag)
+		if err != nil {
+			return nil, errors.NewErrConfigInvalid(name, "max_lag: "+err.Error())
+		}
+		c.SetMaxLag(d)
+	}
+	return c, nil
+}
+
+// open connects the database and keeps it for closing on error
+func (b *builder) open(name, driver, dsn string) (interface{}, error) {
+	db, err := b.connect(driver, dsn)
+	if err != nil {
+		return nil, errors.NewErrConfigConnect(name, err)
+	}
+	b.dbs = append(b.dbs, db)
+	return db, nil
+}
+
+// close closes all of the created connections
+func (b *builder) close() {
+	for _, db := range b.dbs {
+		if c, ok := db.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+func (b *builder) clusterNames() []string {
+	var list []string
+	for name := range b.config.Clusters {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (b *builder) tableNames() []string {
+	var list []string
+	for name := range b.config.Tables {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
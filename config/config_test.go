@@ -0,0 +1,271 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+const testYAML = `
+driver: mysql
+default: main
+strict: true
+clusters:
+  main:
+    master: main-master
+    slaves:
+      - dsn: main-slave01
+        weight: 3
+      - dsn: main-slave02
+    balancer: weighted
+    max_lag: 5s
+  user:
+    type: shard
+    slot_size: 10
+    shards:
+      - min: 0
+        max: 4
+        master: user01-master
+        slaves:
+          - dsn: user01-slave01
+      - min: 5
+        max: 9
+        master: user02-master
+  item:
+    type: shard
+    strategy: hash_ring
+    replicas: 10
+    shards:
+      - name: item01
+        master: item01-master
+      - name: item02
+        driver: postgres
+        master: item02-master
+tables:
+  config.testUser: user
+  test_item: item
+`
+
+const testJSON = `{
+  "driver": "mysql",
+  "clusters": {
+    "main": {"master": "main-master", "slaves": [{"dsn": "main-slave01"}], "balancer": "round_robin"}
+  },
+  "tables": {"test_main": "main"}
+}`
+
+type testUser struct {
+	ID int64 `shard_key:"true"`
+}
+
+type testDB struct {
+	driver string
+	dsn    string
+	closed bool
+}
+
+func (db *testDB) Close() error {
+	db.closed = true
+	return nil
+}
+
+type testConnector struct {
+	dbs map[string]*testDB
+}
+
+func newTestConnector() *testConnector {
+	return &testConnector{dbs: make(map[string]*testDB)}
+}
+
+func (c *testConnector) connect(driver, dsn string) (interface{}, error) {
+	if dsn == "broken" {
+		return nil, errors.NewErr(1, "connection refused")
+	}
+	db := &testDB{driver: driver, dsn: dsn}
+	c.dbs[dsn] = db
+	return db, nil
+}
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := newTestConnector()
+	wiz, err := Load([]byte(testYAML), "yaml", conn.connect)
+	assert.Nil(err)
+	assert.NotNil(wiz)
+	assert.True(wiz.IsStrict())
+	assert.Len(conn.dbs, 8)
+	assert.Equal("mysql", conn.dbs["user01-master"].driver)
+	assert.Equal("postgres", conn.dbs["item02-master"].driver)
+
+	// default
+	main := wiz.Select("unknown_table")
+	assert.NotNil(main)
+	assert.Equal(conn.dbs["main-master"], main.Master().DB())
+	nodes := main.Nodes()
+	assert.Len(nodes, 3)
+	assert.Equal(conn.dbs["main-slave01"], nodes[1].DB())
+	assert.Equal(3, nodes[1].Weight())
+	assert.Equal(1, nodes[2].Weight())
+
+	// modulo
+	s := wiz.Select(testUser{ID: 3})
+	assert.NotNil(s)
+	assert.Equal(conn.dbs["user01-master"], s.Master().DB())
+	assert.Equal(conn.dbs["user01-slave01"], s.Slave().DB())
+	s = wiz.Select(testUser{ID: 7})
+	assert.Equal(conn.dbs["user02-master"], s.Master().DB())
+
+	// hash ring
+	s = wiz.SelectByKey("test_item", 100)
+	assert.NotNil(s)
+	assert.NotEqual(main, s)
+	assert.Len(wiz.UseMasters("test_item"), 2)
+}
+
+func TestLoadJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := newTestConnector()
+	wiz, err := Load([]byte(testJSON), "json", conn.connect)
+	assert.Nil(err)
+	assert.False(wiz.HasDefault())
+	assert.Nil(wiz.Select("unknown_table"))
+
+	s := wiz.Select("test_main")
+	assert.NotNil(s)
+	assert.Equal(conn.dbs["main-master"], s.Master().DB())
+	assert.Equal(conn.dbs["main-slave01"], s.Slave().DB())
+}
+
+func TestLoadFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "wizard-config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wizard.yml")
+	assert.Nil(ioutil.WriteFile(path, []byte(testYAML), 0644))
+	wiz, err := LoadFile(path, newTestConnector().connect)
+	assert.Nil(err)
+	assert.NotNil(wiz)
+
+	path = filepath.Join(dir, "wizard.toml")
+	assert.Nil(ioutil.WriteFile(path, []byte(""), 0644))
+	_, err = LoadFile(path, newTestConnector().connect)
+	assert.Equal(errors.NewErrConfigFormat(".toml"), err, "toml is not built in")
+
+	_, err = LoadFile(filepath.Join(dir, "not_found.json"), newTestConnector().connect)
+	assert.NotNil(err)
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := getDecoder("test")
+	assert.NotNil(err)
+
+	RegisterDecoder(".TEST", func(data []byte, v interface{}) error {
+		conf := v.(*Config)
+		conf.Driver = string(data)
+		return nil
+	})
+	defer func() {
+		decodersMu.Lock()
+		delete(decoders, "test")
+		decodersMu.Unlock()
+	}()
+
+	conf, err := Parse([]byte("sqlite3"), "test")
+	assert.Nil(err)
+	assert.Equal("sqlite3", conf.Driver)
+
+	// the values are set by the json tags
+	RegisterDecoder("test", JSONTagDecoder(yaml.Unmarshal))
+	conf, err = Parse([]byte(testYAML), "test")
+	assert.Nil(err)
+	expected, _ := Parse([]byte(testYAML), "yaml")
+	assert.Equal(expected, conf)
+	assert.EqualValues(10, conf.Clusters["user"].SlotSize)
+
+	_, err = Parse([]byte("- invalid"), "test")
+	assert.NotNil(err)
+}
+
+func TestBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		conf *Config
+		err  error
+	}{
+		{&Config{Default: "main"}, errors.NewErrConfigUnknownCluster("main")},
+		{&Config{Tables: map[string]string{"t": "main"}}, errors.NewErrConfigUnknownCluster("main")},
+		{&Config{Clusters: map[string]*ClusterConfig{"main": nil}}, errors.NewErrConfigInvalid("main", "empty cluster")},
+		{&Config{Clusters: map[string]*ClusterConfig{"main": {}}}, errors.NewErrConfigInvalid("main", "master is empty")},
+		{&Config{Clusters: map[string]*ClusterConfig{"main": {Type: "foo"}}}, errors.NewErrConfigInvalid("main", "unknown type: foo")},
+		{&Config{Clusters: map[string]*ClusterConfig{"main": {Type: TypeShard}}}, errors.NewErrConfigInvalid("main", "slot_size must be positive")},
+		{&Config{Clusters: map[string]*ClusterConfig{"main": {Type: TypeShard, Strategy: "foo"}}}, errors.NewErrConfigInvalid("main", "unknown strategy: foo")},
+		{&Config{Clusters: map[string]*ClusterConfig{
+			"main": {NodesConfig: NodesConfig{Master: "m", Balancer: "foo"}},
+		}}, errors.NewErrConfigInvalid("main", "unknown balancer: foo")},
+		{&Config{Clusters: map[string]*ClusterConfig{
+			"main": {NodesConfig: NodesConfig{Master: "m", Slaves: []*SlaveConfig{{}}}},
+		}}, errors.NewErrConfigInvalid("main", "slave dsn is empty at 0")},
+		{&Config{Clusters: map[string]*ClusterConfig{
+			"main": {NodesConfig: NodesConfig{Master: "broken"}},
+		}}, errors.NewErrConfigConnect("main.master", errors.NewErr(1, "connection refused"))},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.conf.Build(newTestConnector().connect)
+		assert.Equal(tt.err, err)
+	}
+
+	// invalid max lag
+	_, err := (&Config{Clusters: map[string]*ClusterConfig{
+		"main": {NodesConfig: NodesConfig{Master: "m", MaxLag: "foo"}},
+	}}).Build(newTestConnector().connect)
+	assert.NotNil(err)
+
+	// overlapped shards
+	_, err = (&Config{Clusters: map[string]*ClusterConfig{
+		"main": {Type: TypeShard, SlotSize: 10, Shards: []*ShardConfig{
+			{Min: 0, Max: 5, NodesConfig: NodesConfig{Master: "m1"}},
+			{Min: 5, Max: 9, NodesConfig: NodesConfig{Master: "m2"}},
+		}},
+	}}).Build(newTestConnector().connect)
+	assert.NotNil(err)
+}
+
+func TestBuildStrict(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &Config{
+		Clusters: map[string]*ClusterConfig{
+			"main": {Type: TypeShard, SlotSize: 10, Shards: []*ShardConfig{
+				{Min: 0, Max: 4, NodesConfig: NodesConfig{Master: "m1"}},
+			}},
+		},
+		Tables: map[string]string{"test": "main"},
+	}
+	conn := newTestConnector()
+	wiz, err := conf.Build(conn.connect)
+	assert.Nil(err)
+	assert.NotNil(wiz)
+
+	conf.Strict = true
+	conn = newTestConnector()
+	wiz, err = conf.Build(conn.connect)
+	assert.Nil(wiz)
+	_, ok := err.(errors.ErrValidation)
+	assert.True(ok)
+	assert.True(conn.dbs["m1"].closed, "connections are closed on error")
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/evalphobia/wizard"
+	"github.com/evalphobia/wizard/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DecodeFunc decodes the config data into the struct
+// e.g. json.Unmarshal, yaml.Unmarshal
+type DecodeFunc func(data []byte, v interface{}) error
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]DecodeFunc{
+		"json": json.Unmarshal,
+		"yaml": yaml.Unmarshal,
+		"yml":  yaml.Unmarshal,
+	}
+)
+
+// RegisterDecoder sets the decoder for the config format
+// e.g. RegisterDecoder("toml", JSONTagDecoder(toml.Unmarshal)) to load TOML
+func RegisterDecoder(format string, fn DecodeFunc) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[normalizeFormat(format)] = fn
+}
+
+// JSONTagDecoder returns the decoder which sets the values into the config by the json tags
+// the data is decoded into the map by fn, so the decoder without the tags of the config (e.g. toml.Unmarshal) can be used.
+func JSONTagDecoder(fn DecodeFunc) DecodeFunc {
+	return func(data []byte, v interface{}) error {
+		m := make(map[string]interface{})
+		if err := fn(data, &m); err != nil {
+			return err
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
+// getDecoder returns the decoder for the config format
+func getDecoder(format string) (DecodeFunc, error) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	fn, ok := decoders[normalizeFormat(format)]
+	if !ok {
+		return nil, errors.NewErrConfigFormat(format)
+	}
+	return fn, nil
+}
+
+// normalizeFormat converts the format name or file extension into lower case name
+func normalizeFormat(format string) string {
+	return strings.ToLower(strings.TrimPrefix(format, "."))
+}
+
+// Parse decodes the config data in the format, [json | yaml | yml | (registered format)]
+func Parse(data []byte, format string) (*Config, error) {
+	decode, err := getDecoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Config{}
+	err = decode(data, conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// ParseFile reads and decodes the config file
+// the format is detected from the file extension
+func ParseFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, filepath.Ext(path))
+}
+
+// Load creates Wizard from the config data
+func Load(data []byte, format string, connect ConnectFunc) (*wizard.Wizard, error) {
+	conf, err := Parse(data, format)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Build(connect)
+}
+
+// LoadFile creates Wizard from the config file
+func LoadFile(path string, connect ConnectFunc) (*wizard.Wizard, error) {
+	conf, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Build(connect)
+}
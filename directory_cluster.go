@@ -0,0 +1,207 @@
+package wizard
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// ShardDirectory is interface for the lookup table of shard key and shard name
+type ShardDirectory interface {
+	// Lookup returns the shard name for the key
+	// if the key is not found, ErrDirectoryNotFound must be returned
+	Lookup(key string) (string, error)
+	// Assign saves the shard name for the key
+	Assign(key string, shard string) error
+}
+
+// DirectoryCluster is struct for database cluster sharded by the lookup table
+// e.g. tenant id => shard name
+type DirectoryCluster struct {
+	directory ShardDirectory
+	cache     *lruCache
+
+	mu     sync.RWMutex
+	names  []string
+	shards map[string]*StandardCluster
+}
+
+// NewDirectoryCluster returns initialized DirectoryCluster
+// cacheSize is the number of the keys cached in front of the directory
+func NewDirectoryCluster(dir ShardDirectory, cacheSize int) *DirectoryCluster {
+	return &DirectoryCluster{
+		directory: dir,
+		cache:     newLRUCache(cacheSize),
+		shards:    make(map[string]*StandardCluster),
+	}
+}
+
+// Master is dummy method for interface
+func (c *DirectoryCluster) Master() *Node {
+	return nil
+}
+
+// Masters returns all db masters from the sharded clusters
+func (c *DirectoryCluster) Masters() []*Node {
+	var result []*Node
+	for _, s := range c.clusters() {
+		result = append(result, s.Master())
+	}
+	return result
+}
+
+// Slave is dummy method for interface
+func (c *DirectoryCluster) Slave() *Node {
+	return nil
+}
+
+// Slaves randomly returns all db slaves from the sharded clusters
+func (c *DirectoryCluster) Slaves() []*Node {
+	var result []*Node
+	for _, s := range c.clusters() {
+		result = append(result, s.Slave())
+	}
+	return result
+}
+
+// Nodes returns all of the nodes in the sharded clusters
+func (c *DirectoryCluster) Nodes() []*Node {
+	var result []*Node
+	for _, s := range c.clusters() {
+		result = append(result, s.Nodes()...)
+	}
+	return result
+}
+
+// Validate checks the shards are registered
+func (c *DirectoryCluster) Validate() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch {
+	case c.directory == nil:
+		return errors.NewErrValidation("directory", []error{errors.NewErrNilDB("directory")})
+	case len(c.names) == 0:
+		return errors.NewErrValidation("directory", []error{errors.NewErrNoShards()})
+	}
+	return nil
+}
+
+// SelectByKey returns sharded cluster by the key
+// if the key is not found in the directory, nil is returned
+func (c *DirectoryCluster) SelectByKey(key interface{}) *StandardCluster {
+	s, _ := c.Lookup(key)
+	return s
+}
+
+// Lookup returns sharded cluster by the key from the cache or the directory
+func (c *DirectoryCluster) Lookup(key interface{}) (*StandardCluster, error) {
+	k := fmt.Sprint(key)
+	if name, ok := c.cache.get(k); ok {
+		return c.getShard(name.(string))
+	}
+
+	name, err := c.directory.Lookup(k)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.getShard(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.cache.set(k, name)
+	return s, nil
+}
+
+// Assign saves the shard name for the key into the directory
+func (c *DirectoryCluster) Assign(key interface{}, shard string) error {
+	if _, err := c.getShard(shard); err != nil {
+		return err
+	}
+
+	k := fmt.Sprint(key)
+	err := c.directory.Assign(k, shard)
+	if err != nil {
+		c.cache.remove(k)
+		return err
+	}
+	c.cache.set(k, shard)
+	return nil
+}
+
+// Purge removes the key from the cache
+func (c *DirectoryCluster) Purge(key interface{}) {
+	c.cache.remove(fmt.Sprint(key))
+}
+
+// RegisterShard adds cluster with the shard name
+func (c *DirectoryCluster) RegisterShard(name string, s *StandardCluster) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.shards[name]; ok {
+		return errors.NewErrShardAlreadyRegistered(name)
+	}
+	c.shards[name] = s
+	c.names = append(c.names, name)
+	return nil
+}
+
+// getShard returns the cluster by the shard name
+func (c *DirectoryCluster) getShard(name string) (*StandardCluster, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s, ok := c.shards[name]
+	if !ok {
+		return nil, errors.NewErrNoShard(name)
+	}
+	return s, nil
+}
+
+// clusters returns all of the registered clusters in registered order
+func (c *DirectoryCluster) clusters() []*StandardCluster {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	list := make([]*StandardCluster, 0, len(c.names))
+	for _, name := range c.names {
+		list = append(list, c.shards[name])
+	}
+	return list
+}
+
+// MemoryDirectory is in-memory ShardDirectory
+type MemoryDirectory struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+// NewMemoryDirectory returns initialized MemoryDirectory
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{
+		data: make(map[string]string),
+	}
+}
+
+// Lookup returns the shard name for the key
+func (d *MemoryDirectory) Lookup(key string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	shard, ok := d.data[key]
+	if !ok {
+		return "", errors.NewErrDirectoryNotFound(key)
+	}
+	return shard, nil
+}
+
+// Assign saves the shard name for the key
+func (d *MemoryDirectory) Assign(key string, shard string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.data[key] = shard
+	return nil
+}
@@ -0,0 +1,120 @@
+package wizard
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCountDirectory struct {
+	*MemoryDirectory
+	count int
+	err   error
+}
+
+func (d *testCountDirectory) Lookup(key string) (string, error) {
+	d.count++
+	return d.MemoryDirectory.Lookup(key)
+}
+
+func (d *testCountDirectory) Assign(key string, shard string) error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.MemoryDirectory.Assign(key, shard)
+}
+
+func TestDirectoryClusterMasters(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDirectoryCluster(NewMemoryDirectory(), 10)
+	assert.Nil(c.Master(), "Master() should be always nil on DirectoryCluster")
+	assert.Nil(c.Slave(), "Slave() should be always nil on DirectoryCluster")
+	assert.Len(c.Masters(), 0)
+
+	c.RegisterShard("shard01", testCreateCluster("shard01"))
+	c.RegisterShard("shard02", testCreateCluster("shard02"))
+	assert.Len(c.Masters(), 2)
+	assert.Equal("shard01-master", c.Masters()[0].DB())
+	assert.Len(c.Slaves(), 2)
+}
+
+func TestDirectoryClusterRegisterShard(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDirectoryCluster(NewMemoryDirectory(), 10)
+	assert.Nil(c.RegisterShard("shard01", testCreateCluster("shard01")))
+	assert.NotNil(c.RegisterShard("shard01", testCreateCluster("shard01")), "Shard name is already registered")
+}
+
+func TestDirectoryClusterLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := &testCountDirectory{MemoryDirectory: NewMemoryDirectory()}
+	dir.MemoryDirectory.Assign("tenant-a", "shard01")
+	dir.MemoryDirectory.Assign("tenant-x", "unknown")
+
+	c := NewDirectoryCluster(dir, 10)
+	c.RegisterShard("shard01", testCreateCluster("shard01"))
+	c.RegisterShard("shard02", testCreateCluster("shard02"))
+
+	s, err := c.Lookup("tenant-a")
+	assert.Nil(err)
+	assert.Equal("shard01-master", s.Master().DB())
+	assert.Equal(1, dir.count)
+
+	s, err = c.Lookup("tenant-a")
+	assert.Nil(err)
+	assert.Equal("shard01-master", s.Master().DB())
+	assert.Equal(1, dir.count, "cached key should not be looked up from the directory")
+
+	c.Purge("tenant-a")
+	c.Lookup("tenant-a")
+	assert.Equal(2, dir.count)
+
+	s, err = c.Lookup("tenant-b")
+	assert.NotNil(err, "key is not found")
+	assert.Nil(s)
+	assert.Nil(c.SelectByKey("tenant-b"))
+
+	s, err = c.Lookup("tenant-x")
+	assert.NotNil(err, "shard is not registered")
+	assert.Nil(s)
+}
+
+func TestDirectoryClusterAssign(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := &testCountDirectory{MemoryDirectory: NewMemoryDirectory()}
+	c := NewDirectoryCluster(dir, 10)
+	c.RegisterShard("shard01", testCreateCluster("shard01"))
+	c.RegisterShard("shard02", testCreateCluster("shard02"))
+
+	assert.NotNil(c.Assign(1, "shard03"), "shard is not registered")
+
+	assert.Nil(c.Assign(1, "shard02"))
+	assert.Equal("shard02-master", c.SelectByKey(1).Master().DB())
+	assert.Equal(0, dir.count, "assigned key should be cached")
+
+	assert.Nil(c.Assign(1, "shard01"))
+	assert.Equal("shard01-master", c.SelectByKey(1).Master().DB())
+
+	dir.err = errors.New("write error")
+	assert.NotNil(c.Assign(1, "shard02"))
+	assert.Equal("shard01-master", c.SelectByKey(1).Master().DB())
+	assert.Equal(1, dir.count, "cache should be purged when assign is failed")
+}
+
+func TestMemoryDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	d := NewMemoryDirectory()
+	_, err := d.Lookup("a")
+	assert.NotNil(err)
+
+	assert.Nil(d.Assign("a", "shard01"))
+	shard, err := d.Lookup("a")
+	assert.Nil(err)
+	assert.Equal("shard01", shard)
+}
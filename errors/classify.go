@@ -0,0 +1,208 @@
+package errors
+
+import (
+	"context"
+	"database/sql/driver"
+	stderrors "errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// MySQL error numbers
+var (
+	mysqlConnectionErrors = map[uint16]bool{
+		1040: true, // too many connections
+		1042: true, // can't get hostname
+		1043: true, // bad handshake
+		1053: true, // server shutdown in progress
+		1077: true, // normal shutdown
+		1078: true, // got signal, aborting
+		1079: true, // shutdown complete
+		1152: true, // aborted connection
+		1158: true, // network read error
+		1159: true, // network read timeout
+		1160: true, // network write error
+		1161: true, // network write timeout
+		2002: true, // can't connect through socket
+		2003: true, // can't connect to server
+		2006: true, // server has gone away
+		2013: true, // lost connection during query
+	}
+	mysqlRetryableErrors = map[uint16]bool{
+		1205: true, // lock wait timeout
+		1213: true, // deadlock
+	}
+	mysqlReadOnlyErrors = map[uint16]bool{
+		1290: true, // read only mode (e.g. during failover)
+		1792: true, // read only transaction
+	}
+)
+
+// PostgreSQL SQLSTATE codes
+var (
+	postgresConnectionErrors = map[string]bool{
+		"57P01": true, // admin_shutdown
+		"57P02": true, // crash_shutdown
+		"57P03": true, // cannot_connect_now
+		"53300": true, // too_many_connections
+	}
+	postgresRetryableErrors = map[string]bool{
+		"40001": true, // serialization_failure
+		"40P01": true, // deadlock_detected
+		"55P03": true, // lock_not_available
+	}
+	postgresReadOnlyErrors = map[string]bool{
+		"25006": true, // read_only_sql_transaction
+	}
+)
+
+// connection error messages of the drivers which do not have the error type
+var connectionErrorMessages = []string{
+	"invalid connection",           // go-sql-driver/mysql ErrInvalidConn
+	"bad connection",               // database/sql/driver ErrBadConn
+	"connection refused",           // syscall ECONNREFUSED
+	"connection reset by peer",     // syscall ECONNRESET
+	"broken pipe",                  // syscall EPIPE
+	"server closed the connection", // lib/pq
+	"use of closed network connection",
+}
+
+// IsConnectionError checks the error is caused by the connection to the database
+// e.g. refused, reset, lost connection, server has gone away, shutdown
+// for the aggregate errors, it returns true when any of the errors is connection error.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if list, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range list.Unwrap() {
+			if IsConnectionError(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case stderrors.Is(err, ErrConfigConnect),
+		stderrors.Is(err, driver.ErrBadConn),
+		stderrors.Is(err, io.ErrUnexpectedEOF),
+		stderrors.Is(err, syscall.ECONNREFUSED),
+		stderrors.Is(err, syscall.ECONNRESET),
+		stderrors.Is(err, syscall.EPIPE):
+		return true
+	}
+
+	var netErr net.Error
+	if stderrors.As(err, &netErr) {
+		return true
+	}
+	if num, ok := mysqlErrorNumber(err); ok {
+		return mysqlConnectionErrors[num]
+	}
+	if state, ok := sqlState(err); ok {
+		// class 08 is connection exception
+		return strings.HasPrefix(state, "08") || postgresConnectionErrors[state]
+	}
+
+	msg := err.Error()
+	for _, m := range connectionErrorMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRetryable checks the operation may succeed by retrying it
+// e.g. connection error, deadlock, lock wait timeout, serialization failure
+// the error of the context is not retryable, because the context is already done.
+// for the aggregate errors, it returns true when all of the errors are retryable.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if list, ok := err.(interface{ Unwrap() []error }); ok {
+		errs := list.Unwrap()
+		for _, e := range errs {
+			if !IsRetryable(e) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+
+	switch {
+	case stderrors.Is(err, context.Canceled),
+		stderrors.Is(err, context.DeadlineExceeded):
+		return false
+	case IsConnectionError(err):
+		return true
+	}
+
+	if num, ok := mysqlErrorNumber(err); ok {
+		return mysqlRetryableErrors[num]
+	}
+	if state, ok := sqlState(err); ok {
+		return postgresRetryableErrors[state]
+	}
+	return false
+}
+
+// IsReadOnlyError checks the error is caused by writing to the read only database
+// it is not retryable by IsRetryable(), because it is permanent except during the failover.
+// e.g. RetryPolicy.SetClassifier(func(err error) bool { return IsRetryable(err) || IsReadOnlyError(err) })
+// for the aggregate errors, it returns true when any of the errors is read only error.
+func IsReadOnlyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if list, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range list.Unwrap() {
+			if IsReadOnlyError(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if num, ok := mysqlErrorNumber(err); ok {
+		return mysqlReadOnlyErrors[num]
+	}
+	if state, ok := sqlState(err); ok {
+		return postgresReadOnlyErrors[state]
+	}
+	return false
+}
+
+// mysqlErrorNumber returns the error number of *mysql.MySQLError without importing the driver
+func mysqlErrorNumber(err error) (uint16, bool) {
+	for err != nil {
+		v := reflect.ValueOf(err)
+		if v.Kind() == reflect.Ptr && !v.IsNil() {
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Struct && v.Type().Name() == "MySQLError" {
+			f := v.FieldByName("Number")
+			if f.IsValid() && f.Kind() == reflect.Uint16 {
+				return uint16(f.Uint()), true
+			}
+		}
+		err = stderrors.Unwrap(err)
+	}
+	return 0, false
+}
+
+// sqlState returns SQLSTATE of the error, e.g. *pq.Error, *pgconn.PgError
+func sqlState(err error) (string, bool) {
+	var e interface {
+		SQLState() string
+	}
+	if stderrors.As(err, &e) {
+		return e.SQLState(), true
+	}
+	return "", false
+}
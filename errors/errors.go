@@ -5,15 +5,84 @@ import (
 	"strings"
 )
 
+// sentinel errors, use errors.Is() to check the kind of the error
+// e.g. errors.Is(err, ErrNilDB)
+var (
+	ErrNilDB                  = Err{Code: 10000, Info: "cannot find db"}
+	ErrNilDBs                 = Err{Code: 10001, Info: "cannot find dbs"}
+	ErrAlreadyRegistered      = Err{Code: 11001, Info: "already registered table"}
+	ErrSlotSizeMin            = Err{Code: 11002, Info: "minimum slot size must be positive integer"}
+	ErrSlotSizeMax            = Err{Code: 11003, Info: "maximum slot size is out of range"}
+	ErrSlotMinOverlapped      = Err{Code: 11004, Info: "minimum slot size is overlapped"}
+	ErrSlotMaxOverlapped      = Err{Code: 11005, Info: "maximum slot size is overlapped"}
+	ErrSlotRangeRequired      = Err{Code: 11006, Info: "hash slot range is required for the shard"}
+	ErrShardAlreadyRegistered = Err{Code: 11007, Info: "already registered shard"}
+	ErrRangeOutOfRange        = Err{Code: 11008, Info: "key is out of all ranges"}
+	ErrRangeOverlapped        = Err{Code: 11009, Info: "range is overlapped"}
+	ErrRangeKeyType           = Err{Code: 11010, Info: "unsupported or mismatched type for range key"}
+	ErrRangeInvalid           = Err{Code: 11011, Info: "lower bound must be less than upper bound"}
+	ErrDirectoryNotFound      = Err{Code: 11012, Info: "cannot find the key in the shard directory"}
+	ErrNoShard                = Err{Code: 11013, Info: "cannot find shard"}
+	ErrUnsupportedStrategy    = Err{Code: 11014, Info: "unsupported operation for the shard strategy"}
+	ErrMigrationOverlapped    = Err{Code: 11015, Info: "migration range is overlapped"}
+	ErrNoMigration            = Err{Code: 11016, Info: "cannot find migration"}
+	ErrInvalidConfiguration   = Err{Code: 11017, Info: "invalid configuration"}
+	ErrSlotRangeOverlapped    = Err{Code: 11018, Info: "slot range contains the other shard"}
+	ErrSlotGap                = Err{Code: 11019, Info: "slots are not covered by any shard"}
+	ErrShardOverlapped        = Err{Code: 11020, Info: "shards are overlapped"}
+	ErrNoShards               = Err{Code: 11021, Info: "no shard is registered"}
+	ErrNoMaster               = Err{Code: 11022, Info: "master is not registered"}
+	ErrConfigFormat           = Err{Code: 12001, Info: "unsupported config format"}
+	ErrConfigInvalid          = Err{Code: 12002, Info: "invalid config"}
+	ErrConfigUnknownCluster   = Err{Code: 12003, Info: "cluster is not defined in the config"}
+	ErrConfigConnect          = Err{Code: 12004, Info: "cannot connect to the database"}
+	ErrNoSession              = Err{Code: 20001, Info: "cannot find session"}
+	ErrDuplicateTx            = Err{Code: 20002, Info: "transaction already exists"}
+	ErrWrongTx                = Err{Code: 20003, Info: "something wrong with the transaction"}
+	ErrCommitAll              = Err{Code: 20004, Info: "commit all error"}
+	ErrRollbackAll            = Err{Code: 20005, Info: "rollback all error"}
+	ErrAnotherTx              = Err{Code: 20006, Info: "another transaction already exists"}
+	ErrDrainTimeout           = Err{Code: 20007, Info: "sessions are still in use after the drain timeout"}
+	ErrTwoPhasePrepare        = Err{Code: 20008, Info: "two-phase commit is aborted"}
+	ErrTwoPhaseInDoubt        = Err{Code: 20009, Info: "two-phase commit is in doubt"}
+	ErrNoCoordinator          = Err{Code: 20010, Info: "two-phase commit coordinator is not set"}
+	ErrTwoPhaseDriver         = Err{Code: 20011, Info: "two-phase commit is not supported"}
+	ErrTwoPhaseRecover        = Err{Code: 20012, Info: "two-phase commit recovery error"}
+	ErrCompensated            = Err{Code: 20013, Info: "commit all is partially failed and compensated"}
+	ErrTwoPhaseSession        = Err{Code: 20014, Info: "the session cannot join two-phase commit"}
+	ErrGTIDPrefix             = Err{Code: 20015, Info: "the prefix of global transaction id is empty"}
+	ErrParallelQuery          = Err{Code: 30001, Info: "parallel query error"}
+	ErrArgType                = Err{Code: 30002, Info: "invalid argument type"}
+	ErrShardTimeout           = Err{Code: 30003, Info: "parallel query is timed out in some of the shards"}
+)
+
+// Err is the error of wizard
+// Name, Key and Slot are the context of the error, and they are empty when not related.
 type Err struct {
 	Code int
 	Info string
+
+	Name    string // name of the table, shard, cluster or db
+	Key     string // shard key or range
+	SlotMin int64
+	SlotMax int64
 }
 
 func (e Err) Error() string {
 	return e.Info
 }
 
+// Is checks the error is the same kind as the target by the code
+func (e Err) Is(target error) bool {
+	switch t := target.(type) {
+	case Err:
+		return e.Code == t.Code
+	case *Err:
+		return t != nil && e.Code == t.Code
+	}
+	return false
+}
+
 func NewErr(code int, msg string) Err {
 	return Err{
 		Code: code,
@@ -21,77 +90,470 @@ func NewErr(code int, msg string) Err {
 	}
 }
 
+// MultiErr is the aggregate error keeping the individual errors
+// the errors occurred on the nodes are NodeErr.
+type MultiErr struct {
+	Err
+	Errors []error
+}
+
+// Unwrap returns the individual errors for errors.Is and errors.As
+func (e MultiErr) Unwrap() []error {
+	return e.Errors
+}
+
+// NodeErrors returns the errors with the node identity
+func (e MultiErr) NodeErrors() []NodeErr {
+	var list []NodeErr
+	for _, err := range e.Errors {
+		if ne, ok := err.(NodeErr); ok {
+			list = append(list, ne)
+		}
+	}
+	return list
+}
+
+// NodeErr is the error occurred on the node of the cluster
+// Shard is the index of the shard in the cluster, -1 means unknown.
+// Node is the db of the node (e.g. *xorm.Engine), nil means the db is not found.
+type NodeErr struct {
+	Shard int
+	Node  interface{}
+	Err   error
+}
+
+func NewNodeErr(shard int, node interface{}, err error) NodeErr {
+	return NodeErr{
+		Shard: shard,
+		Node:  node,
+		Err:   err,
+	}
+}
+
+func (e NodeErr) Error() string {
+	if e.Shard < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("shard=%d: %s", e.Shard, e.Err.Error())
+}
+
+// Unwrap returns the original error
+func (e NodeErr) Unwrap() error {
+	return e.Err
+}
+
 func NewErrNilDB(name interface{}) Err {
-	return Err{Code: 10000, Info: "cannot find db, name=" + fmt.Sprint(name)}
+	return Err{
+		Code: ErrNilDB.Code,
+		Info: "cannot find db, name=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
 }
 
-func NewErrNilDBs(es []error) Err {
+func NewErrNilDBs(es []error) MultiErr {
 	var messages []string
 	for _, err := range es {
 		messages = append(messages, err.Error())
 	}
-	return Err{Code: 10001, Info: strings.Join(messages, " || ")}
+	return MultiErr{
+		Err:    Err{Code: ErrNilDBs.Code, Info: strings.Join(messages, " || ")},
+		Errors: es,
+	}
 }
 
 func NewErrAlreadyRegistared(name interface{}) Err {
-	return Err{Code: 11001, Info: "already registered table name=" + fmt.Sprint(name)}
+	return Err{
+		Code: ErrAlreadyRegistered.Code,
+		Info: "already registered table name=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
 }
 
 func NewErrSlotSizeMin(min int64) Err {
-	return Err{Code: 11002, Info: fmt.Sprintf("minimun slot size must be positive interger, value=%d", min)}
+	return Err{
+		Code:    ErrSlotSizeMin.Code,
+		Info:    fmt.Sprintf("minimun slot size must be positive interger, value=%d", min),
+		SlotMin: min,
+	}
 }
 
 func NewErrSlotSizeMax(max, slot int64) Err {
-	return Err{Code: 11003, Info: fmt.Sprintf("maximum slot size is out of range, DefinedSize=%d GivenSize=%d", slot, max)}
+	return Err{
+		Code:    ErrSlotSizeMax.Code,
+		Info:    fmt.Sprintf("maximum slot size is out of range, DefinedSize=%d GivenSize=%d", slot, max),
+		SlotMax: max,
+	}
 }
 
 func NewErrSlotMinOverlapped(size int64) Err {
-	return Err{Code: 11004, Info: fmt.Sprintf("minimun slot size is overlapped, value=%d", size)}
+	return Err{
+		Code:    ErrSlotMinOverlapped.Code,
+		Info:    fmt.Sprintf("minimun slot size is overlapped, value=%d", size),
+		SlotMin: size,
+	}
 }
 
 func NewErrSlotMaxOverlapped(size int64) Err {
-	return Err{Code: 11005, Info: fmt.Sprintf("maximun slot size is overlapped, value=%d", size)}
+	return Err{
+		Code:    ErrSlotMaxOverlapped.Code,
+		Info:    fmt.Sprintf("maximun slot size is overlapped, value=%d", size),
+		SlotMax: size,
+	}
+}
+
+func NewErrSlotRangeRequired(name interface{}) Err {
+	return Err{
+		Code: ErrSlotRangeRequired.Code,
+		Info: "hash slot range is required for the shard, name=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
+}
+
+func NewErrShardAlreadyRegistered(name interface{}) Err {
+	return Err{
+		Code: ErrShardAlreadyRegistered.Code,
+		Info: "already registered shard name=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
+}
+
+func NewErrRangeOutOfRange(key interface{}) Err {
+	return Err{
+		Code: ErrRangeOutOfRange.Code,
+		Info: "key is out of all ranges, key=" + fmt.Sprint(key),
+		Key:  fmt.Sprint(key),
+	}
+}
+
+func NewErrRangeOverlapped(r interface{}) Err {
+	return Err{
+		Code: ErrRangeOverlapped.Code,
+		Info: "range is overlapped, range=" + fmt.Sprint(r),
+		Key:  fmt.Sprint(r),
+	}
+}
+
+func NewErrRangeKeyType(key interface{}) Err {
+	return Err{
+		Code: ErrRangeKeyType.Code,
+		Info: fmt.Sprintf("unsupported or mismatched type for range key, key=%v type=%T", key, key),
+		Key:  fmt.Sprint(key),
+	}
+}
+
+func NewErrRangeInvalid(r interface{}) Err {
+	return Err{
+		Code: ErrRangeInvalid.Code,
+		Info: "lower bound must be less than upper bound, range=" + fmt.Sprint(r),
+		Key:  fmt.Sprint(r),
+	}
+}
+
+func NewErrDirectoryNotFound(key interface{}) Err {
+	return Err{
+		Code: ErrDirectoryNotFound.Code,
+		Info: "cannot find the key in the shard directory, key=" + fmt.Sprint(key),
+		Key:  fmt.Sprint(key),
+	}
+}
+
+func NewErrNoShard(name interface{}) Err {
+	return Err{
+		Code: ErrNoShard.Code,
+		Info: "cannot find shard, name=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
+}
+
+func NewErrUnsupportedStrategy(name interface{}) Err {
+	return Err{
+		Code: ErrUnsupportedStrategy.Code,
+		Info: "unsupported operation for the shard strategy, strategy=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
+}
+
+func NewErrMigrationOverlapped(r interface{}) Err {
+	return Err{
+		Code: ErrMigrationOverlapped.Code,
+		Info: "migration range is overlapped, range=" + fmt.Sprint(r),
+		Key:  fmt.Sprint(r),
+	}
+}
+
+func NewErrNoMigration(r interface{}) Err {
+	return Err{
+		Code: ErrNoMigration.Code,
+		Info: "cannot find migration, range=" + fmt.Sprint(r),
+		Key:  fmt.Sprint(r),
+	}
+}
+
+// ErrValidation is the list of the problems found in the configuration
+type ErrValidation struct {
+	Err
+	Name     interface{}
+	Problems []error
+}
+
+// Unwrap returns the problems for errors.Is and errors.As
+func (e ErrValidation) Unwrap() []error {
+	return e.Problems
+}
+
+func NewErrValidation(name interface{}, es []error) ErrValidation {
+	messages := []string{}
+	for _, err := range es {
+		messages = append(messages, err.Error())
+	}
+	return ErrValidation{
+		Err:      Err{Code: ErrInvalidConfiguration.Code, Info: "invalid configuration, name=" + fmt.Sprint(name) + ": " + strings.Join(messages, " || ")},
+		Name:     name,
+		Problems: es,
+	}
+}
+
+func NewErrSlotRangeOverlapped(min, max int64) Err {
+	return Err{
+		Code:    ErrSlotRangeOverlapped.Code,
+		Info:    fmt.Sprintf("slot range contains the other shard, range=%d-%d", min, max),
+		SlotMin: min,
+		SlotMax: max,
+	}
+}
+
+func NewErrSlotGap(min, max int64) Err {
+	return Err{
+		Code:    ErrSlotGap.Code,
+		Info:    fmt.Sprintf("slots are not covered by any shard, range=%d-%d", min, max),
+		SlotMin: min,
+		SlotMax: max,
+	}
+}
+
+func NewErrShardOverlapped(a, b interface{}) Err {
+	return Err{
+		Code: ErrShardOverlapped.Code,
+		Info: fmt.Sprintf("shards are overlapped, shard1=%v shard2=%v", a, b),
+		Name: fmt.Sprint(a),
+	}
+}
+
+func NewErrNoShards() Err {
+	return Err{Code: ErrNoShards.Code, Info: "no shard is registered"}
+}
+
+func NewErrNoMaster() Err {
+	return Err{Code: ErrNoMaster.Code, Info: "master is not registered"}
+}
+
+func NewErrConfigFormat(format string) Err {
+	return Err{
+		Code: ErrConfigFormat.Code,
+		Info: "unsupported config format, format=" + format,
+		Name: format,
+	}
+}
+
+func NewErrConfigInvalid(name, reason string) Err {
+	return Err{
+		Code: ErrConfigInvalid.Code,
+		Info: "invalid config, name=" + name + ", reason=" + reason,
+		Name: name,
+	}
+}
+
+func NewErrConfigUnknownCluster(name string) Err {
+	return Err{
+		Code: ErrConfigUnknownCluster.Code,
+		Info: "cluster is not defined in the config, name=" + name,
+		Name: name,
+	}
+}
+
+func NewErrConfigConnect(name string, err error) Err {
+	return Err{
+		Code: ErrConfigConnect.Code,
+		Info: "cannot connect to the database, name=" + name + ", error=" + err.Error(),
+		Name: name,
+	}
 }
 
 func NewErrNoSession(name interface{}) Err {
-	return Err{Code: 20001, Info: "cannot find session, name=" + fmt.Sprint(name)}
+	return Err{
+		Code: ErrNoSession.Code,
+		Info: "cannot find session, name=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
 }
 
 func NewErrDuplicateTx() Err {
-	return Err{Code: 20002, Info: "transaction already exists"}
+	return Err{Code: ErrDuplicateTx.Code, Info: "transaction already exists"}
 }
 
 func NewErrWrongTx() Err {
-	return Err{Code: 20003, Info: "something wrong with the transaction"}
+	return Err{Code: ErrWrongTx.Code, Info: "something wrong with the transaction"}
 }
-func NewErrCommitAll(es []error) Err {
+func NewErrCommitAll(es []error) MultiErr {
 	messages := []string{"commit all error: "}
 	for _, err := range es {
 		messages = append(messages, err.Error())
 	}
-	return Err{Code: 20004, Info: strings.Join(messages, " ")}
+	return MultiErr{
+		Err:    Err{Code: ErrCommitAll.Code, Info: strings.Join(messages, " ")},
+		Errors: es,
+	}
 }
 
-func NewErrRollbackAll(es []error) Err {
+func NewErrRollbackAll(es []error) MultiErr {
 	messages := []string{"rollback all error: "}
 	for _, err := range es {
 		messages = append(messages, err.Error())
 	}
-	return Err{Code: 20005, Info: strings.Join(messages, " ")}
+	return MultiErr{
+		Err:    Err{Code: ErrRollbackAll.Code, Info: strings.Join(messages, " ")},
+		Errors: es,
+	}
 }
 
 func NewErrAnotherTx(name interface{}) Err {
-	return Err{Code: 20006, Info: "transaction already exists, db=" + fmt.Sprint(name)}
+	return Err{
+		Code: ErrAnotherTx.Code,
+		Info: "transaction already exists, db=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
+}
+
+func NewErrDrainTimeout(count int) Err {
+	return Err{Code: ErrDrainTimeout.Code, Info: fmt.Sprintf("sessions are still in use after the drain timeout, engines=%d", count)}
 }
 
-func NewErrParallelQuery(es []error) Err {
+func NewErrTwoPhasePrepare(gtid string, es []error) MultiErr {
+	messages := []string{"two-phase commit is aborted, gtid=" + gtid + ":"}
+	for _, err := range es {
+		messages = append(messages, err.Error())
+	}
+	return MultiErr{
+		Err:    Err{Code: ErrTwoPhasePrepare.Code, Info: strings.Join(messages, " ")},
+		Errors: es,
+	}
+}
+
+func NewErrTwoPhaseInDoubt(gtid string, es []error) MultiErr {
+	messages := []string{"two-phase commit is in doubt and will be resolved by recovery, gtid=" + gtid + ":"}
+	for _, err := range es {
+		messages = append(messages, err.Error())
+	}
+	return MultiErr{
+		Err:    Err{Code: ErrTwoPhaseInDoubt.Code, Info: strings.Join(messages, " ")},
+		Errors: es,
+	}
+}
+
+func NewErrNoCoordinator() Err {
+	return Err{Code: ErrNoCoordinator.Code, Info: "two-phase commit coordinator is not set"}
+}
+
+func NewErrTwoPhaseDriver(driver string) Err {
+	return Err{
+		Code: ErrTwoPhaseDriver.Code,
+		Info: "two-phase commit is not supported, driver=" + driver,
+		Name: driver,
+	}
+}
+
+func NewErrGTIDPrefix() Err {
+	return Err{Code: ErrGTIDPrefix.Code, Info: "the prefix of global transaction id is empty, it must be unique for every process"}
+}
+
+func NewErrTwoPhaseSession(name interface{}) Err {
+	return Err{
+		Code: ErrTwoPhaseSession.Code,
+		Info: "the session cannot join two-phase commit, use Transaction() instead, db=" + fmt.Sprint(name),
+		Name: fmt.Sprint(name),
+	}
+}
+
+func NewErrTwoPhaseRecover(es []error) MultiErr {
+	messages := []string{"two-phase commit recovery error: "}
+	for _, err := range es {
+		messages = append(messages, err.Error())
+	}
+	return MultiErr{
+		Err:    Err{Code: ErrTwoPhaseRecover.Code, Info: strings.Join(messages, " ")},
+		Errors: es,
+	}
+}
+
+// ErrCompensation is the result of CommitAll() which partially failed and ran the compensations
+// the dbs are listed by the status, Failed contains the dbs failed to commit or to compensate.
+type ErrCompensation struct {
+	Err
+	Committed   []interface{}
+	Compensated []interface{}
+	RolledBack  []interface{}
+	Failed      []interface{}
+	Errors      []error
+}
+
+// Unwrap returns the errors of committing and compensating for errors.Is and errors.As
+func (e ErrCompensation) Unwrap() []error {
+	return e.Errors
+}
+
+func NewErrCompensation(committed, compensated, rolledBack, failed []interface{}, es []error) ErrCompensation {
+	messages := []string{}
+	for _, err := range es {
+		messages = append(messages, err.Error())
+	}
+	info := fmt.Sprintf("commit all is partially failed and compensated, committed=%d compensated=%d rolled_back=%d failed=%d: ",
+		len(committed), len(compensated), len(rolledBack), len(failed))
+	return ErrCompensation{
+		Err:         Err{Code: ErrCompensated.Code, Info: info + strings.Join(messages, " || ")},
+		Committed:   committed,
+		Compensated: compensated,
+		RolledBack:  rolledBack,
+		Failed:      failed,
+		Errors:      es,
+	}
+}
+
+func NewErrParallelQuery(es []error) MultiErr {
 	messages := []string{"parallel query error: "}
 	for _, err := range es {
 		messages = append(messages, err.Error())
 	}
-	return Err{Code: 30001, Info: strings.Join(messages, " || ")}
+	return MultiErr{
+		Err:    Err{Code: ErrParallelQuery.Code, Info: strings.Join(messages, " || ")},
+		Errors: es,
+	}
 }
 
 func NewErrArgType(msg string) Err {
-	return Err{Code: 30002, Info: msg}
+	return Err{Code: ErrArgType.Code, Info: msg}
+}
+
+// ErrPartialResult is the error of the parallel query returning the results without the timed out shards
+// TimedOut contains the index of the timed out shards.
+type ErrPartialResult struct {
+	MultiErr
+	TimedOut []int
+}
+
+func NewErrPartialResult(es []error) ErrPartialResult {
+	messages := []string{"parallel query is timed out: "}
+	var shards []int
+	for _, err := range es {
+		messages = append(messages, err.Error())
+		if e, ok := err.(NodeErr); ok {
+			shards = append(shards, e.Shard)
+		}
+	}
+	return ErrPartialResult{
+		MultiErr: MultiErr{
+			Err:    Err{Code: ErrShardTimeout.Code, Info: strings.Join(messages, " || ")},
+			Errors: es,
+		},
+		TimedOut: shards,
+	}
 }
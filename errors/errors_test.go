@@ -0,0 +1,179 @@
+package errors
+
+import (
+	"context"
+	"database/sql/driver"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiErr(t *testing.T) {
+	assert := assert.New(t)
+
+	dupErr := NewErr(1062, "duplicate entry")
+	err := NewErrParallelQuery([]error{
+		NewNodeErr(2, "db2", dupErr),
+		NewNodeErr(5, "db5", io.ErrUnexpectedEOF),
+	})
+	assert.Equal(30001, err.Code)
+	assert.Equal("parallel query error:  || shard=2: duplicate entry || shard=5: unexpected EOF", err.Error())
+	assert.Len(err.Unwrap(), 2)
+
+	assert.True(stderrors.Is(err, dupErr))
+	assert.True(stderrors.Is(err, io.ErrUnexpectedEOF))
+	assert.False(stderrors.Is(err, io.EOF))
+
+	var nodeErr NodeErr
+	assert.True(stderrors.As(err, &nodeErr))
+	assert.Equal(2, nodeErr.Shard)
+	assert.Equal("db2", nodeErr.Node)
+
+	list := err.NodeErrors()
+	assert.Len(list, 2)
+	assert.Equal(5, list[1].Shard)
+	assert.Equal(io.ErrUnexpectedEOF, list[1].Err)
+
+	// the shard is unknown
+	err = NewErrCommitAll([]error{NewNodeErr(-1, "db1", dupErr), io.EOF})
+	assert.Equal("commit all error:  duplicate entry EOF", err.Error())
+	assert.Len(err.NodeErrors(), 1)
+	assert.True(stderrors.Is(err, io.EOF))
+}
+
+func TestMultiErrNested(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewErrNilDBs([]error{NewNodeErr(0, nil, NewErrNilDB("user"))})
+	err := NewErrValidation("wizard", []error{inner})
+	assert.True(stderrors.Is(err, NewErrNilDB("user")))
+
+	var multi MultiErr
+	assert.True(stderrors.As(err, &multi))
+	assert.Equal(10001, multi.Code)
+	assert.Nil(multi.NodeErrors()[0].Node)
+}
+
+func TestSentinel(t *testing.T) {
+	assert := assert.New(t)
+
+	err := NewErrNilDB("user")
+	assert.True(stderrors.Is(err, ErrNilDB))
+	assert.False(stderrors.Is(err, ErrNilDBs))
+	assert.Equal("user", err.Name)
+
+	slotErr := NewErrSlotSizeMin(-1)
+	assert.True(stderrors.Is(slotErr, ErrSlotSizeMin))
+	assert.EqualValues(-1, slotErr.SlotMin)
+
+	wrapped := fmt.Errorf("insert: %w", NewNodeErr(1, "db1", NewErrAnotherTx("user")))
+	assert.True(stderrors.Is(wrapped, ErrAnotherTx))
+
+	multi := NewErrCommitAll([]error{NewNodeErr(0, "db0", NewErrNoSession("user"))})
+	assert.True(stderrors.Is(multi, ErrCommitAll))
+	assert.True(stderrors.Is(multi, ErrNoSession))
+	assert.False(stderrors.Is(multi, ErrRollbackAll))
+}
+
+// MySQLError has the same form of *mysql.MySQLError
+type MySQLError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *MySQLError) Error() string { return e.Message }
+
+// testPgError has the same form of *pq.Error
+type testPgError struct {
+	code string
+}
+
+func (e testPgError) Error() string    { return "pq: " + e.code }
+func (e testPgError) SQLState() string { return e.code }
+
+func TestIsConnectionError(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{driver.ErrBadConn, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{fmt.Errorf("write: %w", syscall.EPIPE), true},
+		{NewErrConfigConnect("user", io.EOF), true},
+		{&MySQLError{Number: 2006, Message: "server has gone away"}, true},
+		{&MySQLError{Number: 1213, Message: "deadlock"}, false},
+		{&MySQLError{Number: 1153, Message: "packet too large"}, false},
+		{testPgError{"08006"}, true},
+		{testPgError{"57P01"}, true},
+		{testPgError{"40001"}, false},
+		{stderrors.New("invalid connection"), true},
+		{NewErrCommitAll([]error{io.EOF, NewNodeErr(1, "db1", driver.ErrBadConn)}), true},
+		{NewErrCommitAll([]error{io.EOF}), false},
+	}
+	for _, tt := range tests {
+		assert.Equal(tt.expected, IsConnectionError(tt.err), "%v", tt.err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{driver.ErrBadConn, true},
+		{&MySQLError{Number: 1213, Message: "deadlock"}, true},
+		{&MySQLError{Number: 1205, Message: "lock wait timeout"}, true},
+		{&MySQLError{Number: 1062, Message: "duplicate entry"}, false},
+		{&MySQLError{Number: 1153, Message: "packet too large"}, false},
+		{&MySQLError{Number: 1290, Message: "read only"}, false},
+		{fmt.Errorf("update: %w", &MySQLError{Number: 1213}), true},
+		{testPgError{"40001"}, true},
+		{testPgError{"40P01"}, true},
+		{testPgError{"23505"}, false},
+		{testPgError{"25006"}, false},
+		{NewErrCommitAll([]error{NewNodeErr(0, "db0", driver.ErrBadConn), testPgError{"40P01"}}), true},
+		{NewErrCommitAll([]error{NewNodeErr(0, "db0", driver.ErrBadConn), io.EOF}), false},
+		{NewErrCommitAll(nil), false},
+	}
+	for _, tt := range tests {
+		assert.Equal(tt.expected, IsRetryable(tt.err), "%v", tt.err)
+	}
+}
+
+func TestIsReadOnlyError(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, false},
+		{&MySQLError{Number: 1290, Message: "read only"}, true},
+		{fmt.Errorf("insert: %w", &MySQLError{Number: 1792}), true},
+		{&MySQLError{Number: 1213, Message: "deadlock"}, false},
+		{testPgError{"25006"}, true},
+		{testPgError{"40001"}, false},
+		{NewErrCommitAll([]error{io.EOF, NewNodeErr(1, "db1", &MySQLError{Number: 1290})}), true},
+		{NewErrCommitAll([]error{NewNodeErr(0, "db0", testPgError{"40001"})}), false},
+		{NewErrCommitAll(nil), false},
+	}
+	for _, tt := range tests {
+		assert.Equal(tt.expected, IsReadOnlyError(tt.err), "%v", tt.err)
+	}
+}
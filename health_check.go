@@ -0,0 +1,203 @@
+package wizard
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultProbeTimeout        = 5 * time.Second
+	defaultFailureThreshold    = 3
+	defaultRecoveryThreshold   = 1
+)
+
+// ProbeFunc is function for checking the database connection
+// e.g. func(db interface{}) error { return db.(*xorm.Engine).Ping() }
+type ProbeFunc func(db interface{}) error
+
+// HealthChecker checks the nodes periodically and marks them healthy or unhealthy
+type HealthChecker struct {
+	probe ProbeFunc
+
+	mu                sync.Mutex
+	interval          time.Duration
+	probeTimeout      time.Duration
+	failureThreshold  int
+	recoveryThreshold int
+	nodes             []*Node
+	failures          map[*Node]int
+	recovers          map[*Node]int
+	probing           map[*Node]bool
+
+	worker worker
+}
+
+// NewHealthChecker returns initialized HealthChecker
+func NewHealthChecker(probe ProbeFunc) *HealthChecker {
+	return &HealthChecker{
+		probe:             probe,
+		interval:          defaultHealthCheckInterval,
+		probeTimeout:      defaultProbeTimeout,
+		failureThreshold:  defaultFailureThreshold,
+		recoveryThreshold: defaultRecoveryThreshold,
+		failures:          make(map[*Node]int),
+		recovers:          make(map[*Node]int),
+		probing:           make(map[*Node]bool),
+	}
+}
+
+// SetInterval sets the interval of health checking
+// the interval is applied on the next Start().
+func (hc *HealthChecker) SetInterval(d time.Duration) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.interval = d
+}
+
+// SetProbeTimeout sets the timeout of each probe, the probe over the timeout is treated as failure
+// zero means no timeout.
+func (hc *HealthChecker) SetProbeTimeout(d time.Duration) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.probeTimeout = d
+}
+
+// SetFailureThreshold sets the number of consecutive failures to mark the node unhealthy
+func (hc *HealthChecker) SetFailureThreshold(i int) {
+	if i < 1 {
+		i = 1
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.failureThreshold = i
+}
+
+// SetRecoveryThreshold sets the number of consecutive successes to mark the node healthy again
+func (hc *HealthChecker) SetRecoveryThreshold(i int) {
+	if i < 1 {
+		i = 1
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.recoveryThreshold = i
+}
+
+// Watch adds all the nodes in the clusters for health checking
+func (hc *HealthChecker) Watch(clusters ...*StandardCluster) {
+	for _, c := range clusters {
+		hc.WatchNodes(c.Nodes()...)
+	}
+}
+
+// WatchShardCluster adds all the nodes in the shards for health checking
+func (hc *HealthChecker) WatchShardCluster(s *ShardCluster) {
+	for _, ss := range s.shards() {
+		if ss.set == nil {
+			continue
+		}
+		hc.Watch(ss.set)
+	}
+}
+
+// WatchNodes adds the nodes for health checking
+func (hc *HealthChecker) WatchNodes(nodes ...*Node) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.nodes = append(hc.nodes, nodes...)
+}
+
+// Start starts health checking on background
+func (hc *HealthChecker) Start() {
+	hc.mu.Lock()
+	interval := hc.interval
+	hc.mu.Unlock()
+	hc.worker.start(interval, hc.Check)
+}
+
+// Stop stops health checking
+func (hc *HealthChecker) Stop() {
+	hc.worker.stopWorker()
+}
+
+// Check probes all of the nodes once and updates their health status
+// the nodes are probed concurrently without the lock, so the hanging probe does not block the other callers.
+func (hc *HealthChecker) Check() {
+	hc.mu.Lock()
+	nodes := make([]*Node, len(hc.nodes))
+	copy(nodes, hc.nodes)
+	timeout := hc.probeTimeout
+	hc.mu.Unlock()
+
+	errList := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, n := range nodes {
+		go func(i int, n *Node) {
+			defer wg.Done()
+			errList[i] = hc.probeNode(n, timeout)
+		}(i, n)
+	}
+	wg.Wait()
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for i, n := range nodes {
+		hc.update(n, errList[i])
+	}
+}
+
+// probeNode probes the node within the timeout
+// while the previous probe of the node is still running, new probe is not started and it's treated as failure.
+func (hc *HealthChecker) probeNode(n *Node, timeout time.Duration) error {
+	hc.mu.Lock()
+	if hc.probing[n] {
+		hc.mu.Unlock()
+		return context.DeadlineExceeded
+	}
+	hc.probing[n] = true
+	hc.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := hc.probe(n.DB())
+		hc.mu.Lock()
+		delete(hc.probing, n)
+		hc.mu.Unlock()
+		done <- err
+	}()
+
+	if timeout <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return context.DeadlineExceeded
+	}
+}
+
+// update updates the health status of the node by the result of the probe
+func (hc *HealthChecker) update(n *Node, err error) {
+	switch {
+	case err != nil:
+		hc.recovers[n] = 0
+		hc.failures[n]++
+		if hc.failures[n] >= hc.failureThreshold {
+			n.setHealthy(false)
+		}
+	case !n.IsHealthy():
+		hc.failures[n] = 0
+		hc.recovers[n]++
+		if hc.recovers[n] >= hc.recoveryThreshold {
+			hc.recovers[n] = 0
+			n.setHealthy(true)
+		}
+	default:
+		hc.failures[n] = 0
+	}
+}
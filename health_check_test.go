@@ -0,0 +1,206 @@
+package wizard
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testProbe struct {
+	mu   sync.Mutex
+	down map[interface{}]bool
+}
+
+func newTestProbe() *testProbe {
+	return &testProbe{down: make(map[interface{}]bool)}
+}
+
+func (p *testProbe) set(db interface{}, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[db] = down
+}
+
+func (p *testProbe) probe(db interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down[db] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestHealthCheckerCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+
+	p := newTestProbe()
+	hc := NewHealthChecker(p.probe)
+	hc.SetFailureThreshold(2)
+	hc.SetRecoveryThreshold(2)
+	hc.Watch(c)
+
+	p.set("slave01", true)
+	hc.Check()
+	assert.True(c.slaves[0].IsHealthy(), "node is healthy until failures reach the threshold")
+	hc.Check()
+	assert.False(c.slaves[0].IsHealthy())
+	assert.True(c.slaves[1].IsHealthy())
+	for i := 0; i < 10; i++ {
+		assert.Equal("slave02", c.Slave().DB(), "unhealthy slave should not be selected")
+	}
+
+	p.set("slave01", false)
+	hc.Check()
+	assert.False(c.slaves[0].IsHealthy(), "node is unhealthy until successes reach the threshold")
+	hc.Check()
+	assert.True(c.slaves[0].IsHealthy())
+}
+
+func TestHealthCheckerFallbackToMaster(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+	c.SetBalancer(NewRoundRobinBalancer())
+
+	p := newTestProbe()
+	hc := NewHealthChecker(p.probe)
+	hc.SetFailureThreshold(1)
+	hc.Watch(c)
+
+	p.set("slave01", true)
+	p.set("slave02", true)
+	hc.Check()
+	assert.Equal("master", c.Slave().DB(), "master is returned when all slaves are unhealthy")
+	assert.Equal("master", c.Slaves()[0].DB())
+}
+
+func TestHealthCheckerWatchShardCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &ShardCluster{slotsize: 2}
+	s.RegisterShard(0, 0, testCreateCluster("shard01"))
+	s.RegisterShard(1, 1, testCreateCluster("shard02"))
+
+	hc := NewHealthChecker(newTestProbe().probe)
+	hc.WatchShardCluster(s)
+	assert.Len(hc.nodes, 8)
+}
+
+func TestWatchShardClusterWhileResharding(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &ShardCluster{slotsize: 1000}
+	s.RegisterShard(0, 999, testCreateCluster("shard01"))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			NewHealthChecker(newTestProbe().probe).WatchShardCluster(s)
+			NewLagMonitor(newTestLagProbe().probe).WatchShardCluster(s)
+		}
+	}()
+	for i := int64(1); i < 200; i++ {
+		s.SplitShard(i, testCreateCluster("shard02"))
+	}
+	close(done)
+	wg.Wait()
+
+	hc := NewHealthChecker(newTestProbe().probe)
+	hc.WatchShardCluster(s)
+	assert.Len(hc.nodes, 4*len(s.shards()))
+}
+
+func TestHealthCheckerStartStop(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+
+	p := newTestProbe()
+	p.set("slave01", true)
+	hc := NewHealthChecker(p.probe)
+	hc.SetFailureThreshold(1)
+	hc.SetInterval(time.Millisecond)
+	hc.Watch(c)
+
+	hc.Start()
+	hc.Start()
+	defer hc.Stop()
+
+	for i := 0; i < 100 && c.slaves[0].IsHealthy(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(c.slaves[0].IsHealthy())
+	hc.Stop()
+	hc.Stop()
+}
+
+func TestHealthCheckerProbeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	started := 0
+	hc := NewHealthChecker(func(db interface{}) error {
+		if db == "slave01" {
+			mu.Lock()
+			started++
+			mu.Unlock()
+			<-release
+		}
+		return nil
+	})
+	hc.SetFailureThreshold(2)
+	hc.SetProbeTimeout(10 * time.Millisecond)
+	hc.Watch(c)
+
+	// the hanging probe does not block the other callers
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.Check()
+		}()
+	}
+	hc.SetInterval(time.Second)
+	hc.WatchNodes()
+	wg.Wait()
+
+	assert.False(c.slaves[0].IsHealthy(), "timed out probe is treated as failure")
+	assert.True(c.slaves[1].IsHealthy())
+	mu.Lock()
+	assert.Equal(1, started, "new probe is not started while the previous one is running")
+	mu.Unlock()
+
+	close(release)
+	for i := 0; i < 100; i++ {
+		hc.Check()
+		if c.slaves[0].IsHealthy() {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(c.slaves[0].IsHealthy())
+}
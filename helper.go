@@ -33,30 +33,40 @@ func (w *Wizard) UseMasters(obj interface{}) []interface{} {
 // UseSlave randomly returns db slave from the slaves
 // if any slave is not set, master is returned
 func (w *Wizard) UseSlave(obj interface{}) interface{} {
+	return nodeDB(w.UseSlaveNode(obj))
+}
+
+// UseSlaveNode returns the slave node selected by the balancer
+// if any slave is not set, master is returned
+func (w *Wizard) UseSlaveNode(obj interface{}) *Node {
 	cluster := w.Select(obj)
 	if cluster == nil {
 		return nil
 	}
-	db := cluster.Slave()
-	if db == nil {
-		return nil
-	}
-	return db.DB()
+	return cluster.Slave()
 }
 
 // UseSlaves randomly returns all db slave instances for sharding
 func (w *Wizard) UseSlaves(obj interface{}) []interface{} {
 	var results []interface{}
+	for _, node := range w.UseSlaveNodes(obj) {
+		results = append(results, node.DB())
+	}
+	return results
+}
+
+// UseSlaveNodes returns the slave nodes of all shards
+func (w *Wizard) UseSlaveNodes(obj interface{}) []*Node {
+	var results []*Node
 	c := w.getCluster(obj)
 	if c == nil {
 		return results
 	}
 	for _, node := range c.Slaves() {
-		db := node.DB()
-		if db == nil {
+		if node == nil || node.DB() == nil {
 			continue
 		}
-		results = append(results, db)
+		results = append(results, node)
 	}
 	return results
 }
@@ -77,13 +87,51 @@ func (w *Wizard) UseMasterByKey(obj interface{}, key interface{}) interface{} {
 // UseSlaveByKey randomly returns db slave for sharding by shard key
 // if any slave is not set in the cluster, master is returned
 func (w *Wizard) UseSlaveByKey(obj interface{}, key interface{}) interface{} {
+	return nodeDB(w.UseSlaveNodeByKey(obj, key))
+}
+
+// UseSlaveNodeByKey returns the slave node selected by the balancer for the shard key
+// if any slave is not set in the cluster, master is returned
+func (w *Wizard) UseSlaveNodeByKey(obj interface{}, key interface{}) *Node {
 	cluster := w.SelectByKey(obj, key)
 	if cluster == nil {
 		return nil
 	}
-	db := cluster.Slave()
-	if db == nil {
+	return cluster.Slave()
+}
+
+// UseMigrationMasters returns db masters of the migration destinations for the object
+func (w *Wizard) UseMigrationMasters(obj interface{}) []interface{} {
+	return mastersOf(w.SelectMigrationTargets(obj))
+}
+
+// UseMigrationMastersByKey returns db masters of the migration destinations for the shard key
+func (w *Wizard) UseMigrationMastersByKey(obj interface{}, key interface{}) []interface{} {
+	return mastersOf(w.SelectMigrationTargetsByKey(obj, key))
+}
+
+// UseAllMigrationMasters returns db masters of the destinations of all migrations for the object
+func (w *Wizard) UseAllMigrationMasters(obj interface{}) []interface{} {
+	return mastersOf(w.SelectAllMigrationTargets(obj))
+}
+
+// mastersOf returns db masters of the clusters
+func mastersOf(clusters []*StandardCluster) []interface{} {
+	var results []interface{}
+	for _, c := range clusters {
+		node := c.Master()
+		if node == nil || node.DB() == nil {
+			continue
+		}
+		results = append(results, node.DB())
+	}
+	return results
+}
+
+// nodeDB returns db of the node
+func nodeDB(node *Node) interface{} {
+	if node == nil {
 		return nil
 	}
-	return db.DB()
+	return node.DB()
 }
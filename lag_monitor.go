@@ -0,0 +1,161 @@
+package wizard
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultLagCheckInterval = 5 * time.Second
+
+// LagProbeFunc is function for getting the replication lag of the slave database
+// e.g. returns `Seconds_Behind_Master` of `SHOW SLAVE STATUS` on MySQL
+type LagProbeFunc func(db interface{}) (time.Duration, error)
+
+// LagMonitor checks the replication lag of the slaves periodically
+type LagMonitor struct {
+	probe LagProbeFunc
+
+	mu           sync.Mutex
+	interval     time.Duration
+	probeTimeout time.Duration
+	nodes        []*Node
+	probing      map[*Node]bool
+
+	worker worker
+}
+
+// NewLagMonitor returns initialized LagMonitor
+func NewLagMonitor(probe LagProbeFunc) *LagMonitor {
+	return &LagMonitor{
+		probe:        probe,
+		interval:     defaultLagCheckInterval,
+		probeTimeout: defaultProbeTimeout,
+		probing:      make(map[*Node]bool),
+	}
+}
+
+// SetInterval sets the interval of lag checking
+// the interval is applied on the next Start().
+func (m *LagMonitor) SetInterval(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.interval = d
+}
+
+// SetProbeTimeout sets the timeout of each probe, the lag of the probe over the timeout is regarded as unknown
+// zero means no timeout.
+func (m *LagMonitor) SetProbeTimeout(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.probeTimeout = d
+}
+
+// Watch adds all the slaves in the clusters for lag checking
+func (m *LagMonitor) Watch(clusters ...*StandardCluster) {
+	for _, c := range clusters {
+		m.WatchNodes(c.slaves...)
+	}
+}
+
+// WatchShardCluster adds all the slaves in the shards for lag checking
+func (m *LagMonitor) WatchShardCluster(s *ShardCluster) {
+	for _, ss := range s.shards() {
+		if ss.set == nil {
+			continue
+		}
+		m.Watch(ss.set)
+	}
+}
+
+// WatchNodes adds the nodes for lag checking
+func (m *LagMonitor) WatchNodes(nodes ...*Node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes = append(m.nodes, nodes...)
+}
+
+// Start starts lag checking on background
+func (m *LagMonitor) Start() {
+	m.mu.Lock()
+	interval := m.interval
+	m.mu.Unlock()
+	m.worker.start(interval, m.Check)
+}
+
+// Stop stops lag checking
+func (m *LagMonitor) Stop() {
+	m.worker.stopWorker()
+}
+
+// Check probes all of the nodes once and updates their replication lag
+// when the probe fails, the lag is regarded as unknown
+// the nodes are probed concurrently without the lock, so the hanging probe does not block the other callers.
+func (m *LagMonitor) Check() {
+	m.mu.Lock()
+	nodes := make([]*Node, len(m.nodes))
+	copy(nodes, m.nodes)
+	timeout := m.probeTimeout
+	m.mu.Unlock()
+
+	lags := make([]time.Duration, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, n := range nodes {
+		go func(i int, n *Node) {
+			defer wg.Done()
+			lag, err := m.probeNode(n, timeout)
+			if err != nil {
+				lag = lagUnknown
+			}
+			lags[i] = lag
+		}(i, n)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, n := range nodes {
+		n.setLag(lags[i])
+	}
+}
+
+// lagResult is the result of the lag probe
+type lagResult struct {
+	lag time.Duration
+	err error
+}
+
+// probeNode probes the node within the timeout
+// while the previous probe of the node is still running, new probe is not started and the lag is unknown.
+func (m *LagMonitor) probeNode(n *Node, timeout time.Duration) (time.Duration, error) {
+	m.mu.Lock()
+	if m.probing[n] {
+		m.mu.Unlock()
+		return 0, context.DeadlineExceeded
+	}
+	m.probing[n] = true
+	m.mu.Unlock()
+
+	done := make(chan lagResult, 1)
+	go func() {
+		lag, err := m.probe(n.DB())
+		m.mu.Lock()
+		delete(m.probing, n)
+		m.mu.Unlock()
+		done <- lagResult{lag: lag, err: err}
+	}()
+
+	if timeout <= 0 {
+		r := <-done
+		return r.lag, r.err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.lag, r.err
+	case <-timer.C:
+		return 0, context.DeadlineExceeded
+	}
+}
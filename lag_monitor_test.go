@@ -0,0 +1,156 @@
+package wizard
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLagProbe struct {
+	mu   sync.Mutex
+	lags map[interface{}]time.Duration
+}
+
+func newTestLagProbe() *testLagProbe {
+	return &testLagProbe{lags: make(map[interface{}]time.Duration)}
+}
+
+func (p *testLagProbe) set(db interface{}, lag time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lags[db] = lag
+}
+
+func (p *testLagProbe) probe(db interface{}) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lag, ok := p.lags[db]
+	if !ok {
+		return 0, errors.New("cannot get slave status")
+	}
+	return lag, nil
+}
+
+func TestLagMonitorCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+	c.SetMaxLag(3 * time.Second)
+
+	p := newTestLagProbe()
+	p.set("slave01", 10*time.Second)
+	p.set("slave02", time.Second)
+	m := NewLagMonitor(p.probe)
+	m.Watch(c)
+	assert.Len(m.nodes, 2, "only slaves are watched")
+
+	m.Check()
+	assert.Equal(10*time.Second, c.slaves[0].Lag())
+	assert.Equal(time.Second, c.slaves[1].Lag())
+	for i := 0; i < 10; i++ {
+		assert.Equal("slave02", c.Slave().DB(), "lagging slave should not be selected")
+	}
+
+	p.set("slave01", 0)
+	m.Check()
+	assert.Len(c.availableSlaves(), 2)
+}
+
+func TestLagMonitorFallbackToMaster(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+	c.SetMaxLag(time.Second)
+
+	p := newTestLagProbe()
+	p.set("slave01", 10*time.Second)
+	m := NewLagMonitor(p.probe)
+	m.Watch(c)
+
+	m.Check()
+	assert.Equal(lagUnknown, c.slaves[1].Lag(), "lag is unknown when probe fails")
+	assert.Equal("master", c.Slave().DB(), "master is returned when all slaves are lagging")
+
+	c.SetMaxLag(0)
+	assert.NotEqual("master", c.Slave().DB(), "lag is ignored when max lag is not set")
+}
+
+func TestLagMonitorStartStop(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+
+	p := newTestLagProbe()
+	p.set("slave01", time.Minute)
+	m := NewLagMonitor(p.probe)
+	m.SetInterval(time.Millisecond)
+	m.Watch(c)
+
+	m.Start()
+	defer m.Stop()
+
+	for i := 0; i < 100 && c.slaves[0].Lag() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(time.Minute, c.slaves[0].Lag())
+}
+
+func TestLagMonitorProbeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("master")
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	started := 0
+	m := NewLagMonitor(func(db interface{}) (time.Duration, error) {
+		if db == "slave01" {
+			mu.Lock()
+			started++
+			mu.Unlock()
+			<-release
+		}
+		return time.Second, nil
+	})
+	m.SetProbeTimeout(10 * time.Millisecond)
+	m.Watch(c)
+
+	// the hanging probe does not block the other callers
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Check()
+		}()
+	}
+	m.SetInterval(time.Second)
+	m.WatchNodes()
+	wg.Wait()
+
+	assert.Equal(lagUnknown, c.slaves[0].Lag(), "lag of timed out probe is unknown")
+	assert.Equal(time.Second, c.slaves[1].Lag())
+	mu.Lock()
+	assert.Equal(1, started, "new probe is not started while the previous one is running")
+	mu.Unlock()
+
+	close(release)
+	for i := 0; i < 100; i++ {
+		m.Check()
+		if c.slaves[0].Lag() == time.Second {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(time.Second, c.slaves[0].Lag())
+}
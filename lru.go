@@ -0,0 +1,88 @@
+package wizard
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is fixed size cache which evicts the least recently used entry
+type lruCache struct {
+	size int
+
+	mu    sync.Mutex
+	list  *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRUCache returns initialized lruCache
+// if size is not positive, nothing is cached
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		list:  list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached value
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.list.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// set saves the value and evicts the oldest entry when the cache is full
+func (c *lruCache) set(key string, value interface{}) {
+	if c.size < 1 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.list.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.list.PushFront(&lruEntry{key: key, value: value})
+	if c.list.Len() <= c.size {
+		return
+	}
+
+	oldest := c.list.Back()
+	c.list.Remove(oldest)
+	delete(c.items, oldest.Value.(*lruEntry).key)
+}
+
+// remove deletes the cached value
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.list.Remove(e)
+	delete(c.items, key)
+}
+
+// len returns the number of the cached entries
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list.Len()
+}
@@ -0,0 +1,43 @@
+package wizard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newLRUCache(2)
+	_, ok := c.get("a")
+	assert.False(ok)
+
+	c.set("a", 1)
+	c.set("b", 2)
+	v, ok := c.get("a")
+	assert.True(ok)
+	assert.Equal(1, v)
+
+	c.set("c", 3)
+	assert.Equal(2, c.len())
+	_, ok = c.get("b")
+	assert.False(ok, "least recently used entry should be evicted")
+	_, ok = c.get("a")
+	assert.True(ok)
+
+	c.set("a", 10)
+	v, _ = c.get("a")
+	assert.Equal(10, v)
+	assert.Equal(2, c.len())
+
+	c.remove("a")
+	_, ok = c.get("a")
+	assert.False(ok)
+	assert.Equal(1, c.len())
+
+	c = newLRUCache(0)
+	c.set("a", 1)
+	_, ok = c.get("a")
+	assert.False(ok, "nothing is cached when size is zero")
+}
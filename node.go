@@ -1,16 +1,87 @@
 package wizard
 
+import (
+	"sync/atomic"
+	"time"
+)
+
+// lagUnknown is used when the replication lag cannot be measured
+const lagUnknown time.Duration = -1
+
 // Node is struct for single database instance
 type Node struct {
-	db interface{} // db connection
+	db       interface{} // db connection
+	weight   int         // weight for slave balancing
+	inFlight int64       // number of in-flight queries
+
+	unhealthy int32 // marked by HealthChecker
+	lag       int64 // replication lag measured by LagMonitor
 }
 
 // NewNode returns initialized Node
 func NewNode(db interface{}) *Node {
-	return &Node{db: db}
+	return &Node{
+		db:     db,
+		weight: 1,
+	}
 }
 
 // DB is used for returning database connection
 func (n *Node) DB() interface{} {
 	return n.db
 }
+
+// Weight returns the weight for slave balancing
+func (n *Node) Weight() int {
+	return n.weight
+}
+
+// InFlight returns the number of in-flight queries on the node
+func (n *Node) InFlight() int64 {
+	return atomic.LoadInt64(&n.inFlight)
+}
+
+// Acquire increments the number of in-flight queries
+func (n *Node) Acquire() {
+	atomic.AddInt64(&n.inFlight, 1)
+}
+
+// Release decrements the number of in-flight queries
+func (n *Node) Release() {
+	atomic.AddInt64(&n.inFlight, -1)
+}
+
+// IsHealthy checks the node is marked healthy or not
+func (n *Node) IsHealthy() bool {
+	return atomic.LoadInt32(&n.unhealthy) == 0
+}
+
+// setHealthy changes the health status of the node
+func (n *Node) setHealthy(b bool) {
+	if b {
+		atomic.StoreInt32(&n.unhealthy, 0)
+		return
+	}
+	atomic.StoreInt32(&n.unhealthy, 1)
+}
+
+// Lag returns the replication lag measured by LagMonitor
+// if the lag cannot be measured, minus value is returned
+func (n *Node) Lag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&n.lag))
+}
+
+// setLag changes the replication lag of the node
+func (n *Node) setLag(d time.Duration) {
+	atomic.StoreInt64(&n.lag, int64(d))
+}
+
+// isLagging checks the replication lag is over the limit or unknown
+// if max is not positive, always returns false
+func (n *Node) isLagging(max time.Duration) bool {
+	if max <= 0 {
+		return false
+	}
+	lag := n.Lag()
+	return lag < 0 || lag > max
+}
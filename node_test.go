@@ -2,6 +2,7 @@ package wizard
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -29,3 +30,32 @@ func TestDB(t *testing.T) {
 	n = NewNode(TestDB{})
 	assert.Equal(TestDB{}, n.DB(), "db should equal to Node.db")
 }
+
+func TestNodeInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	n := NewNode("db")
+	assert.EqualValues(0, n.InFlight())
+
+	n.Acquire()
+	n.Acquire()
+	assert.EqualValues(2, n.InFlight())
+
+	n.Release()
+	assert.EqualValues(1, n.InFlight())
+}
+
+func TestNodeIsLagging(t *testing.T) {
+	assert := assert.New(t)
+
+	n := NewNode("db")
+	assert.False(n.isLagging(time.Second))
+
+	n.setLag(2 * time.Second)
+	assert.True(n.isLagging(time.Second))
+	assert.False(n.isLagging(2 * time.Second))
+	assert.False(n.isLagging(0), "no limit when max lag is zero")
+
+	n.setLag(lagUnknown)
+	assert.True(n.isLagging(time.Second), "unknown lag is regarded as lagging")
+}
@@ -0,0 +1,443 @@
+package xorm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// AggregateRow is the row of the aggregate result
+// the values are keyed by the group column and the alias of the aggregate.
+// COUNT is int64, SUM is int64 or float64, AVG is float64, and NULL is nil.
+type AggregateRow map[string]interface{}
+
+// Int64 returns the value as int64
+func (r AggregateRow) Int64(name string) int64 {
+	switch v := r[name].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	}
+	return 0
+}
+
+// Float64 returns the value as float64
+func (r AggregateRow) Float64(name string) float64 {
+	switch v := r[name].(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
+// String returns the value as string
+func (r AggregateRow) String(name string) string {
+	v, ok := r[name]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// AggregateParallelByCondition executes the aggregate query to all of the shards and merges the results
+func (xpr *XormParallel) AggregateParallelByCondition(cond FindCondition) ([]AggregateRow, error) {
+	return xpr.AggregateParallelByConditionContext(context.Background(), cond)
+}
+
+// AggregateParallelByConditionContext executes the aggregate query to all of the shards with the context and merges the results
+// AVG is executed as SUM and COUNT in each shard, the partial results are re-grouped by Group,
+// and then HavingBy, OrderBy, Limit and Offset are applied to the merged results.
+func (xpr *XormParallel) AggregateParallelByConditionContext(ctx context.Context, cond FindCondition) ([]AggregateRow, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateAggregate(cond); err != nil {
+		return nil, err
+	}
+
+	// execute query
+	result, err := xpr.execute(ctx, xpr.createAggregateSessions(cond), func(s Session, r *ShardResult) error {
+		rows, err := s.QueryInterface()
+		r.Rows = rows
+		r.Count = int64(len(rows))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	partials := make([][]map[string]interface{}, len(result.Shards))
+	for i, r := range result.Shards {
+		if r.Err == nil {
+			partials[i] = r.Rows.([]map[string]interface{})
+		}
+	}
+	if err := xpr.resultError(result, xpr.partialResults); err != nil {
+		if _, ok := err.(errors.ErrPartialResult); !ok {
+			return nil, err
+		}
+		list, _ := mergeAggregates(cond, partials)
+		return list, err
+	}
+	return mergeAggregates(cond, partials)
+}
+
+// validateAggregate checks the condition can be merged across the shards
+func validateAggregate(cond FindCondition) error {
+	if len(cond.Aggregates) == 0 {
+		return errors.NewErrArgType("aggregate column is required")
+	}
+	if len(cond.Havings) > 0 {
+		return errors.NewErrArgType("Having cannot be merged across the shards, use HavingBy")
+	}
+
+	names := make(map[string]bool)
+	for _, g := range cond.Group {
+		names[g] = true
+	}
+	for _, a := range cond.Aggregates {
+		switch a.Func {
+		case AggregateCount, AggregateSum, AggregateMin, AggregateMax, AggregateAvg:
+		default:
+			return errors.NewErrArgType("unsupported aggregate function: " + string(a.Func))
+		}
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(a.Column)), "DISTINCT") {
+			return errors.NewErrArgType("DISTINCT cannot be merged across the shards: " + a.Column)
+		}
+		if a.Alias == "" {
+			return errors.NewErrArgType("alias is required for the aggregate: " + a.Column)
+		}
+		names[a.Alias] = true
+	}
+
+	for _, h := range cond.HavingBys {
+		if !names[h.Name] {
+			return errors.NewErrArgType("unknown column for HavingBy: " + h.Name)
+		}
+		if _, ok := havingOperators[h.Operator]; !ok {
+			return errors.NewErrArgType("unsupported operator for HavingBy: " + h.Operator)
+		}
+	}
+	for _, o := range cond.OrderBy {
+		if !names[o.Name] {
+			return errors.NewErrArgType("unknown column for OrderBy: " + o.Name)
+		}
+	}
+	return nil
+}
+
+// the aliases of the columns in the query for each shard
+func groupAlias(i int) string     { return fmt.Sprintf("wizard_g%d", i) }
+func aggregateAlias(i int) string { return fmt.Sprintf("wizard_a%d", i) }
+func avgCountAlias(i int) string  { return fmt.Sprintf("wizard_a%d_count", i) }
+
+// createAggregateSessions creates new sessions with the partial aggregate query for each shard
+func (xpr *XormParallel) createAggregateSessions(cond FindCondition) []shardSession {
+	defer xpr.orm.usage.pin()()
+	var columns []string
+	for i, g := range cond.Group {
+		columns = append(columns, g+" AS "+groupAlias(i))
+	}
+	for i, a := range cond.Aggregates {
+		switch a.Func {
+		case AggregateAvg:
+			columns = append(columns,
+				"SUM("+a.Column+") AS "+aggregateAlias(i),
+				"COUNT("+a.Column+") AS "+avgCountAlias(i),
+			)
+		default:
+			columns = append(columns, string(a.Func)+"("+a.Column+") AS "+aggregateAlias(i))
+		}
+	}
+
+	var sessions []shardSession
+	slaves, nodes := xpr.orm.slaveNodes(cond.Table)
+	for i, slave := range slaves {
+		s := xpr.orm.openSession(slave, nodes[i])
+		s.Table(cond.Table)
+		s.Select(strings.Join(columns, ", "))
+		for _, w := range cond.Where {
+			s.And(w.Statement, w.Args...)
+		}
+		for _, in := range cond.WhereIn {
+			s.In(in.Statement, in.Args...)
+		}
+		if len(cond.Group) > 0 {
+			s.GroupBy(strings.Join(cond.Group, ", "))
+		}
+		sessions = append(sessions, shardSession{Session: s, shard: i, db: slave})
+	}
+	return sessions
+}
+
+// aggregateState is the merging state of the aggregate
+type aggregateState struct {
+	count   int64
+	sum     float64
+	intSum  int64
+	isFloat bool
+	values  []interface{} // the partial results of MIN or MAX
+	valid   bool
+}
+
+// add merges the partial result of the shard
+func (st *aggregateState) add(fn AggregateFunc, v, count interface{}) {
+	switch fn {
+	case AggregateCount:
+		n, _ := toNumber(v)
+		st.count += asInt64(n)
+		st.valid = true
+	case AggregateSum, AggregateAvg:
+		if fn == AggregateAvg {
+			n, _ := toNumber(count)
+			st.count += asInt64(n)
+		}
+		n, ok := toNumber(v)
+		if !ok {
+			return
+		}
+		switch x := n.(type) {
+		case int64:
+			st.intSum += x
+			st.sum += float64(x)
+		case float64:
+			st.isFloat = true
+			st.sum += x
+		}
+		st.valid = true
+	case AggregateMin, AggregateMax:
+		n := normalizeQueryValue(v)
+		if n == nil {
+			return
+		}
+		st.values = append(st.values, n)
+		st.valid = true
+	}
+}
+
+// extreme returns MIN or MAX of the partial results
+// the values are compared as the numbers only when all of them are numeric,
+// otherwise they are compared as they are, e.g. "007" of the string column is kept.
+func (st *aggregateState) extreme(fn AggregateFunc) interface{} {
+	values := make([]interface{}, len(st.values))
+	for i, v := range st.values {
+		n, ok := toNumber(v)
+		if !ok {
+			values = st.values
+			break
+		}
+		values[i] = n
+	}
+
+	var result interface{}
+	for i, v := range values {
+		c := compareValues(reflect.ValueOf(v), reflect.ValueOf(result))
+		if i == 0 || (fn == AggregateMin && c < 0) || (fn == AggregateMax && c > 0) {
+			result = v
+		}
+	}
+	return result
+}
+
+// result returns the merged value
+func (st *aggregateState) result(fn AggregateFunc) interface{} {
+	switch {
+	case fn == AggregateCount:
+		return st.count
+	case !st.valid:
+		return nil
+	case fn == AggregateAvg:
+		if st.count == 0 {
+			return nil
+		}
+		return st.sum / float64(st.count)
+	case fn == AggregateSum && st.isFloat:
+		return st.sum
+	case fn == AggregateSum:
+		return st.intSum
+	}
+	return st.extreme(fn)
+}
+
+// aggregateGroup is the merging group of the partial results
+type aggregateGroup struct {
+	keys   []interface{}
+	states []aggregateState
+}
+
+// mergeAggregates re-groups the partial results of the shards and applies HavingBy, OrderBy, Limit and Offset
+func mergeAggregates(cond FindCondition, partials [][]map[string]interface{}) ([]AggregateRow, error) {
+	var groups []*aggregateGroup
+	index := make(map[string]*aggregateGroup)
+	for _, rows := range partials {
+		for _, row := range rows {
+			keys := make([]interface{}, len(cond.Group))
+			for i := range cond.Group {
+				keys[i] = normalizeQueryValue(row[groupAlias(i)])
+			}
+			k := groupKey(keys)
+			g, ok := index[k]
+			if !ok {
+				g = &aggregateGroup{
+					keys:   keys,
+					states: make([]aggregateState, len(cond.Aggregates)),
+				}
+				index[k] = g
+				groups = append(groups, g)
+			}
+			for i, a := range cond.Aggregates {
+				g.states[i].add(a.Func, row[aggregateAlias(i)], row[avgCountAlias(i)])
+			}
+		}
+	}
+	if len(cond.Group) == 0 && len(groups) == 0 {
+		// aggregate without GROUP BY always returns one row
+		groups = append(groups, &aggregateGroup{states: make([]aggregateState, len(cond.Aggregates))})
+	}
+
+	var list []AggregateRow
+	for _, g := range groups {
+		row := make(AggregateRow, len(cond.Group)+len(cond.Aggregates))
+		for i, name := range cond.Group {
+			row[name] = g.keys[i]
+		}
+		for i, a := range cond.Aggregates {
+			row[a.Alias] = g.states[i].result(a.Func)
+		}
+		if matchHavings(row, cond.HavingBys) {
+			list = append(list, row)
+		}
+	}
+
+	// sort by OrderBy, and then by Group for the stable result
+	orders := cond.OrderBy
+	for _, name := range cond.Group {
+		orders = append(orders, Order{Name: name})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		for _, o := range orders {
+			c := compareValuesWith(reflect.ValueOf(list[i][o.Name]), reflect.ValueOf(list[j][o.Name]), o.Compare)
+			if c == 0 {
+				continue
+			}
+			if o.OrderByDesc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	switch {
+	case cond.Offset >= len(list):
+		return []AggregateRow{}, nil
+	case cond.Offset > 0:
+		list = list[cond.Offset:]
+	}
+	if cond.Limit > 0 && cond.Limit < len(list) {
+		list = list[:cond.Limit]
+	}
+	return list, nil
+}
+
+// groupKey returns the key of the group values
+func groupKey(keys []interface{}) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		if k == nil {
+			parts[i] = "\x00"
+			continue
+		}
+		parts[i] = fmt.Sprintf("%T:%v", k, k)
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+// havingOperators are the operators for HavingBy with the matcher of the compared result
+var havingOperators = map[string]func(int) bool{
+	"=":  func(c int) bool { return c == 0 },
+	"==": func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<>": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+// matchHavings checks the merged row matches all of the conditions
+// NULL does not match any conditions as same as SQL.
+func matchHavings(row AggregateRow, havings []HavingCondition) bool {
+	for _, h := range havings {
+		v := row[h.Name]
+		if v == nil || h.Value == nil {
+			return false
+		}
+		c := compareValues(reflect.ValueOf(v), reflect.ValueOf(h.Value))
+		if !havingOperators[h.Operator](c) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeQueryValue converts the value of the query result into the comparable value
+// e.g. []byte => string, int32 => int64
+func normalizeQueryValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return string(x)
+	}
+	n, isNull := columnValue(reflect.ValueOf(v))
+	if isNull {
+		return nil
+	}
+	return n
+}
+
+// toNumber converts the value of the query result into int64 or float64
+// the drivers return DECIMAL as []byte or string.
+func toNumber(v interface{}) (interface{}, bool) {
+	switch x := normalizeQueryValue(v).(type) {
+	case int64:
+		return x, true
+	case uint64:
+		return int64(x), true
+	case float64:
+		return x, true
+	case string:
+		if i, err := strconv.ParseInt(x, 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func asInt64(v interface{}) int64 {
+	switch x := v.(type) {
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package xorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAggregate(t *testing.T) {
+	assert := assert.New(t)
+
+	cond := NewFindCondition(testUser{})
+	assert.NotNil(validateAggregate(cond), "aggregate is required")
+
+	cond.GroupBy("name")
+	cond.Aggregate(AggregateAvg, "price", "avg_price")
+	cond.HavingBy("avg_price", ">=", 100)
+	cond.OrderByAsc("name")
+	assert.Nil(validateAggregate(cond))
+
+	tests := []func(c *FindCondition){
+		func(c *FindCondition) { c.Aggregate("MEDIAN", "price", "m") },
+		func(c *FindCondition) { c.Aggregate(AggregateCount, "DISTINCT user_id", "users") },
+		func(c *FindCondition) { c.Aggregate(AggregateSum, "price", "") },
+		func(c *FindCondition) { c.HavingBy("unknown", ">", 1) },
+		func(c *FindCondition) { c.HavingBy("avg_price", "LIKE", 1) },
+		func(c *FindCondition) { c.OrderByDesc("price") },
+		func(c *FindCondition) { c.Having("SUM(price) > 1") },
+	}
+	for i, fn := range tests {
+		c := cond
+		c.Aggregates = append([]Aggregate{}, cond.Aggregates...)
+		fn(&c)
+		assert.NotNil(validateAggregate(c), "case %d", i)
+	}
+}
+
+func TestMergeAggregates(t *testing.T) {
+	assert := assert.New(t)
+
+	cond := NewFindCondition(testUser{})
+	cond.GroupBy("category")
+	cond.Aggregate(AggregateCount, "*", "cnt")
+	cond.Aggregate(AggregateSum, "price", "total")
+	cond.Aggregate(AggregateAvg, "price", "avg_price")
+	cond.Aggregate(AggregateMin, "price", "min_price")
+	cond.Aggregate(AggregateMax, "created", "last")
+
+	partials := [][]map[string]interface{}{
+		{
+			{"wizard_g0": []byte("book"), "wizard_a0": int64(2), "wizard_a1": int64(30), "wizard_a2": int64(30), "wizard_a2_count": int64(2), "wizard_a3": int64(10), "wizard_a4": "2018-01-02"},
+			{"wizard_g0": []byte("food"), "wizard_a0": int64(1), "wizard_a1": []byte("5.5"), "wizard_a2": []byte("5.5"), "wizard_a2_count": int64(1), "wizard_a3": []byte("5.5"), "wizard_a4": "2018-01-01"},
+		},
+		{
+			{"wizard_g0": []byte("book"), "wizard_a0": int64(1), "wizard_a1": int64(60), "wizard_a2": int64(60), "wizard_a2_count": int64(1), "wizard_a3": int64(60), "wizard_a4": "2018-01-03"},
+			{"wizard_g0": nil, "wizard_a0": int64(1), "wizard_a1": nil, "wizard_a2": nil, "wizard_a2_count": int64(0), "wizard_a3": nil, "wizard_a4": nil},
+		},
+		nil,
+	}
+
+	list, err := mergeAggregates(cond, partials)
+	assert.Nil(err)
+	assert.Equal([]AggregateRow{
+		{"category": nil, "cnt": int64(1), "total": nil, "avg_price": nil, "min_price": nil, "last": nil},
+		{"category": "book", "cnt": int64(3), "total": int64(90), "avg_price": float64(30), "min_price": int64(10), "last": "2018-01-03"},
+		{"category": "food", "cnt": int64(1), "total": 5.5, "avg_price": 5.5, "min_price": 5.5, "last": "2018-01-01"},
+	}, list)
+	assert.EqualValues(90, list[1].Int64("total"))
+	assert.Equal(5.5, list[2].Float64("avg_price"))
+	assert.Equal("book", list[1].String("category"))
+	assert.Equal("", list[0].String("category"))
+
+	// HAVING after merging, which does not match on each shard
+	cond.HavingBy("total", ">", 50)
+	cond.OrderByDesc("cnt")
+	list, err = mergeAggregates(cond, partials)
+	assert.Nil(err)
+	assert.Len(list, 1)
+	assert.Equal("book", list[0]["category"])
+
+	// limit and offset
+	cond.HavingBys = nil
+	cond.SetLimit(1)
+	cond.SetOffset(1)
+	list, _ = mergeAggregates(cond, partials)
+	assert.Len(list, 1)
+	assert.Nil(list[0]["category"], "sorted by cnt desc, category asc")
+	cond.SetOffset(5)
+	list, _ = mergeAggregates(cond, partials)
+	assert.Len(list, 0)
+
+	// MIN and MAX are compared as the numbers only when all of the values are numeric
+	cond = NewFindCondition(testUser{})
+	cond.Aggregate(AggregateMin, "code", "min_code")
+	cond.Aggregate(AggregateMax, "code", "max_code")
+	list, _ = mergeAggregates(cond, [][]map[string]interface{}{
+		{{"wizard_a0": []byte("9"), "wizard_a1": []byte("9")}},
+		{{"wizard_a0": []byte("10"), "wizard_a1": []byte("10")}},
+	})
+	assert.Equal([]AggregateRow{{"min_code": int64(9), "max_code": int64(10)}}, list)
+	list, _ = mergeAggregates(cond, [][]map[string]interface{}{
+		{{"wizard_a0": []byte("007"), "wizard_a1": []byte("007")}},
+		{{"wizard_a0": []byte("10"), "wizard_a1": []byte("10")}},
+		{{"wizard_a0": []byte("A1"), "wizard_a1": []byte("A1")}},
+	})
+	assert.Equal([]AggregateRow{{"min_code": "007", "max_code": "A1"}}, list)
+
+	// without GROUP BY
+	cond = NewFindCondition(testUser{})
+	cond.Aggregate(AggregateCount, "*", "cnt")
+	cond.Aggregate(AggregateSum, "price", "total")
+	list, _ = mergeAggregates(cond, [][]map[string]interface{}{nil, nil})
+	assert.Equal([]AggregateRow{{"cnt": int64(0), "total": nil}}, list)
+}
@@ -12,9 +12,40 @@ func NewWhere(s string, args ...interface{}) Where {
 	}
 }
 
+// CompareFunc compares the non-NULL values of the order column, and returns -1, 0 or +1
+// the value of the string column is string or []byte.
+type CompareFunc func(a, b interface{}) int
+
 type Order struct {
 	Name        string
 	OrderByDesc bool
+	Compare     CompareFunc // compares the values on merging, required for the string columns
+}
+
+// AggregateFunc is the aggregate function for AggregateParallel
+type AggregateFunc string
+
+// aggregate functions
+const (
+	AggregateCount AggregateFunc = "COUNT"
+	AggregateSum   AggregateFunc = "SUM"
+	AggregateMin   AggregateFunc = "MIN"
+	AggregateMax   AggregateFunc = "MAX"
+	AggregateAvg   AggregateFunc = "AVG"
+)
+
+// Aggregate is the aggregate column for AggregateParallel
+type Aggregate struct {
+	Func   AggregateFunc
+	Column string
+	Alias  string
+}
+
+// HavingCondition is the condition for the merged aggregate result
+type HavingCondition struct {
+	Name     string
+	Operator string
+	Value    interface{}
 }
 
 // FindCondition is conditions for FindParallel
@@ -29,6 +60,10 @@ type FindCondition struct {
 	OrderBy []Order
 	Limit   int
 	Offset  int
+	Merge   bool
+
+	Aggregates []Aggregate
+	HavingBys  []HavingCondition
 }
 
 func NewFindCondition(table interface{}) FindCondition {
@@ -76,6 +111,26 @@ func (c *FindCondition) OrderByDesc(s string) {
 	c.OrderBy = append(c.OrderBy, o)
 }
 
+// OrderByAscWith adds the ascending order with the function comparing the values on merging
+// e.g. OrderByAscWith("name", CompareBinary) for the binary collation (e.g. utf8mb4_bin)
+func (c *FindCondition) OrderByAscWith(s string, fn CompareFunc) {
+	o := Order{
+		Name:    s,
+		Compare: fn,
+	}
+	c.OrderBy = append(c.OrderBy, o)
+}
+
+// OrderByDescWith adds the descending order with the function comparing the values on merging
+func (c *FindCondition) OrderByDescWith(s string, fn CompareFunc) {
+	o := Order{
+		Name:        s,
+		OrderByDesc: true,
+		Compare:     fn,
+	}
+	c.OrderBy = append(c.OrderBy, o)
+}
+
 func (c *FindCondition) SetLimit(i int) {
 	c.Limit = i
 }
@@ -84,6 +139,33 @@ func (c *FindCondition) SetOffset(i int) {
 	c.Offset = i
 }
 
+// SetMerge sets the scatter-gather mode
+// the results of the shards are merged by OrderBy, and Limit and Offset are applied to the merged list.
+// the string columns must be ordered with the function matching the collation of the database, e.g. OrderByAscWith().
+func (c *FindCondition) SetMerge(b bool) {
+	c.Merge = b
+}
+
+// Aggregate adds the aggregate column for AggregateParallel
+// e.g. Aggregate(AggregateSum, "price", "total") => SUM(price) AS total
+func (c *FindCondition) Aggregate(fn AggregateFunc, column, alias string) {
+	c.Aggregates = append(c.Aggregates, Aggregate{
+		Func:   fn,
+		Column: column,
+		Alias:  alias,
+	})
+}
+
+// HavingBy adds the condition for the merged aggregate result of AggregateParallel
+// name is the group column or the alias of the aggregate, and operator is one of =, !=, <>, <, <=, >, >=.
+func (c *FindCondition) HavingBy(name, operator string, value interface{}) {
+	c.HavingBys = append(c.HavingBys, HavingCondition{
+		Name:     name,
+		Operator: operator,
+		Value:    value,
+	})
+}
+
 // UpdateCondition is conditions for UpdateParallel
 type UpdateCondition struct {
 	Table           interface{}
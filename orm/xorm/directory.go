@@ -0,0 +1,84 @@
+package xorm
+
+import (
+	"github.com/evalphobia/wizard"
+	"github.com/evalphobia/wizard/errors"
+)
+
+// SQLDirectory is wizard.ShardDirectory stored in the database table of the cluster
+type SQLDirectory struct {
+	cluster *wizard.StandardCluster
+	table   string
+}
+
+// NewSQLDirectory returns initialized SQLDirectory
+// the table must have `shard_key` (primary or unique key) and `shard_name` columns
+func NewSQLDirectory(c *wizard.StandardCluster, table string) *SQLDirectory {
+	return &SQLDirectory{
+		cluster: c,
+		table:   table,
+	}
+}
+
+// CreateTable creates the directory table if not exists
+func (d *SQLDirectory) CreateTable() error {
+	db, err := d.engine(d.cluster.Master())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS " + d.table + " (shard_key VARCHAR(255) NOT NULL PRIMARY KEY, shard_name VARCHAR(255) NOT NULL)")
+	return err
+}
+
+// Lookup returns the shard name for the key from the slave db
+func (d *SQLDirectory) Lookup(key string) (string, error) {
+	node := d.cluster.Slave()
+	db, err := d.engine(node)
+	if err != nil {
+		return "", err
+	}
+	node.Acquire()
+	defer node.Release()
+
+	rows, err := db.Query("SELECT shard_name FROM "+d.table+" WHERE shard_key = ?", key)
+	switch {
+	case err != nil:
+		return "", err
+	case len(rows) == 0:
+		return "", errors.NewErrDirectoryNotFound(key)
+	}
+	return string(rows[0]["shard_name"]), nil
+}
+
+// Assign saves the shard name for the key into the master db
+// the key is inserted or updated atomically by the upsert of the driver.
+func (d *SQLDirectory) Assign(key string, shard string) error {
+	db, err := d.engine(d.cluster.Master())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(d.upsertQuery(db.DriverName()), key, shard)
+	return err
+}
+
+// upsertQuery returns the query to insert or update the shard name for the driver
+// ON CONFLICT is used for postgres and sqlite3.
+func (d *SQLDirectory) upsertQuery(driver string) string {
+	query := "INSERT INTO " + d.table + " (shard_key, shard_name) VALUES (?, ?)"
+	if driver == "mysql" {
+		return query + " ON DUPLICATE KEY UPDATE shard_name = VALUES(shard_name)"
+	}
+	return query + " ON CONFLICT (shard_key) DO UPDATE SET shard_name = excluded.shard_name"
+}
+
+// engine returns xorm engine of the node
+func (d *SQLDirectory) engine(node *wizard.Node) (Engine, error) {
+	if node == nil {
+		return nil, errors.NewErrNilDB(d.table)
+	}
+	db, ok := node.DB().(Engine)
+	if !ok || db == nil {
+		return nil, errors.NewErrNilDB(d.table)
+	}
+	return db, nil
+}
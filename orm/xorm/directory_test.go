@@ -0,0 +1,84 @@
+package xorm
+
+import (
+	"testing"
+
+	"github.com/evalphobia/wizard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := NewSQLDirectory(wizard.NewCluster(dbOther), "test_directory")
+	err := dir.CreateTable()
+	assert.Nil(err)
+	dbOther.Exec("DELETE FROM test_directory")
+
+	_, err = dir.Lookup("tenant-a")
+	assert.NotNil(err, "key is not found")
+
+	err = dir.Assign("tenant-a", "shard01")
+	assert.Nil(err)
+	shard, err := dir.Lookup("tenant-a")
+	assert.Nil(err)
+	assert.Equal("shard01", shard)
+
+	err = dir.Assign("tenant-a", "shard02")
+	assert.Nil(err)
+	shard, err = dir.Lookup("tenant-a")
+	assert.Nil(err)
+	assert.Equal("shard02", shard)
+
+	err = dir.Assign("tenant-a", "shard02")
+	assert.Nil(err, "assigning the same shard is not an error")
+	shard, err = dir.Lookup("tenant-a")
+	assert.Nil(err)
+	assert.Equal("shard02", shard)
+
+	dbOther.Exec("DROP TABLE test_directory")
+}
+
+func TestSQLDirectoryUpsertQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := NewSQLDirectory(wizard.NewCluster(nil), "test_directory")
+	assert.Equal("INSERT INTO test_directory (shard_key, shard_name) VALUES (?, ?) ON DUPLICATE KEY UPDATE shard_name = VALUES(shard_name)", dir.upsertQuery("mysql"))
+	assert.Equal("INSERT INTO test_directory (shard_key, shard_name) VALUES (?, ?) ON CONFLICT (shard_key) DO UPDATE SET shard_name = excluded.shard_name", dir.upsertQuery("postgres"))
+	assert.Equal("INSERT INTO test_directory (shard_key, shard_name) VALUES (?, ?) ON CONFLICT (shard_key) DO UPDATE SET shard_name = excluded.shard_name", dir.upsertQuery("sqlite3"))
+}
+
+func TestSQLDirectoryWithCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := NewSQLDirectory(wizard.NewCluster(dbOther), "test_directory")
+	dir.CreateTable()
+	dir.Assign("1", "shard01")
+	dir.Assign("500", "shard02")
+
+	wiz := wizard.NewWizard()
+	users := wiz.CreateDirectoryCluster(testUser{}, dir, 100)
+	users.RegisterShard("shard01", wizard.NewCluster(dbUser01Master))
+	users.RegisterShard("shard02", wizard.NewCluster(dbUser02Master))
+	orm := New(wiz)
+
+	row := &testUser{ID: 500}
+	has, err := orm.Get(row, func(s Session) (bool, error) {
+		return s.Get(row)
+	})
+	assert.Nil(err)
+	assert.True(has)
+	assert.Equal("Alice", row.Name)
+
+	dbOther.Exec("DROP TABLE test_directory")
+}
+
+func TestSQLDirectoryNilDB(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := NewSQLDirectory(wizard.NewCluster(nil), "test_directory")
+	assert.NotNil(dir.CreateTable())
+	assert.NotNil(dir.Assign("a", "shard01"))
+	_, err := dir.Lookup("a")
+	assert.NotNil(err)
+}
@@ -1,9 +1,12 @@
 package xorm
 
 import (
+	"context"
 	"database/sql"
 	"io"
+	"time"
 
+	"github.com/evalphobia/wizard"
 	"github.com/go-xorm/core"
 	"github.com/go-xorm/xorm"
 )
@@ -14,6 +17,11 @@ type ORM interface {
 	IsReadOnly(Identifier) bool
 	SetAutoTransaction(Identifier, bool)
 	IsAutoTransaction(Identifier) bool
+	SetReadYourWrites(Identifier, bool)
+	IsReadYourWrites(Identifier) bool
+	SetReadYourWritesWindow(Identifier, time.Duration)
+	SetTwoPhaseCommit(Identifier, bool)
+	IsTwoPhaseCommit(Identifier) bool
 
 	Master(interface{}) Engine
 	MasterByKey(interface{}, interface{}) Engine
@@ -21,19 +29,35 @@ type ORM interface {
 	Slave(interface{}) Engine
 	SlaveByKey(interface{}, interface{}) Engine
 	Slaves(interface{}) []Engine
+	MigrationMasters(interface{}) []Engine
+	MigrationMastersByKey(interface{}, interface{}) []Engine
+	AllMigrationMasters(interface{}) []Engine
+	Reload(*wizard.Wizard, time.Duration) error
+	RecoverTransactions() error
+	SetRetryPolicy(*RetryPolicy)
 
 	Get(interface{}, func(Session) (bool, error)) (bool, error)
 	Find(interface{}, func(Session) error) error
 	Count(interface{}, func(Session) (int64, error)) (int64, error)
 	Insert(Identifier, interface{}, func(Session) (int64, error)) (int64, error)
 	Update(Identifier, interface{}, func(Session) (int64, error)) (int64, error)
+	InsertWithCompensation(Identifier, interface{}, func(Session) (int64, error), func(Session) error) (int64, error)
+	UpdateWithCompensation(Identifier, interface{}, func(Session) (int64, error), func(Session) error) (int64, error)
 	FindParallel(interface{}, interface{}, string, ...interface{}) error
 	FindParallelByCondition(interface{}, FindCondition) error
 	CountParallelByCondition(interface{}, FindCondition) ([]int64, error)
+	AggregateParallelByCondition(FindCondition) ([]AggregateRow, error)
 	UpdateParallelByCondition(interface{}, UpdateCondition) (int64, error)
+	FindParallelResultByCondition(interface{}, FindCondition) (ParallelResult, error)
+	CountParallelResultByCondition(interface{}, FindCondition) (ParallelResult, error)
+	UpdateParallelResultByCondition(interface{}, UpdateCondition) (ParallelResult, error)
+	IterateParallelByCondition(interface{}, FindCondition, IterateFunc) error
 	GetUsingMaster(Identifier, interface{}, func(Session) (bool, error)) (bool, error)
 	FindUsingMaster(Identifier, interface{}, func(Session) error) error
 	CountUsingMaster(Identifier, interface{}, func(Session) (int64, error)) (int64, error)
+	GetUsingSlave(Identifier, interface{}, func(Session) (bool, error)) (bool, error)
+	FindUsingSlave(Identifier, interface{}, func(Session) error) error
+	CountUsingSlave(Identifier, interface{}, func(Session) (int64, error)) (int64, error)
 
 	NewMasterSession(interface{}) (Session, error)
 
@@ -42,14 +66,60 @@ type ORM interface {
 	UseSlaveSession(Identifier, interface{}) (Session, error)
 	UseSlaveSessionByKey(Identifier, interface{}, interface{}) (Session, error)
 	UseAllMasterSessions(Identifier, interface{}) ([]Session, error)
+	UseMigrationMasterSessions(Identifier, interface{}) ([]Session, error)
+	UseMigrationMasterSessionsByKey(Identifier, interface{}, interface{}) ([]Session, error)
 
 	ForceNewTransaction(interface{}) (Session, error)
 	Transaction(Identifier, interface{}) (Session, error)
 	TransactionByKey(Identifier, interface{}, interface{}) (Session, error)
 	AutoTransaction(Identifier, interface{}, Session) error
 	CommitAll(Identifier) error
+	RunInTransaction(Identifier, func() error) error
+	Compensate(Identifier, interface{}, func(Session) error) error
 	RollbackAll(Identifier) error
 	CloseAll(Identifier)
+
+	// context.Context variants
+	GetContext(context.Context, interface{}, func(Session) (bool, error)) (bool, error)
+	FindContext(context.Context, interface{}, func(Session) error) error
+	CountContext(context.Context, interface{}, func(Session) (int64, error)) (int64, error)
+	InsertContext(context.Context, Identifier, interface{}, func(Session) (int64, error)) (int64, error)
+	UpdateContext(context.Context, Identifier, interface{}, func(Session) (int64, error)) (int64, error)
+	InsertWithCompensationContext(context.Context, Identifier, interface{}, func(Session) (int64, error), func(Session) error) (int64, error)
+	UpdateWithCompensationContext(context.Context, Identifier, interface{}, func(Session) (int64, error), func(Session) error) (int64, error)
+	FindParallelContext(context.Context, interface{}, interface{}, string, ...interface{}) error
+	FindParallelByConditionContext(context.Context, interface{}, FindCondition) error
+	CountParallelByConditionContext(context.Context, interface{}, FindCondition) ([]int64, error)
+	AggregateParallelByConditionContext(context.Context, FindCondition) ([]AggregateRow, error)
+	UpdateParallelByConditionContext(context.Context, interface{}, UpdateCondition) (int64, error)
+	FindParallelResultByConditionContext(context.Context, interface{}, FindCondition) (ParallelResult, error)
+	CountParallelResultByConditionContext(context.Context, interface{}, FindCondition) (ParallelResult, error)
+	UpdateParallelResultByConditionContext(context.Context, interface{}, UpdateCondition) (ParallelResult, error)
+	IterateParallelByConditionContext(context.Context, interface{}, FindCondition, IterateFunc) error
+	GetUsingMasterContext(context.Context, Identifier, interface{}, func(Session) (bool, error)) (bool, error)
+	FindUsingMasterContext(context.Context, Identifier, interface{}, func(Session) error) error
+	CountUsingMasterContext(context.Context, Identifier, interface{}, func(Session) (int64, error)) (int64, error)
+	GetUsingSlaveContext(context.Context, Identifier, interface{}, func(Session) (bool, error)) (bool, error)
+	FindUsingSlaveContext(context.Context, Identifier, interface{}, func(Session) error) error
+	CountUsingSlaveContext(context.Context, Identifier, interface{}, func(Session) (int64, error)) (int64, error)
+
+	NewMasterSessionContext(context.Context, interface{}) (Session, error)
+
+	UseMasterSessionContext(context.Context, Identifier, interface{}) (Session, error)
+	UseMasterSessionByKeyContext(context.Context, Identifier, interface{}, interface{}) (Session, error)
+	UseSlaveSessionContext(context.Context, Identifier, interface{}) (Session, error)
+	UseSlaveSessionByKeyContext(context.Context, Identifier, interface{}, interface{}) (Session, error)
+	UseAllMasterSessionsContext(context.Context, Identifier, interface{}) ([]Session, error)
+	UseMigrationMasterSessionsContext(context.Context, Identifier, interface{}) ([]Session, error)
+	UseMigrationMasterSessionsByKeyContext(context.Context, Identifier, interface{}, interface{}) ([]Session, error)
+
+	ForceNewTransactionContext(context.Context, interface{}) (Session, error)
+	TransactionContext(context.Context, Identifier, interface{}) (Session, error)
+	TransactionByKeyContext(context.Context, Identifier, interface{}, interface{}) (Session, error)
+	AutoTransactionContext(context.Context, Identifier, interface{}, Session) error
+	CommitAllContext(context.Context, Identifier) error
+	RunInTransactionContext(context.Context, Identifier, func() error) error
+	BindContext(context.Context, Identifier)
 }
 
 // Session is interface for xorm.Session
@@ -0,0 +1,242 @@
+package xorm
+
+import (
+	"container/heap"
+	"context"
+	stderrors "errors"
+	"reflect"
+	"sync"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// IterateFunc is the function called for each row of the shards
+type IterateFunc func(shard int, bean interface{}) error
+
+// streamRow is the row sent from the shard
+type streamRow struct {
+	shard int
+	bean  interface{}
+}
+
+// IterateParallelByCondition executes SELECT query to all of the shards with conditions and calls fn for each row
+func (xpr *XormParallel) IterateParallelByCondition(beanPtr interface{}, cond FindCondition, fn IterateFunc) error {
+	return xpr.IterateParallelByConditionContext(context.Background(), beanPtr, cond, fn)
+}
+
+// IterateParallelByConditionContext executes SELECT query to all of the shards with conditions and the context and calls fn for each row
+// the rows are streamed from the shards one by one, and the shards wait until fn returns.
+// when OrderBy is set, the sorted rows of the shards are merged and paginated by Limit and Offset,
+// otherwise the rows are passed in the order of arrival.
+// the string columns of OrderBy are merged by the byte order, see SetMerge().
+// when fn returns the error or the context is done, the queries in progress are aborted and the error is returned.
+func (xpr *XormParallel) IterateParallelByConditionContext(ctx context.Context, beanPtr interface{}, cond FindCondition, fn IterateFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	vt := reflect.TypeOf(beanPtr)
+	if vt == nil || vt.Kind() != reflect.Ptr || vt.Elem().Kind() != reflect.Struct {
+		return errors.NewErrArgType("beanPtr must be a pointer of struct")
+	}
+
+	var keys []sortKey
+	if len(cond.OrderBy) > 0 {
+		var err error
+		keys, err = newSortKeys(vt, cond.OrderBy)
+		if err != nil {
+			return err
+		}
+		cond.Merge = true
+	}
+
+	return xpr.iterate(ctx, xpr.createFindSessions(cond), vt.Elem(), keys, cond, fn)
+}
+
+// iterate streams the rows of the sessions to fn
+// the rows are merged by the sort keys in the merge mode.
+func (xpr *XormParallel) iterate(ctx context.Context, sessions []shardSession, rowType reflect.Type, keys []sortKey, cond FindCondition, fn IterateFunc) error {
+	iterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errList := make([]error, len(sessions))
+	var err error
+	if cond.Merge {
+		err = xpr.iterateMerged(iterCtx, cancel, sessions, rowType, errList, keys, cond.Offset, cond.Limit, fn)
+	} else {
+		err = xpr.iterateUnordered(iterCtx, cancel, sessions, rowType, errList, fn)
+	}
+
+	switch {
+	case err != nil:
+		return err
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return iterateError(errList)
+}
+
+// iterateUnordered passes the rows of the shards in the order of arrival
+// the number of the shards queried at the same time is limited by the concurrency.
+func (xpr *XormParallel) iterateUnordered(ctx context.Context, cancel context.CancelFunc, sessions []shardSession, rowType reflect.Type, errList []error, fn IterateFunc) error {
+	jobs := make(chan int, len(sessions))
+	for i := range sessions {
+		jobs <- i
+	}
+	close(jobs)
+
+	workers := len(sessions)
+	if xpr.concurrency > 0 && xpr.concurrency < workers {
+		workers = xpr.concurrency
+	}
+
+	rows := make(chan streamRow)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errList[i] = streamShard(ctx, sessions[i], rowType, rows)
+				if errList[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(rows)
+	}()
+
+	var err error
+	for row := range rows {
+		if err != nil || ctx.Err() != nil {
+			// drains the rows sent before the cancel
+			continue
+		}
+		if err = fn(row.shard, row.bean); err != nil {
+			cancel()
+		}
+	}
+	return err
+}
+
+// iterateMerged merges the sorted rows of the shards and passes them in the order
+// all of the shards are queried at the same time to compare the head rows.
+func (xpr *XormParallel) iterateMerged(ctx context.Context, cancel context.CancelFunc, sessions []shardSession, rowType reflect.Type, errList []error, keys []sortKey, offset, limit int, fn IterateFunc) error {
+	streams := make([]chan streamRow, len(sessions))
+	var wg sync.WaitGroup
+	wg.Add(len(sessions))
+	for i := range sessions {
+		streams[i] = make(chan streamRow)
+		go func(i int) {
+			defer wg.Done()
+			defer close(streams[i])
+			errList[i] = streamShard(ctx, sessions[i], rowType, streams[i])
+			if errList[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	// stops the shards before waiting them
+	defer wg.Wait()
+	defer cancel()
+
+	h := &streamHeap{keys: keys}
+	for _, ch := range streams {
+		if row, ok := <-ch; ok {
+			h.rows = append(h.rows, row)
+		}
+	}
+	heap.Init(h)
+
+	for skipped, passed := 0, 0; h.Len() > 0; {
+		if limit > 0 && passed >= limit {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// some of the shards are failed or the context is done
+			return nil
+		}
+
+		row := h.rows[0]
+		if skipped < offset {
+			skipped++
+		} else {
+			if err := fn(row.shard, row.bean); err != nil {
+				return err
+			}
+			passed++
+		}
+
+		if next, ok := <-streams[row.shard]; ok {
+			h.rows[0] = next
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// streamShard sends the rows of the shard to the channel until the end of the rows or the context is done
+// the session is closed after it.
+func streamShard(ctx context.Context, s shardSession, rowType reflect.Type, rows chan<- streamRow) error {
+	defer s.Close()
+	if err := ctx.Err(); err != nil {
+		return s.err(err)
+	}
+
+	bean := reflect.New(rowType).Interface()
+	err := withContext(ctx, s.Session).Iterate(bean, func(_ int, b interface{}) error {
+		select {
+		case rows <- streamRow{shard: s.shard, bean: b}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil {
+		return s.err(err)
+	}
+	return nil
+}
+
+// iterateError returns the errors of the shards except the cancel by the iteration
+func iterateError(errList []error) error {
+	var list []error
+	for _, err := range errList {
+		if err != nil && !stderrors.Is(err, context.Canceled) {
+			list = append(list, err)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return errors.NewErrParallelQuery(list)
+}
+
+// streamHeap is the min-heap of the head rows of the shards
+type streamHeap struct {
+	rows []streamRow
+	keys []sortKey
+}
+
+func (h streamHeap) Len() int { return len(h.rows) }
+func (h streamHeap) Less(i, j int) bool {
+	a, b := h.rows[i], h.rows[j]
+	if c := compareRows(reflect.ValueOf(a.bean), reflect.ValueOf(b.bean), h.keys); c != 0 {
+		return c < 0
+	}
+	// keeps the order of the shards for the same value
+	return a.shard < b.shard
+}
+func (h streamHeap) Swap(i, j int)       { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+func (h *streamHeap) Push(x interface{}) { h.rows = append(h.rows, x.(streamRow)) }
+func (h *streamHeap) Pop() interface{} {
+	old := h.rows
+	n := len(old)
+	row := old[n-1]
+	h.rows = old[:n-1]
+	return row
+}
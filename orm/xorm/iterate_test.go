@@ -0,0 +1,162 @@
+package xorm
+
+import (
+	"context"
+	stderrors "errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-xorm/xorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// testIterateSession is Session which iterates the rows
+type testIterateSession struct {
+	Session
+	rows   []interface{}
+	err    error
+	closed int32
+}
+
+func (s *testIterateSession) Iterate(bean interface{}, fn xorm.IterFunc) error {
+	for i, row := range s.rows {
+		if err := fn(i, row); err != nil {
+			return err
+		}
+	}
+	return s.err
+}
+
+func (s *testIterateSession) Close() {
+	atomic.AddInt32(&s.closed, 1)
+}
+
+func testIterateSessions(ids ...[]int64) ([]shardSession, []*testIterateSession) {
+	var list []shardSession
+	var sessions []*testIterateSession
+	for i, shardIDs := range ids {
+		s := &testIterateSession{}
+		for _, id := range shardIDs {
+			s.rows = append(s.rows, &testUser{ID: id})
+		}
+		sessions = append(sessions, s)
+		list = append(list, shardSession{Session: s, shard: i})
+	}
+	return list, sessions
+}
+
+func TestIterate(t *testing.T) {
+	assert := assert.New(t)
+	xpr := &XormParallel{}
+	ctx := context.Background()
+	rowType := reflect.TypeOf(testUser{})
+	keys, err := newSortKeys(rowType, []Order{{Name: "id"}})
+	assert.Nil(err)
+
+	var ids []int64
+	var shards []int
+	collect := func(shard int, bean interface{}) error {
+		ids = append(ids, bean.(*testUser).ID)
+		shards = append(shards, shard)
+		return nil
+	}
+
+	// merged
+	list, sessions := testIterateSessions([]int64{1, 4, 7}, []int64{2, 3, 9})
+	cond := FindCondition{Merge: true}
+	err = xpr.iterate(ctx, list, rowType, keys, cond, collect)
+	assert.Nil(err)
+	assert.Equal([]int64{1, 2, 3, 4, 7, 9}, ids)
+	assert.Equal([]int{0, 1, 1, 0, 0, 1}, shards)
+	for _, s := range sessions {
+		assert.EqualValues(1, atomic.LoadInt32(&s.closed))
+	}
+
+	// merged with offset and limit
+	ids, shards = nil, nil
+	list, _ = testIterateSessions([]int64{1, 4, 7}, []int64{2, 3, 9})
+	cond.SetOffset(1)
+	cond.SetLimit(3)
+	err = xpr.iterate(ctx, list, rowType, keys, cond, collect)
+	assert.Nil(err)
+	assert.Equal([]int64{2, 3, 4}, ids)
+
+	// unordered
+	ids, shards = nil, nil
+	xpr.SetParallelConcurrency(1)
+	list, _ = testIterateSessions([]int64{1, 4, 7}, []int64{2, 3, 9})
+	err = xpr.iterate(ctx, list, rowType, nil, FindCondition{}, collect)
+	assert.Nil(err)
+	assert.Equal([]int64{1, 4, 7, 2, 3, 9}, ids, "shards are queried one by one")
+	xpr.SetParallelConcurrency(0)
+
+	// stopped by the function
+	errStop := errors.NewErr(1, "stop")
+	for _, cond := range []FindCondition{{Merge: true}, {}} {
+		count := 0
+		list, sessions = testIterateSessions([]int64{1, 4, 7}, []int64{2, 3, 9})
+		err = xpr.iterate(ctx, list, rowType, keys, cond, func(shard int, bean interface{}) error {
+			count++
+			if count == 2 {
+				return errStop
+			}
+			return nil
+		})
+		assert.Equal(errStop, err)
+		assert.Equal(2, count)
+		for _, s := range sessions {
+			assert.EqualValues(1, atomic.LoadInt32(&s.closed))
+		}
+	}
+
+	// the error of the shard
+	for _, cond := range []FindCondition{{Merge: true}, {}} {
+		list, sessions = testIterateSessions([]int64{1, 4, 7}, []int64{2, 3, 9})
+		sessions[1].err = errors.NewErr(2, "shard error")
+		err = xpr.iterate(ctx, list, rowType, keys, cond, func(shard int, bean interface{}) error {
+			return nil
+		})
+		assert.True(stderrors.Is(err, errors.ErrParallelQuery))
+		e, ok := err.(errors.MultiErr)
+		assert.True(ok)
+		assert.Len(e.NodeErrors(), 1)
+		assert.Equal(1, e.NodeErrors()[0].Shard)
+	}
+
+	// cancelled by the caller
+	cancelCtx, cancel := context.WithCancel(ctx)
+	list, _ = testIterateSessions([]int64{1, 4, 7}, []int64{2, 3, 9})
+	err = xpr.iterate(cancelCtx, list, rowType, keys, FindCondition{Merge: true}, func(shard int, bean interface{}) error {
+		cancel()
+		return nil
+	})
+	assert.Equal(context.Canceled, err)
+}
+
+func TestIterateParallelByCondition(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	cond := NewFindCondition(testUser{})
+	cond.And("id > ?", 1)
+	cond.OrderByAsc("id")
+	cond.SetLimit(4)
+
+	var ids []int64
+	err := orm.IterateParallelByCondition(&testUser{}, cond, func(shard int, bean interface{}) error {
+		ids = append(ids, bean.(*testUser).ID)
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal([]int64{2, 3, 500, 501}, ids)
+
+	// invalid bean
+	err = orm.IterateParallelByCondition([]testUser{}, cond, func(shard int, bean interface{}) error {
+		return nil
+	})
+	assert.True(stderrors.Is(err, errors.ErrArgType))
+}
@@ -0,0 +1,374 @@
+package xorm
+
+import (
+	"bytes"
+	"container/heap"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// sortKey is the struct field used for ordering the rows
+type sortKey struct {
+	index   []int
+	desc    bool
+	compare CompareFunc
+}
+
+var nullStringType = reflect.TypeOf(sql.NullString{})
+
+// newSortKeys returns the fields of the row type for the order columns
+// the column is matched with the name in xorm tag or the snake case of the field name.
+// the string column is rejected without Order.Compare, because its order depends on the collation of the database.
+func newSortKeys(rowType reflect.Type, orders []Order) ([]sortKey, error) {
+	if rowType.Kind() == reflect.Ptr {
+		rowType = rowType.Elem()
+	}
+	if rowType.Kind() != reflect.Struct {
+		return nil, errors.NewErrArgType("listPtr must be a pointer of struct slice for merging")
+	}
+
+	keys := make([]sortKey, len(orders))
+	for i, o := range orders {
+		index, ok := findColumnField(rowType, normalizeColumn(o.Name))
+		if !ok {
+			return nil, errors.NewErrArgType("cannot find the field of the order column: " + o.Name)
+		}
+		if o.Compare == nil && isStringType(rowType.FieldByIndex(index).Type) {
+			return nil, errors.NewErrArgType("the string order column needs Order.Compare for merging, e.g. CompareBinary for the binary collation: " + o.Name)
+		}
+		keys[i] = sortKey{index: index, desc: o.OrderByDesc, compare: o.Compare}
+	}
+	return keys, nil
+}
+
+// isStringType checks the values of the type are compared as the strings
+func isStringType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == nullStringType,
+		t.Kind() == reflect.String,
+		t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return true
+	}
+	return false
+}
+
+// normalizeColumn removes the table name and the quotes from the column name
+// e.g. `users`.`id` => id
+func normalizeColumn(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(strings.Trim(name, "`\"'[] "))
+}
+
+// findColumnField returns the index of the field for the column
+func findColumnField(t reflect.Type, column string) ([]int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("xorm")
+		if tag == "-" {
+			continue
+		}
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if index, ok := findColumnField(f.Type, column); ok {
+				return append([]int{i}, index...), true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		for _, token := range strings.Fields(tag) {
+			if strings.ToLower(strings.Trim(token, "'")) == column {
+				return []int{i}, true
+			}
+		}
+		if toSnakeCase(f.Name) == column || strings.ToLower(f.Name) == column {
+			return []int{i}, true
+		}
+	}
+	return nil, false
+}
+
+// toSnakeCase converts the field name into the column name in the same way of xorm.SnakeMapper
+func toSnakeCase(name string) string {
+	var buf bytes.Buffer
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				buf.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// compareRows compares the rows by the sort keys
+func compareRows(a, b reflect.Value, keys []sortKey) int {
+	a = reflect.Indirect(a)
+	b = reflect.Indirect(b)
+	for _, k := range keys {
+		c := compareValuesWith(a.FieldByIndex(k.index), b.FieldByIndex(k.index), k.compare)
+		if c == 0 {
+			continue
+		}
+		if k.desc {
+			return -c
+		}
+		return c
+	}
+	return 0
+}
+
+// compareValues compares the column values
+// NULL is smaller than any other values as same as MySQL.
+// the strings are compared by the byte order, which matches only the binary collation of the database.
+func compareValues(a, b reflect.Value) int {
+	return compareValuesWith(a, b, nil)
+}
+
+// compareValuesWith compares the column values by the function
+// NULL is smaller than any other values, and the function compares the non-NULL values.
+func compareValuesWith(a, b reflect.Value, fn CompareFunc) int {
+	av, aNull := columnValue(a)
+	bv, bNull := columnValue(b)
+	switch {
+	case aNull && bNull:
+		return 0
+	case aNull:
+		return -1
+	case bNull:
+		return 1
+	case fn != nil:
+		return fn(av, bv)
+	}
+	return compareColumnValues(av, bv)
+}
+
+// CompareBinary compares the values by the byte order, which matches the binary collation of the database
+// e.g. utf8mb4_bin on MySQL, COLLATE "C" on PostgreSQL
+func CompareBinary(a, b interface{}) int {
+	return compareColumnValues(a, b)
+}
+
+// compareColumnValues compares the non-NULL column values of the same type
+func compareColumnValues(av, bv interface{}) int {
+	switch x := av.(type) {
+	case int64:
+		if y, ok := bv.(int64); ok {
+			return compareInt(x, y)
+		}
+	case uint64:
+		if y, ok := bv.(uint64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case bool:
+		if y, ok := bv.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	case time.Time:
+		if y, ok := bv.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if y, ok := bv.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case []byte:
+		if y, ok := bv.([]byte); ok {
+			return bytes.Compare(x, y)
+		}
+	}
+	if c, ok := compareFloat(av, bv); ok {
+		return c
+	}
+	return 0
+}
+
+// compareFloat compares the numbers of the different types, e.g. int64 and float64
+func compareFloat(a, b interface{}) (int, bool) {
+	x, ok := toFloat(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := toFloat(b)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// columnValue returns the comparable value of the field and whether it's NULL
+func columnValue(v reflect.Value) (interface{}, bool) {
+	switch {
+	case !v.IsValid():
+		return nil, true
+	case v.Kind() == reflect.Interface:
+		return columnValue(v.Elem())
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, true
+		}
+		v = v.Elem()
+	}
+	if v.CanInterface() {
+		switch x := v.Interface().(type) {
+		case time.Time:
+			return x, false
+		case []byte:
+			return x, x == nil
+		case driver.Valuer:
+			// e.g. sql.NullString, sql.NullInt64
+			dv, err := x.Value()
+			if err != nil || dv == nil {
+				return nil, true
+			}
+			return columnValue(reflect.ValueOf(dv))
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), false
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false
+	case reflect.Bool:
+		return v.Bool(), false
+	case reflect.String:
+		return v.String(), false
+	}
+	return nil, true
+}
+
+// mergeCursor is the position in the sorted list of the shard
+type mergeCursor struct {
+	list  reflect.Value
+	pos   int
+	shard int
+}
+
+func (c *mergeCursor) row() reflect.Value {
+	return c.list.Index(c.pos)
+}
+
+// mergeHeap is the min-heap of the cursors ordered by the current rows
+type mergeHeap struct {
+	cursors []*mergeCursor
+	keys    []sortKey
+}
+
+func (h mergeHeap) Len() int { return len(h.cursors) }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	if c := compareRows(a.row(), b.row(), h.keys); c != 0 {
+		return c < 0
+	}
+	// keeps the order of the shards for the same value
+	return a.shard < b.shard
+}
+func (h mergeHeap) Swap(i, j int)       { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *mergeHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*mergeCursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := h.cursors
+	n := len(old)
+	c := old[n-1]
+	h.cursors = old[:n-1]
+	return c
+}
+
+// mergeSorted merges the sorted lists of the shards into one sorted list
+// the rows before offset are skipped, and zero limit means no limit.
+func mergeSorted(sliceType reflect.Type, lists []reflect.Value, keys []sortKey, offset, limit int) reflect.Value {
+	h := &mergeHeap{keys: keys}
+	for i, list := range lists {
+		if list.Len() > 0 {
+			h.cursors = append(h.cursors, &mergeCursor{list: list, shard: i})
+		}
+	}
+	heap.Init(h)
+
+	result := reflect.MakeSlice(sliceType, 0, 0)
+	for skipped := 0; h.Len() > 0; {
+		if limit > 0 && result.Len() >= limit {
+			break
+		}
+
+		c := h.cursors[0]
+		if skipped < offset {
+			skipped++
+		} else {
+			result = reflect.Append(result, c.row())
+		}
+
+		c.pos++
+		if c.pos < c.list.Len() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package xorm
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testMergeBase struct {
+	CreatedAt time.Time
+}
+
+type testMergeRow struct {
+	testMergeBase
+	ID       int64          `xorm:"'row_id' pk"`
+	UserName string         `xorm:"varchar(255)"`
+	Score    *float64       `xorm:"score"`
+	Nickname sql.NullString `xorm:"nickname"`
+	Ignored  int            `xorm:"-"`
+}
+
+func TestNewSortKeys(t *testing.T) {
+	assert := assert.New(t)
+	rowType := reflect.TypeOf(testMergeRow{})
+
+	keys, err := newSortKeys(rowType, []Order{
+		{Name: "row_id"},
+		{Name: "`t`.`user_name`", OrderByDesc: true, Compare: CompareBinary},
+		{Name: "created_at"},
+	})
+	assert.Nil(err)
+	assert.NotNil(keys[1].compare)
+	keys[1].compare = nil
+	assert.Equal([]sortKey{
+		{index: []int{1}},
+		{index: []int{2}, desc: true},
+		{index: []int{0, 0}},
+	}, keys)
+
+	keys, err = newSortKeys(reflect.TypeOf(&testMergeRow{}), []Order{{Name: "Score"}})
+	assert.Nil(err)
+	assert.Equal([]int{3}, keys[0].index)
+
+	_, err = newSortKeys(rowType, []Order{{Name: "ignored"}})
+	assert.NotNil(err)
+	_, err = newSortKeys(reflect.TypeOf(int64(0)), nil)
+	assert.NotNil(err)
+
+	// the string columns depend on the collation
+	_, err = newSortKeys(rowType, []Order{{Name: "user_name"}})
+	assert.NotNil(err)
+	_, err = newSortKeys(rowType, []Order{{Name: "nickname"}})
+	assert.NotNil(err)
+}
+
+func TestCompareValuesWith(t *testing.T) {
+	assert := assert.New(t)
+	caseInsensitive := func(a, b interface{}) int {
+		return strings.Compare(strings.ToLower(a.(string)), strings.ToLower(b.(string)))
+	}
+
+	assert.Equal(-1, compareValues(reflect.ValueOf("B"), reflect.ValueOf("a")))
+	assert.Equal(1, compareValuesWith(reflect.ValueOf("B"), reflect.ValueOf("a"), caseInsensitive))
+	assert.Equal(-1, compareValuesWith(reflect.ValueOf(sql.NullString{}), reflect.ValueOf("a"), caseInsensitive), "NULL is not passed to the function")
+	assert.Equal(-1, CompareBinary("B", "a"))
+	assert.Equal(1, CompareBinary([]byte("b"), []byte("a")))
+}
+
+func TestCompareValues(t *testing.T) {
+	assert := assert.New(t)
+	score1, score2 := 1.5, 2.5
+	now := time.Now()
+
+	tests := []struct {
+		a, b     interface{}
+		expected int
+	}{
+		{1, 2, -1},
+		{uint8(2), uint8(1), 1},
+		{"abc", "abc", 0},
+		{"abc", "abd", -1},
+		{now, now.Add(time.Second), -1},
+		{&score2, &score1, 1},
+		{(*float64)(nil), &score1, -1},
+		{sql.NullString{}, sql.NullString{String: "a", Valid: true}, -1},
+		{sql.NullString{String: "b", Valid: true}, sql.NullString{String: "a", Valid: true}, 1},
+		{[]byte("a"), []byte("b"), -1},
+		{false, true, -1},
+	}
+	for _, tt := range tests {
+		assert.Equal(tt.expected, compareValues(reflect.ValueOf(tt.a), reflect.ValueOf(tt.b)), "%v %v", tt.a, tt.b)
+	}
+}
+
+func TestMergeSorted(t *testing.T) {
+	assert := assert.New(t)
+	sliceType := reflect.TypeOf([]testUser{})
+	keys, _ := newSortKeys(sliceType.Elem(), []Order{{Name: "name", Compare: CompareBinary}, {Name: "id", OrderByDesc: true}})
+
+	lists := []reflect.Value{
+		reflect.ValueOf([]testUser{{ID: 1, Name: "a"}, {ID: 3, Name: "c"}, {ID: 5, Name: "e"}}),
+		reflect.ValueOf([]testUser{}),
+		reflect.ValueOf([]testUser{{ID: 12, Name: "b"}, {ID: 11, Name: "b"}, {ID: 14, Name: "d"}}),
+	}
+
+	result := mergeSorted(sliceType, lists, keys, 0, 0).Interface().([]testUser)
+	assert.Equal([]testUser{
+		{ID: 1, Name: "a"},
+		{ID: 12, Name: "b"},
+		{ID: 11, Name: "b"},
+		{ID: 3, Name: "c"},
+		{ID: 14, Name: "d"},
+		{ID: 5, Name: "e"},
+	}, result)
+
+	result = mergeSorted(sliceType, lists, keys, 2, 3).Interface().([]testUser)
+	assert.Equal([]testUser{
+		{ID: 11, Name: "b"},
+		{ID: 3, Name: "c"},
+		{ID: 14, Name: "d"},
+	}, result)
+
+	result = mergeSorted(sliceType, lists, keys, 10, 3).Interface().([]testUser)
+	assert.Len(result, 0)
+
+	// without order, the lists are concatenated in the order of the shards
+	result = mergeSorted(sliceType, lists, nil, 1, 3).Interface().([]testUser)
+	assert.Equal([]int64{3, 5, 12}, []int64{result[0].ID, result[1].ID, result[2].ID})
+}
@@ -0,0 +1,227 @@
+package xorm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+)
+
+// defaultMaxBufferSize is the default size limit of the buffered response
+const defaultMaxBufferSize = 1 << 20
+
+// contextKey is the key type of the context value
+type contextKey struct{}
+
+// identifierKey is the context key of the Identifier
+var identifierKey = contextKey{}
+
+// Middleware manages the sessions for every http request
+// the transactions are committed when the handler succeeds, or rolled back when it fails or panics.
+// the response is buffered and sent after committing, and 500 is sent instead when committing fails.
+// the response flushed or hijacked by the handler is sent before committing, so the commit error is not sent.
+// the identifier is marked in use while the request is handled, so the Sweeper never reclaims it.
+type Middleware struct {
+	orm          *Xorm
+	autoTx       bool
+	maxBuffer    int
+	isSuccess    func(status int) bool
+	errorHandler func(*http.Request, error)
+}
+
+// NewMiddleware returns initialized Middleware
+func NewMiddleware(orm *Xorm) *Middleware {
+	return &Middleware{
+		orm:       orm,
+		maxBuffer: defaultMaxBufferSize,
+		isSuccess: isSuccessStatus,
+	}
+}
+
+// SetAutoTransaction sets auto transaction flag for every request
+func (m *Middleware) SetAutoTransaction(b bool) {
+	m.autoTx = b
+}
+
+// SetMaxBufferSize sets the size limit of the buffered response, zero means no limit
+// the response over the limit is flushed before committing, so the commit error is not sent.
+func (m *Middleware) SetMaxBufferSize(n int) {
+	m.maxBuffer = n
+}
+
+// SetSuccessFunc sets the function to decide commit or rollback from the response status
+// the default is committing when the status is lower than 400
+func (m *Middleware) SetSuccessFunc(fn func(status int) bool) {
+	m.isSuccess = fn
+}
+
+// SetErrorHandler sets the function called when commit or rollback fails
+func (m *Middleware) SetErrorHandler(fn func(*http.Request, error)) {
+	m.errorHandler = fn
+}
+
+// Handler wraps the http.Handler with session management
+// the Identifier for the request can be taken by IdentifierFromRequest() in the handler
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := Identifier(r)
+		r = r.WithContext(NewIdentifierContext(r.Context(), id))
+		if m.autoTx {
+			m.orm.SetAutoTransaction(id, true)
+		}
+		defer m.orm.CloseAll(id)
+		defer m.orm.MarkInUse(id)()
+
+		rec := &statusRecorder{ResponseWriter: w, limit: m.maxBuffer}
+		defer func() {
+			if p := recover(); p != nil {
+				m.handleError(r, m.orm.RollbackAll(id))
+				panic(p)
+			}
+
+			if !m.isSuccess(rec.Status()) {
+				m.handleError(r, m.orm.RollbackAll(id))
+				rec.send()
+				return
+			}
+			if err := m.orm.CommitAll(id); err != nil {
+				m.handleError(r, err)
+				rec.fail()
+				return
+			}
+			rec.send()
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// handleError calls the error handler
+func (m *Middleware) handleError(r *http.Request, err error) {
+	if err == nil || m.errorHandler == nil {
+		return
+	}
+	m.errorHandler(r, err)
+}
+
+// isSuccessStatus checks the http status is not error
+func isSuccessStatus(status int) bool {
+	return status < http.StatusBadRequest
+}
+
+// NewIdentifierContext returns the context with the Identifier
+func NewIdentifierContext(ctx context.Context, id Identifier) context.Context {
+	return context.WithValue(ctx, identifierKey, id)
+}
+
+// IdentifierFromContext returns the Identifier in the context
+func IdentifierFromContext(ctx context.Context) (Identifier, bool) {
+	id := ctx.Value(identifierKey)
+	return id, id != nil
+}
+
+// IdentifierFromRequest returns the Identifier set by Middleware
+func IdentifierFromRequest(r *http.Request) (Identifier, bool) {
+	return IdentifierFromContext(r.Context())
+}
+
+// statusRecorder saves the response status and buffers the response until send() is called
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	limit  int  // the size limit of the buffer, zero means no limit
+	sent   bool // the response is written into the ResponseWriter directly
+}
+
+// WriteHeader saves the status
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = status
+	if r.sent {
+		r.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write buffers the data with 200 status when the status is not written yet
+// the buffered response is sent when the data exceeds the size limit.
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.limit > 0 && r.body.Len()+len(b) > r.limit {
+		r.send()
+	}
+	if r.sent {
+		return r.ResponseWriter.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+// Flush sends the buffered response when the ResponseWriter supports it
+// the response is sent before committing.
+func (r *statusRecorder) Flush() {
+	f, ok := r.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	r.send()
+	f.Flush()
+}
+
+// Hijack takes over the connection when the ResponseWriter supports it
+// the buffered response is discarded, and nothing is sent after committing.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		r.sent = true
+		r.body.Reset()
+	}
+	return conn, rw, err
+}
+
+// send writes the buffered response into the ResponseWriter
+func (r *statusRecorder) send() {
+	if r.sent {
+		return
+	}
+	r.sent = true
+	if r.status != 0 {
+		r.ResponseWriter.WriteHeader(r.status)
+	}
+	if r.body.Len() > 0 {
+		r.ResponseWriter.Write(r.body.Bytes())
+		r.body.Reset()
+	}
+}
+
+// fail discards the buffered response and sends 500 when the response is not sent yet
+func (r *statusRecorder) fail() {
+	if r.sent {
+		return
+	}
+	r.sent = true
+	r.body.Reset()
+
+	// the headers for the discarded response must not be sent with the error
+	h := r.ResponseWriter.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("Content-Type")
+	http.Error(r.ResponseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// Status returns the response status
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
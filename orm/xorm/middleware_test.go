@@ -0,0 +1,152 @@
+package xorm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+
+	var reqID Identifier
+	insert := func(status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := IdentifierFromRequest(r)
+			assert.True(ok)
+			assert.True(orm.IsAutoTransaction(id))
+			reqID = id
+
+			_, err := orm.Insert(id, testUser{ID: 1}, func(s Session) (int64, error) {
+				return s.Insert(&testUser{ID: 4})
+			})
+			assert.Nil(err)
+			w.WriteHeader(status)
+		})
+	}
+
+	m := NewMiddleware(orm)
+	m.SetAutoTransaction(true)
+
+	// rollback on error status
+	m.Handler(insert(http.StatusInternalServerError)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.EqualValues(3, countUserMaster(orm), "transaction is rolled back")
+	assert.False(xsm.hasSessionList(reqID), "sessions are closed")
+
+	// commit on success status
+	m.Handler(insert(http.StatusCreated)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.EqualValues(4, countUserMaster(orm), "transaction is committed")
+	assert.False(xsm.hasSessionList(reqID), "sessions are closed")
+
+	initTestDB()
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+
+	var reqID Identifier
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID, _ = IdentifierFromRequest(r)
+		orm.Insert(reqID, testUser{ID: 1}, func(s Session) (int64, error) {
+			return s.Insert(&testUser{ID: 4})
+		})
+		panic("handler error")
+	})
+
+	m := NewMiddleware(orm)
+	m.SetAutoTransaction(true)
+	assert.Panics(func() {
+		m.Handler(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}, "panic is propagated")
+	assert.EqualValues(3, countUserMaster(orm), "transaction is rolled back")
+	assert.False(xsm.hasSessionList(reqID), "sessions are closed")
+}
+
+func TestIdentifierFromRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	_, ok := IdentifierFromRequest(r)
+	assert.False(ok)
+
+	r = r.WithContext(NewIdentifierContext(r.Context(), testID))
+	id, ok := IdentifierFromRequest(r)
+	assert.True(ok)
+	assert.Equal(testID, id)
+}
+
+func TestStatusRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	assert.Equal(http.StatusOK, rec.Status())
+	rec.Write([]byte("ok"))
+	rec.WriteHeader(http.StatusNotFound)
+	assert.Equal(http.StatusOK, rec.Status(), "first status is used")
+
+	rec = &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.WriteHeader(http.StatusBadRequest)
+	assert.Equal(http.StatusBadRequest, rec.Status())
+	assert.False(isSuccessStatus(rec.Status()))
+
+	// buffered until send
+	w := httptest.NewRecorder()
+	rec = &statusRecorder{ResponseWriter: w}
+	rec.WriteHeader(http.StatusCreated)
+	rec.Write([]byte("ok"))
+	assert.False(w.Flushed)
+	assert.Equal(0, w.Body.Len(), "the response is not sent before committing")
+	rec.send()
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Equal("ok", w.Body.String())
+
+	// commit failure
+	w = httptest.NewRecorder()
+	rec = &statusRecorder{ResponseWriter: w}
+	rec.Header().Set("Content-Length", "2")
+	rec.Header().Set("Content-Encoding", "gzip")
+	rec.Header().Set("Content-Type", "application/json")
+	rec.Write([]byte("ok"))
+	rec.fail()
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.NotContains(w.Body.String(), "ok")
+	assert.Empty(w.Header().Get("Content-Length"), "the headers of the discarded response are removed")
+	assert.Empty(w.Header().Get("Content-Encoding"))
+	assert.Equal("text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// over the size limit
+	w = httptest.NewRecorder()
+	rec = &statusRecorder{ResponseWriter: w, limit: 4}
+	rec.Write([]byte("ok"))
+	assert.Equal(0, w.Body.Len())
+	rec.Write([]byte("!!!"))
+	assert.Equal("ok!!!", w.Body.String(), "the buffer is sent when the data exceeds the limit")
+	rec.Write([]byte("?"))
+	rec.fail()
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ok!!!?", w.Body.String())
+
+	// flushed before committing
+	w = httptest.NewRecorder()
+	rec = &statusRecorder{ResponseWriter: w}
+	rec.Write([]byte("ok"))
+	rec.Flush()
+	rec.Write([]byte("!"))
+	rec.fail()
+	assert.True(w.Flushed)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ok!", w.Body.String())
+
+	// hijack
+	var _ http.Hijacker = rec
+	_, _, err := rec.Hijack()
+	assert.Equal(http.ErrNotSupported, err)
+}
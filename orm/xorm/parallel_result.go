@@ -0,0 +1,77 @@
+package xorm
+
+// ShardResult is the result of the parallel query for the shard
+type ShardResult struct {
+	Shard    int         // the index of the shard
+	DB       Engine      // the db of the shard
+	Rows     interface{} // the slice or map of the rows for SELECT query
+	Count    int64       // the number of the rows for SELECT, COUNT and UPDATE query
+	Err      error
+	TimedOut bool
+}
+
+// ParallelResult is the results of the parallel query for all of the shards
+// the results are ordered by the shard index.
+type ParallelResult struct {
+	Shards []ShardResult
+}
+
+// Get returns the result of the shard index
+func (r ParallelResult) Get(shard int) (ShardResult, bool) {
+	for _, s := range r.Shards {
+		if s.Shard == shard {
+			return s, true
+		}
+	}
+	return ShardResult{}, false
+}
+
+// GetByDB returns the result of the db
+func (r ParallelResult) GetByDB(db Engine) (ShardResult, bool) {
+	for _, s := range r.Shards {
+		if s.DB == db {
+			return s, true
+		}
+	}
+	return ShardResult{}, false
+}
+
+// Counts returns the counts of the shards in the order of the shard index
+func (r ParallelResult) Counts() []int64 {
+	counts := make([]int64, len(r.Shards))
+	for i, s := range r.Shards {
+		counts[i] = s.Count
+	}
+	return counts
+}
+
+// TotalCount returns the sum of the counts of the shards
+func (r ParallelResult) TotalCount() int64 {
+	var total int64
+	for _, s := range r.Shards {
+		total += s.Count
+	}
+	return total
+}
+
+// Errors returns the errors keyed by the shard index
+func (r ParallelResult) Errors() map[int]error {
+	errs := make(map[int]error)
+	for _, s := range r.Shards {
+		if s.Err != nil {
+			errs[s.Shard] = s.Err
+		}
+	}
+	return errs
+}
+
+// TimedOut returns the shard indexes of the timed out queries
+func (r ParallelResult) TimedOut() []int {
+	var list []int
+	for _, s := range r.Shards {
+		if s.TimedOut {
+			list = append(list, s.Shard)
+		}
+	}
+	return list
+}
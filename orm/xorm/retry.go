@@ -0,0 +1,122 @@
+package xorm
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+const (
+	defaultRetryBaseDelay = 10 * time.Millisecond
+	defaultRetryMaxDelay  = time.Second
+	defaultRetryJitter    = 0.5
+)
+
+// RetryPolicy is the policy to retry the operation failed by the transient error
+// e.g. deadlock, lock wait timeout, connection reset
+type RetryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	jitter      float64
+	classifier  func(error) bool
+}
+
+// NewRetryPolicy creates *RetryPolicy
+// maxAttempts is the number of attempts including the first one.
+func NewRetryPolicy(maxAttempts int) *RetryPolicy {
+	return &RetryPolicy{
+		maxAttempts: maxAttempts,
+		baseDelay:   defaultRetryBaseDelay,
+		maxDelay:    defaultRetryMaxDelay,
+		jitter:      defaultRetryJitter,
+		classifier:  errors.IsRetryable,
+	}
+}
+
+// SetBackoff sets the delay before the first retry and the upper limit of the delay
+// the delay is doubled on every retry.
+func (p *RetryPolicy) SetBackoff(base, max time.Duration) {
+	p.baseDelay = base
+	p.maxDelay = max
+}
+
+// SetJitter sets the ratio of the randomized part of the delay, from 0.0 to 1.0
+func (p *RetryPolicy) SetJitter(ratio float64) {
+	switch {
+	case ratio < 0:
+		ratio = 0
+	case ratio > 1:
+		ratio = 1
+	}
+	p.jitter = ratio
+}
+
+// SetClassifier sets the function to check the error is retryable
+// errors.IsRetryable is used by default.
+func (p *RetryPolicy) SetClassifier(fn func(error) bool) {
+	p.classifier = fn
+}
+
+// Delay returns the delay before the n-th retry
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	d := p.baseDelay
+	for i := 1; i < n && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+
+	if r := int64(float64(d) * p.jitter); r > 0 {
+		d -= time.Duration(rand.Int63n(r + 1))
+	}
+	return d
+}
+
+// IsRetryable checks the error is retryable by the classifier
+func (p *RetryPolicy) IsRetryable(err error) bool {
+	if _, ok := err.(permanentErr); ok {
+		return false
+	}
+	return p.classifier(err)
+}
+
+// do executes the function and retries it while the error is retryable
+// nil policy executes the function only once.
+// when the context is done while waiting, the last error is returned.
+func (p *RetryPolicy) do(ctx context.Context, fn func() error) error {
+	if p == nil {
+		return unwrapPermanent(fn())
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= p.maxAttempts || !p.IsRetryable(err) {
+			return unwrapPermanent(err)
+		}
+
+		timer := time.NewTimer(p.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// permanentErr is the error which must not be retried
+type permanentErr struct {
+	error
+}
+
+func unwrapPermanent(err error) error {
+	if e, ok := err.(permanentErr); ok {
+		return e.error
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package xorm
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	assert := assert.New(t)
+	p := NewRetryPolicy(5)
+	p.SetBackoff(10*time.Millisecond, 50*time.Millisecond)
+	p.SetJitter(0)
+
+	assert.Equal(10*time.Millisecond, p.Delay(1))
+	assert.Equal(20*time.Millisecond, p.Delay(2))
+	assert.Equal(40*time.Millisecond, p.Delay(3))
+	assert.Equal(50*time.Millisecond, p.Delay(4), "delay is limited")
+	assert.Equal(50*time.Millisecond, p.Delay(100))
+
+	p.SetJitter(0.5)
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		assert.True(d >= 10*time.Millisecond && d <= 20*time.Millisecond, "delay=%s", d)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	assert := assert.New(t)
+	p := NewRetryPolicy(3)
+	p.SetBackoff(time.Millisecond, time.Millisecond)
+	ctx := context.Background()
+
+	// succeeds after retry
+	count := 0
+	err := p.do(ctx, func() error {
+		count++
+		if count < 3 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(3, count)
+
+	// max attempts
+	count = 0
+	err = p.do(ctx, func() error {
+		count++
+		return driver.ErrBadConn
+	})
+	assert.Equal(driver.ErrBadConn, err)
+	assert.Equal(3, count)
+
+	// not retryable
+	count = 0
+	err = p.do(ctx, func() error {
+		count++
+		return errors.NewErr(1062, "duplicate entry")
+	})
+	assert.Equal(errors.NewErr(1062, "duplicate entry"), err)
+	assert.Equal(1, count)
+
+	count = 0
+	err = p.do(ctx, func() error {
+		count++
+		return permanentErr{driver.ErrBadConn}
+	})
+	assert.Equal(driver.ErrBadConn, err)
+	assert.Equal(1, count, "permanent error is not retried")
+
+	// custom classifier
+	p.SetClassifier(func(err error) bool { return true })
+	count = 0
+	p.do(ctx, func() error {
+		count++
+		return errors.NewErr(1062, "duplicate entry")
+	})
+	assert.Equal(3, count)
+
+	// context is done while waiting
+	p.SetBackoff(time.Hour, time.Hour)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	count = 0
+	err = p.do(ctx, func() error {
+		count++
+		return driver.ErrBadConn
+	})
+	assert.Equal(driver.ErrBadConn, err)
+	assert.Equal(1, count)
+
+	// nil policy
+	var nilPolicy *RetryPolicy
+	count = 0
+	nilPolicy.do(context.Background(), func() error {
+		count++
+		return driver.ErrBadConn
+	})
+	assert.Equal(1, count)
+}
+
+// testSQLStateError is the error with SQLSTATE like *pq.Error
+type testSQLStateError string
+
+func (e testSQLStateError) Error() string    { return "sqlstate " + string(e) }
+func (e testSQLStateError) SQLState() string { return string(e) }
+
+func TestCommitErr(t *testing.T) {
+	assert := assert.New(t)
+	deadlock := errors.NewErrCommitAll([]error{testSQLStateError("40P01")})
+	lost := errors.NewErrCommitAll([]error{driver.ErrBadConn})
+
+	assert.Nil(commitErr(nil, 1))
+	assert.Equal(deadlock, commitErr(deadlock, 1), "deadlock of the single db is retryable")
+	assert.Equal(permanentErr{deadlock}, commitErr(deadlock, 2), "some of the dbs may be committed")
+	assert.Equal(permanentErr{lost}, commitErr(lost, 1), "the result of COMMIT is unknown")
+
+	p := NewRetryPolicy(3)
+	assert.True(p.IsRetryable(commitErr(deadlock, 1)))
+	assert.False(p.IsRetryable(commitErr(lost, 1)))
+}
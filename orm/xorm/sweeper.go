@@ -0,0 +1,114 @@
+package xorm
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultSweepInterval = time.Minute
+
+// Sweeper reclaims the abandoned identifiers
+// the SessionList which is not used for the idle TTL is rolled back and closed.
+// the idle time is updated only by the manager calls, so the caller running the query longer than the TTL
+// on the session must mark the identifier in use by MarkInUse().
+type Sweeper struct {
+	orm      *Xorm
+	ttl      time.Duration
+	interval time.Duration
+	reporter func(SweepReport)
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// SweepReport is the information of the reclaimed identifier
+type SweepReport struct {
+	ID           Identifier
+	Idle         time.Duration
+	Sessions     int
+	Transactions int // the number of uncommitted transactions rolled back
+}
+
+// NewSweeper returns initialized Sweeper
+func NewSweeper(orm *Xorm, ttl time.Duration) *Sweeper {
+	return &Sweeper{
+		orm:      orm,
+		ttl:      ttl,
+		interval: defaultSweepInterval,
+	}
+}
+
+// SetInterval sets the interval of sweeping
+func (s *Sweeper) SetInterval(d time.Duration) {
+	s.interval = d
+}
+
+// SetReporter sets the function called for every reclaimed identifier
+// e.g. logging the identifier which CloseAll() is forgotten
+func (s *Sweeper) SetReporter(fn func(SweepReport)) {
+	s.reporter = fn
+}
+
+// Start starts sweeping on background
+func (s *Sweeper) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stop = stop
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.Sweep()
+			}
+		}
+	}()
+}
+
+// Stop stops sweeping
+func (s *Sweeper) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.stop = nil
+}
+
+// Sweep rolls back and closes the SessionList not used for the idle TTL
+// the SessionList in use (see MarkInUse()) is not reclaimed even when it's idle.
+func (s *Sweeper) Sweep() []SweepReport {
+	xse := s.orm.XormSessionManager
+	var reports []SweepReport
+	for _, id := range xse.idleSessionLists(s.ttl) {
+		sl, ok := xse.takeIdleSessionList(id, s.ttl)
+		if !ok {
+			// used again after listing
+			continue
+		}
+
+		report := SweepReport{
+			ID:           id,
+			Idle:         sl.idleTime(),
+			Sessions:     len(sl.getSessions()),
+			Transactions: len(sl.getTransactions()),
+		}
+
+		xse.releaseSessionList(sl)
+
+		reports = append(reports, report)
+		if s.reporter != nil {
+			s.reporter(report)
+		}
+	}
+	return reports
+}
@@ -0,0 +1,102 @@
+package xorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweeperSweep(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+
+	var reported []SweepReport
+	sw := NewSweeper(orm, 50*time.Millisecond)
+	sw.SetReporter(func(r SweepReport) {
+		reported = append(reported, r)
+	})
+
+	// abandoned transaction
+	s, err := orm.Transaction("abandoned", testUser{ID: 1})
+	assert.Nil(err)
+	s.Insert(&testUser{ID: 4})
+	_, err = orm.UseSlaveSession("abandoned", testFoobar{})
+	assert.Nil(err)
+
+	assert.Empty(sw.Sweep(), "not idle yet")
+	testWaitForIO()
+
+	// active identifier
+	orm.UseSlaveSession("active", testFoobar{})
+
+	reports := sw.Sweep()
+	assert.Len(reports, 1)
+	assert.Equal("abandoned", reports[0].ID)
+	assert.Equal(1, reports[0].Sessions)
+	assert.Equal(1, reports[0].Transactions)
+	assert.True(reports[0].Idle >= 50*time.Millisecond)
+	assert.Equal(reports, reported)
+
+	assert.False(xsm.hasSessionList("abandoned"))
+	assert.True(xsm.hasSessionList("active"))
+	assert.EqualValues(3, countUserMaster(orm), "abandoned transaction is rolled back")
+	orm.CloseAll("active")
+}
+
+func TestSweeperStart(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+
+	sw := NewSweeper(orm, 10*time.Millisecond)
+	sw.SetInterval(10 * time.Millisecond)
+	sw.Start()
+	sw.Start()
+	defer sw.Stop()
+
+	orm.UseSlaveSession("abandoned", testFoobar{})
+	assert.True(xsm.hasSessionList("abandoned"))
+	testWaitForIO()
+	assert.False(xsm.hasSessionList("abandoned"))
+
+	sw.Stop()
+	orm.UseSlaveSession("abandoned", testFoobar{})
+	testWaitForIO()
+	assert.True(xsm.hasSessionList("abandoned"), "not swept after stop")
+	orm.CloseAll("abandoned")
+}
+
+func TestSweeperSweepInUse(t *testing.T) {
+	assert := assert.New(t)
+	xsm := &XormSessionManager{}
+	sw := NewSweeper(&Xorm{XormSessionManager: xsm}, 20*time.Millisecond)
+
+	done := xsm.MarkInUse("long query")
+	xsm.getOrCreateSessionList("abandoned")
+	time.Sleep(40 * time.Millisecond)
+
+	reports := sw.Sweep()
+	assert.Len(reports, 1)
+	assert.Equal("abandoned", reports[0].ID)
+	assert.True(xsm.hasSessionList("long query"), "the identifier in use is not reclaimed")
+
+	done()
+	done()
+	assert.Empty(sw.Sweep(), "the idle time starts after the use")
+	time.Sleep(40 * time.Millisecond)
+	assert.Len(sw.Sweep(), 1)
+	assert.False(xsm.hasSessionList("long query"))
+
+	// used again after listing
+	xsm.getOrCreateSessionList("used again")
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal([]Identifier{"used again"}, xsm.idleSessionLists(20*time.Millisecond))
+	xsm.getOrCreateSessionList("used again")
+	_, ok := xsm.takeIdleSessionList("used again", 20*time.Millisecond)
+	assert.False(ok)
+	assert.True(xsm.hasSessionList("used again"))
+}
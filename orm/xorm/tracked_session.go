@@ -0,0 +1,206 @@
+package xorm
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/evalphobia/wizard"
+	"github.com/go-xorm/xorm"
+)
+
+// trackedSession is the session which runs the release function once on Close()
+// the session of the transaction runs it when the transaction ends too.
+// the written function runs after writing by Insert()/Update()/Delete()/Exec() succeeds.
+type trackedSession struct {
+	Session
+	once    sync.Once
+	release func()
+	written func()
+	tx      bool
+}
+
+// newTrackedSession returns the session which runs the release function once on Close()
+func newTrackedSession(s Session, release func()) *trackedSession {
+	return &trackedSession{Session: s, release: release}
+}
+
+// Close closes the session and runs the release function
+func (s *trackedSession) Close() {
+	s.Session.Close()
+	s.once.Do(s.release)
+}
+
+// Insert inserts the rows and runs the written function
+func (s *trackedSession) Insert(beans ...interface{}) (int64, error) {
+	affected, err := s.Session.Insert(beans...)
+	s.wrote(err)
+	return affected, err
+}
+
+// InsertMulti inserts the rows and runs the written function
+func (s *trackedSession) InsertMulti(beans interface{}) (int64, error) {
+	affected, err := s.Session.InsertMulti(beans)
+	s.wrote(err)
+	return affected, err
+}
+
+// Update updates the rows and runs the written function
+func (s *trackedSession) Update(bean interface{}, condiBeans ...interface{}) (int64, error) {
+	affected, err := s.Session.Update(bean, condiBeans...)
+	s.wrote(err)
+	return affected, err
+}
+
+// Delete deletes the rows and runs the written function
+func (s *trackedSession) Delete(bean interface{}) (int64, error) {
+	affected, err := s.Session.Delete(bean)
+	s.wrote(err)
+	return affected, err
+}
+
+// Exec executes the sql and runs the written function
+func (s *trackedSession) Exec(query string, args ...interface{}) (sql.Result, error) {
+	result, err := s.Session.Exec(query, args...)
+	s.wrote(err)
+	return result, err
+}
+
+// wrote runs the written function when writing succeeds
+func (s *trackedSession) wrote(err error) {
+	if err == nil && s.written != nil {
+		s.written()
+	}
+}
+
+// Context sets the context into the session when the xorm version supports it
+func (s *trackedSession) Context(ctx context.Context) *xorm.Session {
+	if cs, ok := s.Session.(contextSession); ok {
+		return cs.Context(ctx)
+	}
+	return nil
+}
+
+// openSession returns new session of the db which is counted as in use until it's closed
+// the in-flight queries of the node are counted too when the node is given.
+func (xse *XormSessionManager) openSession(db Engine, node *wizard.Node) *trackedSession {
+	xse.usage.acquire(db)
+	if node != nil {
+		node.Acquire()
+	}
+	return newTrackedSession(db.NewSession(), func() {
+		if node != nil {
+			node.Release()
+		}
+		xse.usage.release(db)
+	})
+}
+
+// trackWrites marks the master db dirty in the SessionList after writing by the session
+// the writes by the chained session (e.g. s.Where(...).Update(...)) are not tracked.
+func (xse *XormSessionManager) trackWrites(sl *SessionList, db Engine, s *trackedSession) *trackedSession {
+	s.written = func() {
+		xse.markDirty(sl, db)
+	}
+	return s
+}
+
+// openTxSession returns new session for the transaction which is counted as in use until the transaction ends
+func (xse *XormSessionManager) openTxSession(db Engine) *trackedSession {
+	s := xse.openSession(db, nil)
+	s.tx = true
+	return s
+}
+
+// endTransaction resets the session after the transaction is committed or rolled back
+// the session created for the transaction is no longer counted as in use.
+func endTransaction(s Session) {
+	s.Init()
+	if ts, ok := s.(*trackedSession); ok && ts.tx {
+		ts.once.Do(ts.release)
+	}
+}
+
+// engineUsage counts the open sessions of each engine
+// the draining engine is closed after all of its sessions are closed.
+// the lookups of the engines are pinned to the epoch of the clusters,
+// so the engine taken from the old clusters is not closed before its session is counted.
+type engineUsage struct {
+	mu    sync.Mutex
+	count map[Engine]int
+	epoch int
+	pins  map[int]int // the lookups in progress for each epoch
+}
+
+// pin marks the lookup of the engines in progress until the returned function is called
+// it must be called before the lookup, and the returned function after counting the session.
+func (u *engineUsage) pin() func() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pins == nil {
+		u.pins = make(map[int]int)
+	}
+	epoch := u.epoch
+	u.pins[epoch]++
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.pins[epoch] <= 1 {
+			delete(u.pins, epoch)
+			return
+		}
+		u.pins[epoch]--
+	}
+}
+
+// advance starts new epoch after the clusters are replaced, and returns it
+func (u *engineUsage) advance() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.epoch++
+	return u.epoch
+}
+
+// isPinned checks the lookups started before the epoch are in progress
+// u.mu must be locked by the caller
+func (u *engineUsage) isPinned(epoch int) bool {
+	for e := range u.pins {
+		if e < epoch {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire counts the new session of the engine
+func (u *engineUsage) acquire(db Engine) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count == nil {
+		u.count = make(map[Engine]int)
+	}
+	u.count[db]++
+}
+
+// release uncounts the closed session of the engine
+func (u *engineUsage) release(db Engine) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count[db] <= 1 {
+		delete(u.count, db)
+		return
+	}
+	u.count[db]--
+}
+
+// closeIfIdle closes the engine when it has no open session and no lookup before the epoch is in progress
+// the new session cannot be counted between the check and closing.
+func (u *engineUsage) closeIfIdle(db Engine, epoch int) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count[db] > 0 || u.isPinned(epoch) {
+		return false
+	}
+	db.Close()
+	return true
+}
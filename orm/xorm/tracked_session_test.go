@@ -0,0 +1,158 @@
+package xorm
+
+import (
+	"database/sql"
+	stderrors "errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard"
+)
+
+type testEngine struct {
+	Engine
+	closed int32
+}
+
+func (e *testEngine) Close() error {
+	atomic.AddInt32(&e.closed, 1)
+	return nil
+}
+
+func TestTrackedSession(t *testing.T) {
+	assert := assert.New(t)
+
+	node := wizard.NewNode(nil)
+	node.Acquire()
+	base := &testShardSession{}
+	s := newTrackedSession(base, node.Release)
+	assert.EqualValues(1, node.InFlight())
+
+	s.Close()
+	s.Close()
+	assert.EqualValues(0, node.InFlight(), "the node is released only once")
+	assert.EqualValues(2, atomic.LoadInt32(&base.closed))
+
+	// transaction
+	var released int32
+	s = newTrackedSession(base, func() { atomic.AddInt32(&released, 1) })
+	endTransaction(s)
+	assert.EqualValues(0, atomic.LoadInt32(&released), "the session not created for the transaction is released by Close()")
+	s.tx = true
+	endTransaction(s)
+	s.Close()
+	assert.EqualValues(1, atomic.LoadInt32(&released))
+}
+
+// testWriteSession is Session which returns the error of writing
+type testWriteSession struct {
+	Session
+	err error
+}
+
+func (s *testWriteSession) Insert(...interface{}) (int64, error)   { return 1, s.err }
+func (s *testWriteSession) InsertMulti(interface{}) (int64, error) { return 1, s.err }
+func (s *testWriteSession) Update(interface{}, ...interface{}) (int64, error) {
+	return 1, s.err
+}
+func (s *testWriteSession) Delete(interface{}) (int64, error)               { return 1, s.err }
+func (s *testWriteSession) Exec(string, ...interface{}) (sql.Result, error) { return nil, s.err }
+
+func TestTrackedSessionWritten(t *testing.T) {
+	assert := assert.New(t)
+
+	base := &testWriteSession{}
+	var written int
+	s := newTrackedSession(base, func() {})
+	s.written = func() { written++ }
+
+	s.Insert(testUser{})
+	s.InsertMulti([]testUser{})
+	s.Update(testUser{})
+	s.Delete(testUser{})
+	s.Exec("DELETE FROM test_user")
+	assert.Equal(5, written)
+
+	base.err = stderrors.New("error")
+	s.Insert(testUser{})
+	s.Exec("DELETE FROM test_user")
+	assert.Equal(5, written, "failed writes are not tracked")
+
+	s.written = nil
+	base.err = nil
+	_, err := s.Update(testUser{})
+	assert.Nil(err)
+}
+
+func TestEngineUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	var u engineUsage
+	e := &testEngine{}
+	u.acquire(e)
+	u.acquire(e)
+	assert.False(u.closeIfIdle(e, 0))
+	u.release(e)
+	assert.False(u.closeIfIdle(e, 0))
+	u.release(e)
+	assert.True(u.closeIfIdle(e, 0))
+	assert.EqualValues(1, atomic.LoadInt32(&e.closed))
+	assert.Empty(u.count)
+
+	// the lookup before the epoch
+	unpin := u.pin()
+	epoch := u.advance()
+	assert.False(u.closeIfIdle(e, epoch), "the engine may be taken from the old clusters")
+	newUnpin := u.pin()
+	unpin()
+	assert.True(u.closeIfIdle(e, epoch), "the lookup of the new clusters is not waited")
+	newUnpin()
+	assert.Empty(u.pins)
+}
+
+func TestDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	xse := &XormSessionManager{}
+	busy := &testEngine{}
+	idle := &testEngine{}
+	xse.usage.acquire(busy)
+
+	done := make(chan error)
+	go func() {
+		done <- xse.drain([]Engine{busy, idle}, 0)
+	}()
+
+	time.Sleep(5 * drainInterval)
+	assert.EqualValues(1, atomic.LoadInt32(&idle.closed))
+	assert.EqualValues(0, atomic.LoadInt32(&busy.closed), "the engine in use is not closed")
+
+	xse.usage.release(busy)
+	assert.Nil(<-done)
+	assert.EqualValues(1, atomic.LoadInt32(&busy.closed))
+
+	// the lookup in progress when the clusters are replaced
+	removed := &testEngine{}
+	unpin := xse.usage.pin()
+	go func() {
+		done <- xse.drain([]Engine{removed}, 0)
+	}()
+	time.Sleep(5 * drainInterval)
+	assert.EqualValues(0, atomic.LoadInt32(&removed.closed), "the engine may be taken before replacing the clusters")
+	xse.usage.acquire(removed)
+	unpin()
+	time.Sleep(5 * drainInterval)
+	assert.EqualValues(0, atomic.LoadInt32(&removed.closed), "the session opened by the lookup is counted")
+	xse.usage.release(removed)
+	assert.Nil(<-done)
+	assert.EqualValues(1, atomic.LoadInt32(&removed.closed))
+
+	// timeout
+	xse.usage.acquire(busy)
+	err := xse.drain([]Engine{busy}, drainInterval)
+	assert.NotNil(err)
+	assert.EqualValues(2, atomic.LoadInt32(&busy.closed), "closed forcibly")
+}
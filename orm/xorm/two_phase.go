@@ -0,0 +1,378 @@
+package xorm
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evalphobia/wizard/errors"
+	"github.com/go-xorm/xorm"
+)
+
+// Execer is interface for executing sql, [Session | Engine]
+type Execer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+// Queryer is interface for querying sql, [Session | Engine]
+type Queryer interface {
+	Query(...interface{}) ([]map[string][]byte, error)
+}
+
+// TwoPhaseDialect issues the statements of two-phase commit for the database
+// the branch runs on the dedicated connection without the transaction of database/sql,
+// and the prepared branch is resolved on the connection of the branch, or on the engine by Recover().
+type TwoPhaseDialect interface {
+	Start(s Execer, xid string) error     // starts the branch on the dedicated connection
+	Prepare(s Execer, xid string) error   // prepares the branch
+	Abort(s Execer, xid string) error     // rolls back the branch which is not prepared
+	Commit(db Execer, xid string) error   // commits the prepared branch
+	Rollback(db Execer, xid string) error // rolls back the prepared branch
+	Recover(db Queryer) ([]string, error) // returns the xids of the prepared branches
+}
+
+// MySQLDialect is TwoPhaseDialect for MySQL, using XA transaction
+type MySQLDialect struct{}
+
+// Start starts XA transaction
+func (MySQLDialect) Start(s Execer, xid string) error {
+	_, err := s.Exec("XA START " + quoteXID(xid))
+	return err
+}
+
+// Prepare ends and prepares XA transaction
+func (MySQLDialect) Prepare(s Execer, xid string) error {
+	if _, err := s.Exec("XA END " + quoteXID(xid)); err != nil {
+		return err
+	}
+	_, err := s.Exec("XA PREPARE " + quoteXID(xid))
+	return err
+}
+
+// Abort rolls back XA transaction which is not prepared
+func (MySQLDialect) Abort(s Execer, xid string) error {
+	// XA END fails when the transaction is already ended by Prepare()
+	s.Exec("XA END " + quoteXID(xid))
+	_, err := s.Exec("XA ROLLBACK " + quoteXID(xid))
+	return err
+}
+
+// Commit commits the prepared XA transaction
+func (MySQLDialect) Commit(db Execer, xid string) error {
+	_, err := db.Exec("XA COMMIT " + quoteXID(xid))
+	return err
+}
+
+// Rollback rolls back the prepared XA transaction
+func (MySQLDialect) Rollback(db Execer, xid string) error {
+	_, err := db.Exec("XA ROLLBACK " + quoteXID(xid))
+	return err
+}
+
+// Recover returns the xids of the prepared XA transactions
+func (MySQLDialect) Recover(db Queryer) ([]string, error) {
+	return queryXIDs(db, "data", "XA RECOVER")
+}
+
+// PostgresDialect is TwoPhaseDialect for PostgreSQL, using PREPARE TRANSACTION
+// max_prepared_transactions must be set on the server.
+type PostgresDialect struct{}
+
+// Start starts the transaction
+func (PostgresDialect) Start(s Execer, xid string) error {
+	_, err := s.Exec("BEGIN")
+	return err
+}
+
+// Prepare prepares the transaction
+func (PostgresDialect) Prepare(s Execer, xid string) error {
+	_, err := s.Exec("PREPARE TRANSACTION " + quoteXID(xid))
+	return err
+}
+
+// Abort rolls back the transaction which is not prepared
+func (PostgresDialect) Abort(s Execer, xid string) error {
+	_, err := s.Exec("ROLLBACK")
+	return err
+}
+
+// Commit commits the prepared transaction
+func (PostgresDialect) Commit(db Execer, xid string) error {
+	_, err := db.Exec("COMMIT PREPARED " + quoteXID(xid))
+	return err
+}
+
+// Rollback rolls back the prepared transaction
+func (PostgresDialect) Rollback(db Execer, xid string) error {
+	_, err := db.Exec("ROLLBACK PREPARED " + quoteXID(xid))
+	return err
+}
+
+// Recover returns the xids of the prepared transactions in the current database
+func (PostgresDialect) Recover(db Queryer) ([]string, error) {
+	return queryXIDs(db, "gid", "SELECT gid FROM pg_prepared_xacts WHERE database = current_database()")
+}
+
+// quoteXID returns the quoted xid for the sql
+func quoteXID(xid string) string {
+	return "'" + strings.Replace(xid, "'", "''", -1) + "'"
+}
+
+// queryXIDs returns the values of the column
+func queryXIDs(db Queryer, column string, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, row := range rows {
+		list = append(list, string(row[column]))
+	}
+	return list, nil
+}
+
+// Coordinator is the coordinator of two-phase commit
+// the commit decision is saved into the TxLog before committing the prepared branches,
+// and Recover() resolves the in-doubt branches after a crash by the log.
+// every process sharing the same databases must use its own prefix of the global transaction id and its own TxLog.
+type Coordinator struct {
+	log    TxLog
+	prefix string
+	seq    uint64
+
+	dialectMu sync.RWMutex
+	dialects  map[string]TwoPhaseDialect
+	opener    func(Engine) (Engine, error)
+
+	shardIndex func(db interface{}) int // resolves the shard of the error, set by SetCoordinator()
+
+	activeMu sync.Mutex
+	active   map[string]struct{}
+}
+
+// NewCoordinator returns initialized Coordinator
+// the prefix must be unique for every process and stable across the restarts, e.g. "myapp-host01-8080",
+// because Recover() resolves only the branches with the prefix, and the branches of the other processes are left.
+func NewCoordinator(log TxLog, prefix string) (*Coordinator, error) {
+	if prefix == "" {
+		return nil, errors.NewErrGTIDPrefix()
+	}
+	return &Coordinator{
+		log:    log,
+		prefix: prefix,
+		dialects: map[string]TwoPhaseDialect{
+			"mysql":    MySQLDialect{},
+			"postgres": PostgresDialect{},
+			"pgx":      PostgresDialect{},
+		},
+		opener: openBranchEngine,
+		shardIndex: func(interface{}) int {
+			return -1
+		},
+		active: make(map[string]struct{}),
+	}, nil
+}
+
+// SetDialect sets TwoPhaseDialect for the driver name
+func (c *Coordinator) SetDialect(driver string, d TwoPhaseDialect) {
+	c.dialectMu.Lock()
+	defer c.dialectMu.Unlock()
+	c.dialects[driver] = d
+}
+
+// SetBranchOpener sets the function to open the engine with one connection for the branch
+// the default opens new engine by the driver name and the data source name of the engine,
+// use it to apply the other settings of the engine, e.g. logger, time zone; the engine must use only one connection.
+func (c *Coordinator) SetBranchOpener(fn func(Engine) (Engine, error)) {
+	c.opener = fn
+}
+
+// openBranchEngine opens new engine for the branch, which uses only one connection
+// the connection is not shared with the other sessions, and closed after the branch ends.
+func openBranchEngine(db Engine) (Engine, error) {
+	e, err := xorm.NewEngine(db.DriverName(), db.DataSourceName())
+	if err != nil {
+		return nil, err
+	}
+	e.SetMaxOpenConns(1)
+	if src, ok := db.(*xorm.Engine); ok {
+		e.SetTableMapper(src.TableMapper)
+		e.SetColumnMapper(src.ColumnMapper)
+	}
+	return e, nil
+}
+
+// dialect returns TwoPhaseDialect for the driver of the engine
+func (c *Coordinator) dialect(db Engine) (TwoPhaseDialect, error) {
+	c.dialectMu.RLock()
+	defer c.dialectMu.RUnlock()
+	d, ok := c.dialects[db.DriverName()]
+	if !ok {
+		return nil, errors.NewErrTwoPhaseDriver(db.DriverName())
+	}
+	return d, nil
+}
+
+// newGTID returns new global transaction id and marks it as active
+func (c *Coordinator) newGTID() string {
+	gtid := fmt.Sprintf("%s-%d-%d", c.prefix, time.Now().UnixNano(), atomic.AddUint64(&c.seq, 1))
+	c.activeMu.Lock()
+	defer c.activeMu.Unlock()
+	c.active[gtid] = struct{}{}
+	return gtid
+}
+
+// finish unmarks the global transaction id
+func (c *Coordinator) finish(gtid string) {
+	c.activeMu.Lock()
+	defer c.activeMu.Unlock()
+	delete(c.active, gtid)
+}
+
+// isActive checks the global transaction is in progress on this process
+func (c *Coordinator) isActive(gtid string) bool {
+	c.activeMu.Lock()
+	defer c.activeMu.Unlock()
+	_, ok := c.active[gtid]
+	return ok
+}
+
+// branchXID returns xid of the branch
+func branchXID(gtid string, n int) string {
+	return gtid + "." + strconv.Itoa(n)
+}
+
+// parseXID returns the global transaction id of the branch created by the coordinator
+// the xid must be "<prefix>-<time>-<seq>.<branch>", so the branch of the other prefix starting with the prefix is not matched.
+func (c *Coordinator) parseXID(xid string) (string, bool) {
+	if !strings.HasPrefix(xid, c.prefix+"-") {
+		return "", false
+	}
+	i := strings.LastIndex(xid, ".")
+	if i < 0 || !isDigits(xid[i+1:]) {
+		return "", false
+	}
+	gtid := xid[:i]
+	parts := strings.Split(gtid[len(c.prefix)+1:], "-")
+	if len(parts) != 2 || !isDigits(parts[0]) || !isDigits(parts[1]) {
+		return "", false
+	}
+	return gtid, true
+}
+
+// isDigits checks the string consists of decimal digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Recover resolves the in-doubt branches prepared on the engines
+// the branch whose commit decision is in the log is committed, and the others are rolled back.
+// the engines must contain all of the databases where the branches may be prepared.
+// the commit decision is kept in the log while any engine still reports the prepared branch of it,
+// or the branches of any engine are unknown, e.g. the driver does not have TwoPhaseDialect.
+func (c *Coordinator) Recover(engines []Engine) error {
+	pending, err := c.log.Pending()
+	if err != nil {
+		return err
+	}
+	committed := make(map[string]bool, len(pending))
+	for _, gtid := range pending {
+		committed[gtid] = true
+	}
+
+	var errList []error
+	for _, db := range engines {
+		d, err := c.dialect(db)
+		if err != nil {
+			continue
+		}
+		xids, err := d.Recover(db)
+		if err != nil {
+			errList = append(errList, errors.NewNodeErr(c.shardIndex(db), db, err))
+			continue
+		}
+
+		for _, xid := range xids {
+			gtid, ok := c.parseXID(xid)
+			if !ok || c.isActive(gtid) {
+				continue
+			}
+			if committed[gtid] {
+				err = d.Commit(db, xid)
+			} else {
+				err = d.Rollback(db, xid)
+			}
+			if err != nil {
+				errList = append(errList, errors.NewNodeErr(c.shardIndex(db), db, err))
+			}
+		}
+	}
+	if len(errList) > 0 {
+		return errors.NewErrTwoPhaseRecover(errList)
+	}
+
+	prepared, known, err := c.preparedGTIDs(engines)
+	switch {
+	case err != nil:
+		return err
+	case !known:
+		return nil
+	}
+	for _, gtid := range pending {
+		if c.isActive(gtid) || prepared[gtid] {
+			continue
+		}
+		if err := c.log.Done(gtid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preparedGTIDs returns the global transactions which still have the prepared branches on the engines
+// known is false when the branches of any engine cannot be checked.
+func (c *Coordinator) preparedGTIDs(engines []Engine) (prepared map[string]bool, known bool, err error) {
+	prepared = make(map[string]bool)
+	known = true
+	var errList []error
+	for _, db := range engines {
+		d, err := c.dialect(db)
+		if err != nil {
+			known = false
+			continue
+		}
+		xids, err := d.Recover(db)
+		if err != nil {
+			errList = append(errList, errors.NewNodeErr(c.shardIndex(db), db, err))
+			continue
+		}
+		for _, xid := range xids {
+			if gtid, ok := c.parseXID(xid); ok {
+				prepared[gtid] = true
+			}
+		}
+	}
+	if len(errList) > 0 {
+		return nil, false, errors.NewErrTwoPhaseRecover(errList)
+	}
+	return prepared, known, nil
+}
+
+// branch is the branch of the global transaction on the db
+type branch struct {
+	xid      string
+	dialect  TwoPhaseDialect
+	prepared bool
+}
@@ -0,0 +1,322 @@
+package xorm
+
+import (
+	"database/sql"
+	stderrors "errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// testDialect is TwoPhaseDialect for sqlite, which records the xids
+// the prepared branch is kept as the open transaction on the connection of the branch.
+type testDialect struct {
+	failPrepare bool
+	recovered   []string
+
+	started    []string
+	prepared   []string
+	committed  []string
+	rolledBack []string
+}
+
+func (d *testDialect) Start(s Execer, xid string) error {
+	d.started = append(d.started, xid)
+	_, err := s.Exec("BEGIN")
+	return err
+}
+
+func (d *testDialect) Prepare(s Execer, xid string) error {
+	if d.failPrepare && len(d.prepared) > 0 {
+		return errors.NewErr(1, "prepare error")
+	}
+	d.prepared = append(d.prepared, xid)
+	return nil
+}
+
+func (d *testDialect) Abort(s Execer, xid string) error {
+	_, err := s.Exec("ROLLBACK")
+	return err
+}
+
+func (d *testDialect) Commit(db Execer, xid string) error {
+	d.committed = append(d.committed, xid)
+	return d.exec(db, xid, "COMMIT")
+}
+
+func (d *testDialect) Rollback(db Execer, xid string) error {
+	d.rolledBack = append(d.rolledBack, xid)
+	return d.exec(db, xid, "ROLLBACK")
+}
+
+// exec executes the query on the connection of the branch, the engine on recovery has no transaction
+// the branch resolved on recovery is removed from the recovered xids.
+func (d *testDialect) exec(db Execer, xid string, query string) error {
+	if _, ok := db.(Session); !ok {
+		for i, x := range d.recovered {
+			if x == xid {
+				d.recovered = append(d.recovered[:i:i], d.recovered[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+	_, err := db.Exec(query)
+	return err
+}
+
+func (d *testDialect) Recover(db Queryer) ([]string, error) {
+	return d.recovered, nil
+}
+
+// testExecer records the executed sql
+type testExecer struct {
+	queries []string
+}
+
+func (e *testExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, query)
+	return nil, nil
+}
+
+func (e *testExecer) Query(args ...interface{}) ([]map[string][]byte, error) {
+	e.queries = append(e.queries, args[0].(string))
+	return []map[string][]byte{
+		{"data": []byte("xid1"), "gid": []byte("xid1")},
+	}, nil
+}
+
+func testCreateCoordinator(t *testing.T) (*Coordinator, *FileTxLog, func()) {
+	dir, err := ioutil.TempDir("", "wizard-txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := NewFileTxLog(filepath.Join(dir, "tx.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCoordinator(log, "wizard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, log, func() {
+		log.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	c, log, cleanup := testCreateCoordinator(t)
+	defer cleanup()
+	d := &testDialect{}
+	c.SetDialect("sqlite3", d)
+	orm.SetCoordinator(c)
+	id := "two phase"
+
+	orm.SetTwoPhaseCommit(id, true)
+	assert.True(orm.IsTwoPhaseCommit(id))
+	s1, err := orm.Transaction(id, testUser{ID: 1})
+	assert.Nil(err)
+	s2, err := orm.Transaction(id, testUser{ID: 500})
+	assert.Nil(err)
+	s1.Insert(&testUser{ID: 4})
+	s2.Insert(&testUser{ID: 504})
+	assert.Len(d.started, 2)
+
+	// the session not created for the branch
+	orm.SetAutoTransaction(id, true)
+	s, _ := orm.NewMasterSession(testFoobar{})
+	err = orm.AutoTransaction(id, testFoobar{}, s)
+	assert.True(stderrors.Is(err, errors.ErrTwoPhaseSession))
+	s.Close()
+
+	err = orm.CommitAll(id)
+	assert.Nil(err)
+	assert.Len(d.prepared, 2)
+	assert.ElementsMatch(d.started, d.committed)
+	assert.EqualValues(4, countUserMaster(orm), "users count after commit")
+	assert.EqualValues(4, countUserMasterB(orm), "users count after commit")
+
+	pending, err := log.Pending()
+	assert.Nil(err)
+	assert.Empty(pending, "commit is done")
+	assert.Empty(c.active)
+	orm.CloseAll(id)
+
+	initTestDB()
+}
+
+func TestTwoPhaseCommitAbort(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	c, log, cleanup := testCreateCoordinator(t)
+	defer cleanup()
+	d := &testDialect{failPrepare: true}
+	c.SetDialect("sqlite3", d)
+	orm.SetCoordinator(c)
+	id := "two phase abort"
+
+	orm.SetTwoPhaseCommit(id, true)
+	s1, _ := orm.Transaction(id, testUser{ID: 1})
+	s2, _ := orm.Transaction(id, testUser{ID: 500})
+	s1.Insert(&testUser{ID: 4})
+	s2.Insert(&testUser{ID: 504})
+
+	err := orm.CommitAll(id)
+	assert.NotNil(err)
+	e, ok := err.(errors.MultiErr)
+	assert.True(ok)
+	assert.Equal(20008, e.Code)
+	assert.Equal(errors.NewErr(1, "prepare error"), e.NodeErrors()[0].Err)
+	assert.Contains([]interface{}{dbUser01Master, dbUser02Master}, e.NodeErrors()[0].Node)
+	assert.Len(d.prepared, 1)
+	assert.Len(d.rolledBack, 1, "prepared branch is rolled back")
+	assert.Empty(d.committed)
+	assert.EqualValues(3, countUserMaster(orm), "users count after abort")
+	assert.EqualValues(3, countUserMasterB(orm), "users count after abort")
+
+	pending, _ := log.Pending()
+	assert.Empty(pending, "commit decision is not saved")
+	assert.Empty(c.active)
+	orm.CloseAll(id)
+}
+
+func TestTwoPhaseCommitNoCoordinator(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	id := "two phase"
+
+	orm.SetTwoPhaseCommit(id, true)
+	_, err := orm.Transaction(id, testUser{ID: 1})
+	assert.Equal(errors.NewErrNoCoordinator(), err)
+	assert.Equal(errors.NewErrNoCoordinator(), orm.RecoverTransactions())
+
+	c, _, cleanup := testCreateCoordinator(t)
+	defer cleanup()
+	orm.SetCoordinator(c)
+	_, err = orm.Transaction(id, testUser{ID: 1})
+	assert.Equal(errors.NewErrTwoPhaseDriver("sqlite3"), err)
+	orm.CloseAll(id)
+}
+
+func TestCoordinatorRecover(t *testing.T) {
+	assert := assert.New(t)
+	c, log, cleanup := testCreateCoordinator(t)
+	defer cleanup()
+	d := &testDialect{}
+	c.SetDialect("sqlite3", d)
+
+	active := c.newGTID()
+	d.recovered = []string{"wizard-1-1.1", "wizard-1-1.2", "wizard-2-2.1", "other-3-3.1", active + ".1"}
+	assert.Nil(log.Commit("wizard-1-1"))
+	assert.Nil(log.Commit(active))
+
+	db := &testDriverEngine{driver: "sqlite3"}
+	err := c.Recover([]Engine{db})
+	assert.Nil(err)
+	assert.Equal([]string{"wizard-1-1.1", "wizard-1-1.2"}, d.committed, "decided branches are committed")
+	assert.Equal([]string{"wizard-2-2.1"}, d.rolledBack, "undecided branches are rolled back")
+
+	assert.Equal([]string{"other-3-3.1", active + ".1"}, d.recovered, "the branch of the other prefix is left")
+
+	pending, _ := log.Pending()
+	assert.Equal([]string{active}, pending, "active transaction is not resolved")
+
+	// the branches of the engine without the dialect are unknown
+	c.finish(active)
+	err = c.Recover([]Engine{db, &testDriverEngine{driver: "unknown"}})
+	assert.Nil(err)
+	assert.Equal([]string{"other-3-3.1"}, d.recovered)
+	pending, _ = log.Pending()
+	assert.Equal([]string{active}, pending, "the decision is kept while the branch may be prepared")
+
+	err = c.Recover([]Engine{db})
+	assert.Nil(err)
+	pending, _ = log.Pending()
+	assert.Empty(pending)
+}
+
+// testDriverEngine is Engine of the driver
+type testDriverEngine struct {
+	Engine
+	driver string
+}
+
+func (e *testDriverEngine) DriverName() string { return e.driver }
+
+func TestNewCoordinator(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewCoordinator(nil, "")
+	assert.Equal(errors.NewErrGTIDPrefix(), err)
+
+	c, err := NewCoordinator(nil, "app")
+	assert.Nil(err)
+	gtid := c.newGTID()
+	parsed, ok := c.parseXID(gtid + ".1")
+	assert.True(ok)
+	assert.Equal(gtid, parsed)
+
+	other, _ := NewCoordinator(nil, "app-2")
+	_, ok = c.parseXID(other.newGTID() + ".1")
+	assert.False(ok, "the branch of the other prefix is not matched")
+	_, ok = c.parseXID("app-1-1")
+	assert.False(ok)
+	_, ok = c.parseXID("app-x-1.1")
+	assert.False(ok)
+}
+
+func TestMySQLDialect(t *testing.T) {
+	assert := assert.New(t)
+	d := MySQLDialect{}
+	e := &testExecer{}
+
+	d.Start(e, "xid1")
+	d.Prepare(e, "xid1")
+	d.Commit(e, "xid1")
+	d.Rollback(e, "xid'2")
+	xids, err := d.Recover(e)
+	assert.Nil(err)
+	assert.Equal([]string{"xid1"}, xids)
+	assert.Equal([]string{
+		"XA START 'xid1'",
+		"XA END 'xid1'",
+		"XA PREPARE 'xid1'",
+		"XA COMMIT 'xid1'",
+		"XA ROLLBACK 'xid''2'",
+		"XA RECOVER",
+	}, e.queries)
+}
+
+func TestPostgresDialect(t *testing.T) {
+	assert := assert.New(t)
+	d := PostgresDialect{}
+	e := &testExecer{}
+
+	d.Start(e, "xid1")
+	d.Prepare(e, "xid1")
+	d.Abort(e, "xid1")
+	d.Commit(e, "xid1")
+	d.Rollback(e, "xid1")
+	xids, err := d.Recover(e)
+	assert.Nil(err)
+	assert.Equal([]string{"xid1"}, xids)
+	assert.Equal([]string{
+		"BEGIN",
+		"PREPARE TRANSACTION 'xid1'",
+		"ROLLBACK",
+		"COMMIT PREPARED 'xid1'",
+		"ROLLBACK PREPARED 'xid1'",
+		"SELECT gid FROM pg_prepared_xacts WHERE database = current_database()",
+	}, e.queries)
+}
@@ -0,0 +1,194 @@
+package xorm
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TxLog is the durable log of the two-phase commit coordinator
+type TxLog interface {
+	Commit(gtid string) error   // saves the commit decision before committing the prepared branches
+	Done(gtid string) error     // saves all of the branches are committed
+	Pending() ([]string, error) // returns the global transactions decided to commit but not done
+}
+
+const (
+	txLogCommit = "commit"
+	txLogDone   = "done"
+)
+
+// FileTxLog is TxLog saved in the local file
+// every record is synced to the disk before returning.
+type FileTxLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileTxLog opens the log file, the file is created when it does not exist
+func NewFileTxLog(path string) (*FileTxLog, error) {
+	f, err := openTxLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTxLog{
+		path: path,
+		file: f,
+	}, nil
+}
+
+// openTxLogFile opens the log file for appending
+// the broken last record by a crash is terminated not to be joined with the next record.
+func openTxLogFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	switch {
+	case err != nil:
+		f.Close()
+		return nil, err
+	case stat.Size() == 0:
+		return f, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, stat.Size()-1); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last[0] != '\n' {
+		if _, err := f.WriteString("\n"); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Commit saves the commit decision
+func (l *FileTxLog) Commit(gtid string) error {
+	return l.write(txLogCommit, gtid)
+}
+
+// Done saves the global transaction is completed
+func (l *FileTxLog) Done(gtid string) error {
+	return l.write(txLogDone, gtid)
+}
+
+func (l *FileTxLog) write(kind, gtid string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.file.WriteString(kind + " " + gtid + "\n")
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Pending returns the global transactions decided to commit but not done
+func (l *FileTxLog) Pending() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pending()
+}
+
+func (l *FileTxLog) pending() ([]string, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []string
+	done := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			// the last record is broken by a crash while writing
+			continue
+		}
+		switch fields[0] {
+		case txLogCommit:
+			list = append(list, fields[1])
+		case txLogDone:
+			done[fields[1]] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, gtid := range list {
+		if !done[gtid] {
+			result = append(result, gtid)
+		}
+	}
+	return result, nil
+}
+
+// Compact removes the completed records from the log file
+func (l *FileTxLog) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list, err := l.pending()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.OpenFile(l.path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, gtid := range list {
+		w.WriteString(txLogCommit + " " + gtid + "\n")
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(l.path))
+
+	f, err := openTxLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = f
+	return nil
+}
+
+// Close closes the log file
+func (l *FileTxLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// syncDir saves the renamed file entry into the disk
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,59 @@
+package xorm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTxLog(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "wizard-txlog")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tx.log")
+
+	log, err := NewFileTxLog(path)
+	assert.Nil(err)
+	assert.Nil(log.Commit("gtid1"))
+	assert.Nil(log.Commit("gtid2"))
+	assert.Nil(log.Done("gtid1"))
+
+	pending, err := log.Pending()
+	assert.Nil(err)
+	assert.Equal([]string{"gtid2"}, pending)
+	assert.Nil(log.Close())
+
+	// reopen
+	log, err = NewFileTxLog(path)
+	assert.Nil(err)
+	pending, _ = log.Pending()
+	assert.Equal([]string{"gtid2"}, pending)
+
+	// broken record
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("commit")
+	f.Close()
+	pending, err = log.Pending()
+	assert.Nil(err)
+	assert.Equal([]string{"gtid2"}, pending)
+	assert.Nil(log.Close())
+	log, err = NewFileTxLog(path)
+	assert.Nil(err)
+	defer log.Close()
+	assert.Nil(log.Commit("gtid3"))
+	assert.Nil(log.Done("gtid3"))
+	pending, _ = log.Pending()
+	assert.Equal([]string{"gtid2"}, pending, "broken record is not joined")
+
+	assert.Nil(log.Compact())
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal("commit gtid2\n", string(data))
+
+	assert.Nil(log.Done("gtid2"))
+	pending, _ = log.Pending()
+	assert.Empty(pending)
+}
@@ -1,6 +1,11 @@
 package xorm
 
-import "github.com/evalphobia/wizard"
+import (
+	"time"
+
+	"github.com/evalphobia/wizard"
+	"github.com/evalphobia/wizard/errors"
+)
 
 // Xorm manages database sessions for xorm
 type Xorm struct {
@@ -10,6 +15,8 @@ type Xorm struct {
 	*XormParallel
 
 	Wiz *wizard.Wizard
+
+	retryPolicy *RetryPolicy
 }
 
 // New creates initialized *Xorm
@@ -25,3 +32,44 @@ func New(wiz *wizard.Wizard) *Xorm {
 	orm.XormParallel = &XormParallel{orm: orm}
 	return orm
 }
+
+// Reload replaces the clusters with the ones of the given Wizard at runtime
+// the engines removed from the clusters are closed after all of the sessions using them are closed.
+// when the timeout passes, the remaining engines are closed forcibly and ErrDrainTimeout is returned.
+// zero timeout means to wait without limit.
+func (orm *Xorm) Reload(next *wizard.Wizard, timeout time.Duration) error {
+	var engines []Engine
+	for _, node := range orm.Wiz.Reload(next) {
+		e, ok := node.DB().(Engine)
+		if !ok || e == nil {
+			continue
+		}
+		engines = append(engines, e)
+	}
+	return orm.XormSessionManager.drain(engines, timeout)
+}
+
+// SetRetryPolicy sets the policy to retry the write and the transaction failed by the transient error
+// nil policy disables the retry.
+func (orm *Xorm) SetRetryPolicy(p *RetryPolicy) {
+	orm.retryPolicy = p
+}
+
+// RecoverTransactions resolves the in-doubt branches of two-phase commit on all of the masters
+// call it on startup before using the transactions.
+func (orm *Xorm) RecoverTransactions() error {
+	c := orm.XormSessionManager.coordinator
+	if c == nil {
+		return errors.NewErrNoCoordinator()
+	}
+
+	var engines []Engine
+	for _, node := range orm.Wiz.Masters() {
+		e, ok := node.DB().(Engine)
+		if !ok || e == nil {
+			continue
+		}
+		engines = append(engines, e)
+	}
+	return c.Recover(engines)
+}
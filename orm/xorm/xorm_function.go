@@ -1,7 +1,7 @@
 package xorm
 
 import (
-	"github.com/evalphobia/wizard/errors"
+	"context"
 )
 
 // XormFunction manages xorm functions
@@ -11,60 +11,186 @@ type XormFunction struct {
 
 // Get executes xorm.Sessions.Get() in slave db
 func (xfn XormFunction) Get(obj interface{}, fn func(Session) (bool, error)) (bool, error) {
-	db := xfn.orm.Slave(obj)
-	if db == nil {
-		return false, errors.NewErrNilDB(NormalizeValue(obj))
+	return xfn.GetContext(context.Background(), obj, fn)
+}
+
+// GetContext executes xorm.Sessions.Get() in slave db with the context
+func (xfn XormFunction) GetContext(ctx context.Context, obj interface{}, fn func(Session) (bool, error)) (bool, error) {
+	s, err := xfn.slaveSession(ctx, obj)
+	if err != nil {
+		return false, err
 	}
-	return fn(db.NewSession())
+	defer s.Close()
+	return fn(s)
 }
 
 // Find executes xorm.Sessions.Find() in slave db
 func (xfn XormFunction) Find(obj interface{}, fn func(Session) error) error {
-	db := xfn.orm.Slave(obj)
-	if db == nil {
-		return errors.NewErrNilDB(NormalizeValue(obj))
+	return xfn.FindContext(context.Background(), obj, fn)
+}
+
+// FindContext executes xorm.Sessions.Find() in slave db with the context
+func (xfn XormFunction) FindContext(ctx context.Context, obj interface{}, fn func(Session) error) error {
+	s, err := xfn.slaveSession(ctx, obj)
+	if err != nil {
+		return err
 	}
-	return fn(db.NewSession())
+	defer s.Close()
+	return fn(s)
 }
 
 // Count executes xorm.Sessions.Count() in slave db
 func (xfn XormFunction) Count(obj interface{}, fn func(Session) (int64, error)) (int64, error) {
-	db := xfn.orm.Slave(obj)
+	return xfn.CountContext(context.Background(), obj, fn)
+}
+
+// CountContext executes xorm.Sessions.Count() in slave db with the context
+func (xfn XormFunction) CountContext(ctx context.Context, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	s, err := xfn.slaveSession(ctx, obj)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// slaveSession returns new session of the slave db with the context
+// the session must be closed after the query to release the slave node.
+func (xfn XormFunction) slaveSession(ctx context.Context, obj interface{}) (Session, error) {
+	defer xfn.orm.usage.pin()()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db, node := xfn.orm.slaveNode(obj)
 	if db == nil {
-		return 0, errors.NewErrNilDB(NormalizeValue(obj))
+		return nil, xfn.orm.nilDBErr(obj)
 	}
-	return fn(db.NewSession())
+	return withContext(ctx, xfn.orm.openSession(db, node)), nil
 }
 
 // Insert executes xorm.Sessions.Insert() in master db
+// while the shard is migrating, it's also executed in the new master db (best-effort without transaction)
 func (xfn XormFunction) Insert(id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	return xfn.write(context.Background(), id, obj, fn)
+}
+
+// InsertContext executes xorm.Sessions.Insert() in master db with the context
+func (xfn XormFunction) InsertContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	return xfn.write(ctx, id, obj, fn)
+}
+
+// Update executes xorm.Sessions.Update() in master db
+// while the shard is migrating, it's also executed in the new master db (best-effort without transaction)
+func (xfn XormFunction) Update(id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	return xfn.write(context.Background(), id, obj, fn)
+}
+
+// UpdateContext executes xorm.Sessions.Update() in master db with the context
+func (xfn XormFunction) UpdateContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	return xfn.write(ctx, id, obj, fn)
+}
+
+// InsertWithCompensation executes xorm.Insert() and registers the compensation to undo it
+// the compensation is run when CommitAll() partially fails after the db is committed.
+func (xfn XormFunction) InsertWithCompensation(id Identifier, obj interface{}, fn func(Session) (int64, error), compensation func(Session) error) (int64, error) {
+	return xfn.writeWithCompensation(context.Background(), id, obj, fn, compensation)
+}
+
+// InsertWithCompensationContext executes xorm.Insert() with the context and registers the compensation to undo it
+func (xfn XormFunction) InsertWithCompensationContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error), compensation func(Session) error) (int64, error) {
+	return xfn.writeWithCompensation(ctx, id, obj, fn, compensation)
+}
+
+// UpdateWithCompensation executes xorm.Update() and registers the compensation to undo it
+// the compensation is run when CommitAll() partially fails after the db is committed.
+func (xfn XormFunction) UpdateWithCompensation(id Identifier, obj interface{}, fn func(Session) (int64, error), compensation func(Session) error) (int64, error) {
+	return xfn.writeWithCompensation(context.Background(), id, obj, fn, compensation)
+}
+
+// UpdateWithCompensationContext executes xorm.Update() with the context and registers the compensation to undo it
+func (xfn XormFunction) UpdateWithCompensationContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error), compensation func(Session) error) (int64, error) {
+	return xfn.writeWithCompensation(ctx, id, obj, fn, compensation)
+}
+
+// writeWithCompensation executes write query and registers the compensation for the master db
+// the writes into the migration targets are not compensated.
+func (xfn XormFunction) writeWithCompensation(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error), compensation func(Session) error) (int64, error) {
+	defer xfn.orm.MarkInUse(id)()
 	if xfn.orm.IsReadOnly(id) {
 		return 0, nil
 	}
 
-	s, err := xfn.orm.UseMasterSession(id, obj)
+	affected, err := xfn.write(ctx, id, obj, fn)
 	if err != nil {
-		return 0, err
+		return affected, err
 	}
-	return fn(s)
+	return affected, xfn.orm.Compensate(id, obj, compensation)
 }
 
-// Update executes xorm.Sessions.Update() in master db
-func (xfn XormFunction) Update(id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+// write executes the writing function in master db and migration destinations
+// the result of the current master db is returned.
+// without transaction, the write to the migration destinations is best-effort,
+// the write to the current master db is not rolled back when it fails.
+func (xfn XormFunction) write(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	defer xfn.orm.MarkInUse(id)()
 	if xfn.orm.IsReadOnly(id) {
 		return 0, nil
 	}
 
-	s, err := xfn.orm.UseMasterSession(id, obj)
+	unpin := xfn.orm.usage.pin()
+	db := xfn.orm.Master(obj)
+	s, err := xfn.orm.masterSession(ctx, id, obj, db)
+	unpin()
 	if err != nil {
 		return 0, err
 	}
-	return fn(s)
+	affected, err := xfn.exec(ctx, id, s, fn)
+	if err != nil {
+		return affected, err
+	}
+	xfn.orm.markDirty(xfn.orm.getOrCreateSessionList(id), db)
+
+	unpin = xfn.orm.usage.pin()
+	sessions, err := xfn.orm.migrationSessions(ctx, id, obj, xfn.orm.MigrationMasters(obj))
+	unpin()
+	if err != nil {
+		return affected, err
+	}
+	for _, s := range sessions {
+		_, err = xfn.exec(ctx, id, s, fn)
+		if err != nil {
+			return affected, err
+		}
+	}
+	return affected, nil
+}
+
+// exec executes the writing function and retries it by the retry policy
+// the function in the transaction is not retried, because the transaction is aborted by the error.
+// use RunInTransaction() to retry the whole transaction.
+func (xfn XormFunction) exec(ctx context.Context, id Identifier, s Session, fn func(Session) (int64, error)) (int64, error) {
+	if xfn.orm.inTransaction(id) {
+		return fn(s)
+	}
+
+	var affected int64
+	err := xfn.orm.retryPolicy.do(ctx, func() error {
+		var err error
+		affected, err = fn(s)
+		return err
+	})
+	return affected, err
 }
 
 // GetUsingMaster executes xorm.Sessions.Get() in master db
 func (xfn XormFunction) GetUsingMaster(id Identifier, obj interface{}, fn func(Session) (bool, error)) (bool, error) {
-	s, err := xfn.orm.UseMasterSession(id, obj)
+	return xfn.GetUsingMasterContext(context.Background(), id, obj, fn)
+}
+
+// GetUsingMasterContext executes xorm.Sessions.Get() in master db with the context
+func (xfn XormFunction) GetUsingMasterContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (bool, error)) (bool, error) {
+	defer xfn.orm.MarkInUse(id)()
+	s, err := xfn.orm.UseMasterSessionContext(ctx, id, obj)
 	if err != nil {
 		return false, err
 	}
@@ -73,7 +199,13 @@ func (xfn XormFunction) GetUsingMaster(id Identifier, obj interface{}, fn func(S
 
 // FindUsingMaster executes xorm.Sessions.Find() in master db
 func (xfn XormFunction) FindUsingMaster(id Identifier, obj interface{}, fn func(Session) error) error {
-	s, err := xfn.orm.UseMasterSession(id, obj)
+	return xfn.FindUsingMasterContext(context.Background(), id, obj, fn)
+}
+
+// FindUsingMasterContext executes xorm.Sessions.Find() in master db with the context
+func (xfn XormFunction) FindUsingMasterContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) error) error {
+	defer xfn.orm.MarkInUse(id)()
+	s, err := xfn.orm.UseMasterSessionContext(ctx, id, obj)
 	if err != nil {
 		return err
 	}
@@ -82,7 +214,58 @@ func (xfn XormFunction) FindUsingMaster(id Identifier, obj interface{}, fn func(
 
 // CountUsingMaster executes xorm.Sessions.Count() in master db
 func (xfn XormFunction) CountUsingMaster(id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
-	s, err := xfn.orm.UseMasterSession(id, obj)
+	return xfn.CountUsingMasterContext(context.Background(), id, obj, fn)
+}
+
+// CountUsingMasterContext executes xorm.Sessions.Count() in master db with the context
+func (xfn XormFunction) CountUsingMasterContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	defer xfn.orm.MarkInUse(id)()
+	s, err := xfn.orm.UseMasterSessionContext(ctx, id, obj)
+	if err != nil {
+		return 0, err
+	}
+	return fn(s)
+}
+
+// GetUsingSlave executes xorm.Sessions.Get() in slave db with the session of the identifier
+func (xfn XormFunction) GetUsingSlave(id Identifier, obj interface{}, fn func(Session) (bool, error)) (bool, error) {
+	return xfn.GetUsingSlaveContext(context.Background(), id, obj, fn)
+}
+
+// GetUsingSlaveContext executes xorm.Sessions.Get() in slave db with the session of the identifier and the context
+func (xfn XormFunction) GetUsingSlaveContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (bool, error)) (bool, error) {
+	defer xfn.orm.MarkInUse(id)()
+	s, err := xfn.orm.UseSlaveSessionContext(ctx, id, obj)
+	if err != nil {
+		return false, err
+	}
+	return fn(s)
+}
+
+// FindUsingSlave executes xorm.Sessions.Find() in slave db with the session of the identifier
+func (xfn XormFunction) FindUsingSlave(id Identifier, obj interface{}, fn func(Session) error) error {
+	return xfn.FindUsingSlaveContext(context.Background(), id, obj, fn)
+}
+
+// FindUsingSlaveContext executes xorm.Sessions.Find() in slave db with the session of the identifier and the context
+func (xfn XormFunction) FindUsingSlaveContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) error) error {
+	defer xfn.orm.MarkInUse(id)()
+	s, err := xfn.orm.UseSlaveSessionContext(ctx, id, obj)
+	if err != nil {
+		return err
+	}
+	return fn(s)
+}
+
+// CountUsingSlave executes xorm.Sessions.Count() in slave db with the session of the identifier
+func (xfn XormFunction) CountUsingSlave(id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	return xfn.CountUsingSlaveContext(context.Background(), id, obj, fn)
+}
+
+// CountUsingSlaveContext executes xorm.Sessions.Count() in slave db with the session of the identifier and the context
+func (xfn XormFunction) CountUsingSlaveContext(ctx context.Context, id Identifier, obj interface{}, fn func(Session) (int64, error)) (int64, error) {
+	defer xfn.orm.MarkInUse(id)()
+	s, err := xfn.orm.UseSlaveSessionContext(ctx, id, obj)
 	if err != nil {
 		return 0, err
 	}
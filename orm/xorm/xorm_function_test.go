@@ -1,8 +1,12 @@
 package xorm
 
 import (
+	"context"
+	"database/sql/driver"
 	"testing"
+	"time"
 
+	"github.com/evalphobia/wizard"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -105,6 +109,43 @@ func TestFind(t *testing.T) {
 	assert.Len(companies, 1)
 }
 
+func TestSlaveInFlight(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	cluster := wiz.Select(testUser{ID: 1})
+	cluster.SetBalancer(wizard.NewLeastInFlightBalancer())
+	inFlight := func() int64 {
+		var n int64
+		for _, node := range cluster.Nodes() {
+			n += node.InFlight()
+		}
+		return n
+	}
+
+	err := orm.Find(testUser{ID: 1}, func(s Session) error {
+		assert.EqualValues(1, inFlight())
+		var users []*testUser
+		return s.Find(&users)
+	})
+	assert.Nil(err)
+	assert.EqualValues(0, inFlight(), "the node is released after the query")
+
+	// the session of the identifier is released by CloseAll()
+	_, err = orm.UseSlaveSession(testID, testUser{ID: 1})
+	assert.Nil(err)
+	assert.EqualValues(1, inFlight())
+	orm.CloseAll(testID)
+	assert.EqualValues(0, inFlight())
+
+	// parallel query
+	var users []testUser
+	err = orm.FindParallelByCondition(&users, NewFindCondition(testUser{}))
+	assert.Nil(err)
+	assert.EqualValues(0, inFlight())
+}
+
 func TestCount(t *testing.T) {
 	assert := assert.New(t)
 	wiz := testCreateWizard()
@@ -248,6 +289,106 @@ func TestInsert(t *testing.T) {
 	initTestDB()
 }
 
+func TestInsertWithMigration(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := wizard.NewWizard()
+	userShards := wiz.CreateShardCluster(testUser{}, 997)
+	shard01 := wizard.NewCluster(dbUser01Master)
+	shard02 := wizard.NewCluster(dbUser02Master)
+	userShards.RegisterShard(0, 499, shard01)
+	userShards.RegisterShard(500, 996, shard02)
+	orm := New(wiz)
+
+	var row = &testUser{ID: 4, Name: "Daniel"}
+	fn := func(s Session) (int64, error) {
+		return s.Insert(row)
+	}
+
+	err := userShards.StartMigration(0, 99, shard02)
+	assert.Nil(err)
+	assert.Len(orm.MigrationMasters(row), 1)
+
+	affected, err := orm.Insert(testID, row, fn)
+	assert.Nil(err)
+	assert.EqualValues(1, affected)
+	assert.EqualValues(4, countUserMaster(orm), "inserted into the current shard")
+	assert.EqualValues(4, countUserMasterB(orm), "inserted into the new shard")
+
+	// session and transaction
+	row2 := &testUser{ID: 5, Name: "Emily"}
+	tx, err := orm.TransactionByKey(testID, row2, 5)
+	assert.Nil(err)
+	_, err = tx.Insert(row2)
+	assert.Nil(err)
+	sessions, err := orm.UseMigrationMasterSessionsByKey(testID, row2, 5)
+	assert.Nil(err)
+	assert.Len(sessions, 1)
+	_, err = sessions[0].Insert(row2)
+	assert.Nil(err)
+	err = orm.CommitAll(testID)
+	assert.Nil(err)
+	orm.CloseAll(testID)
+	assert.EqualValues(5, countUserMaster(orm), "inserted into the current shard")
+	assert.EqualValues(5, countUserMasterB(orm), "inserted into the new shard with the transaction")
+
+	// parallel update
+	affected, err = orm.UpdateParallelByCondition(&testUser{Name: "Frank"}, UpdateCondition{
+		Table: testUser{},
+		Where: []Where{{Statement: "id = ?", Args: []interface{}{5}}},
+	})
+	assert.Nil(err)
+	assert.EqualValues(2, affected, "the new shard is updated once as one of the current shards")
+	var updated testUser
+	orm.GetUsingMaster(testID, &testUser{ID: 500}, func(s Session) (bool, error) {
+		return s.Where("id = ?", 5).Get(&updated)
+	})
+	assert.Equal("Frank", updated.Name, "updated in the new shard")
+	orm.CloseAll(testID)
+
+	err = userShards.CompleteMigration(0, 99)
+	assert.Nil(err)
+	assert.Len(orm.MigrationMasters(row), 0)
+	assert.Equal(dbUser02Master, orm.Master(row), "slots are moved to the new shard")
+
+	initTestDB()
+}
+
+func TestInsertRetry(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	p := NewRetryPolicy(3)
+	p.SetBackoff(time.Millisecond, time.Millisecond)
+	orm.SetRetryPolicy(p)
+
+	count := 0
+	fn := func(s Session) (int64, error) {
+		count++
+		if count < 3 {
+			return 0, driver.ErrBadConn
+		}
+		return s.Insert(&testUser{ID: 4})
+	}
+	affected, err := orm.Insert(testID, testUser{ID: 1}, fn)
+	assert.Nil(err)
+	assert.EqualValues(1, affected)
+	assert.Equal(3, count)
+	assert.EqualValues(4, countUserMaster(orm))
+
+	// not retried in the transaction
+	id := "retry in transaction"
+	orm.SetAutoTransaction(id, true)
+	count = 0
+	_, err = orm.Insert(id, testUser{ID: 1}, fn)
+	assert.Equal(driver.ErrBadConn, err)
+	assert.Equal(1, count)
+	orm.RollbackAll(id)
+	orm.CloseAll(id)
+
+	initTestDB()
+}
+
 func TestUpdate(t *testing.T) {
 	assert := assert.New(t)
 	wiz := testCreateWizard()
@@ -436,6 +577,80 @@ func TestCountUsingMaster(t *testing.T) {
 	s.Rollback()
 }
 
+func TestGetUsingSlave(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	var row interface{}
+	var has bool
+	var err error
+	fn := func(s Session) (bool, error) {
+		return s.Get(row)
+	}
+
+	orm.SetAutoTransaction(testID, true)
+	orm.SetReadYourWrites(testID, true)
+
+	row = &testUser{ID: 1}
+	has, err = orm.GetUsingSlave(testID, row, fn)
+	assert.Nil(err)
+	assert.True(has)
+
+	row = &testUser{ID: 4}
+	orm.Insert(testID, row, func(s Session) (int64, error) {
+		return s.Insert(row)
+	})
+
+	// slave
+	has, err = orm.Get(row, fn)
+	assert.Nil(err)
+	assert.False(has)
+
+	// master after writing
+	has, err = orm.GetUsingSlave(testID, row, fn)
+	assert.Nil(err)
+	assert.True(has)
+
+	orm.RollbackAll(testID)
+	orm.CloseAll(testID)
+}
+
+func TestFindUsingSlave(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	var foobars []testFoobar
+	var err error
+	fn := func(s Session) error {
+		return s.Find(&foobars)
+	}
+
+	err = orm.FindUsingSlave(testID, testFoobar{}, fn)
+	assert.Nil(err)
+	assert.Len(foobars, 3)
+	orm.CloseAll(testID)
+}
+
+func TestCountUsingSlave(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	var foobar = testFoobar{}
+	var count int64
+	var err error
+	fn := func(s Session) (int64, error) {
+		return s.Count(&foobar)
+	}
+
+	count, err = orm.CountUsingSlave(testID, foobar, fn)
+	assert.Nil(err)
+	assert.EqualValues(3, count)
+	orm.CloseAll(testID)
+}
+
 func TestFunctionNilDB(t *testing.T) {
 	assert := assert.New(t)
 	orm := New(emptyWiz)
@@ -477,6 +692,20 @@ func TestFunctionNilDB(t *testing.T) {
 	assert.NotNil(err)
 	assert.EqualValues(0, count)
 
+	// GetUsingSlave
+	has, err = orm.GetUsingSlave(testID, testFoobar{}, fnGet)
+	assert.NotNil(err)
+	assert.False(has)
+
+	// FindUsingSlave
+	err = orm.FindUsingSlave(testID, testFoobar{}, fnFind)
+	assert.NotNil(err)
+
+	// CountUsingSlave
+	count, err = orm.CountUsingSlave(testID, testFoobar{}, fnCount)
+	assert.NotNil(err)
+	assert.EqualValues(0, count)
+
 	// Insert
 	affected, err = orm.Insert(testID, testFoobar{}, fnCount)
 	assert.NotNil(err)
@@ -487,3 +716,58 @@ func TestFunctionNilDB(t *testing.T) {
 	assert.NotNil(err)
 	assert.EqualValues(0, affected)
 }
+
+func TestFunctionContext(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	row := &testUser{ID: 1}
+	has, err := orm.GetContext(ctx, row, func(s Session) (bool, error) {
+		return s.Get(row)
+	})
+	assert.Nil(err)
+	assert.True(has)
+	assert.Equal("Adam", row.Name)
+
+	var list []testUser
+	err = orm.FindContext(ctx, testUser{ID: 1}, func(s Session) error {
+		return s.Find(&list)
+	})
+	assert.Nil(err)
+	assert.Len(list, 3)
+
+	count, err := orm.CountUsingMasterContext(ctx, testID, testUser{ID: 1}, func(s Session) (int64, error) {
+		return s.Count(testUser{})
+	})
+	assert.Nil(err)
+	assert.EqualValues(3, count)
+	orm.CloseAll(testID)
+
+	// cancelled
+	cancel()
+	called := false
+	_, err = orm.GetContext(ctx, row, func(s Session) (bool, error) {
+		called = true
+		return s.Get(row)
+	})
+	assert.Equal(context.Canceled, err)
+	assert.False(called, "query is not executed after cancel")
+
+	_, err = orm.InsertContext(ctx, testID, testUser{ID: 4}, func(s Session) (int64, error) {
+		called = true
+		return s.Insert(&testUser{ID: 4})
+	})
+	assert.Equal(context.Canceled, err)
+	assert.False(called, "query is not executed after cancel")
+	assert.EqualValues(3, countUserMaster(orm))
+
+	err = orm.FindUsingSlaveContext(ctx, testID, testUser{ID: 1}, func(s Session) error {
+		called = true
+		return s.Find(&list)
+	})
+	assert.Equal(context.Canceled, err)
+	assert.False(called)
+	orm.CloseAll(testID)
+}
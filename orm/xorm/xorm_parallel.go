@@ -1,8 +1,11 @@
 package xorm
 
 import (
+	"context"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/evalphobia/wizard/errors"
 )
@@ -10,103 +13,321 @@ import (
 // XormParallel supports concurrent query
 type XormParallel struct {
 	orm *Xorm
+
+	concurrency    int
+	shardTimeout   time.Duration
+	timeout        time.Duration
+	partialResults bool
+}
+
+// SetParallelConcurrency sets the maximum number of the shards queried at the same time
+// the query timed out keeps its slot until it returns, so the limit also counts the abandoned queries.
+// zero means no limit.
+func (xpr *XormParallel) SetParallelConcurrency(n int) {
+	xpr.concurrency = n
+}
+
+// SetParallelShardTimeout sets the deadline of the query for each shard
+// zero means no deadline.
+func (xpr *XormParallel) SetParallelShardTimeout(d time.Duration) {
+	xpr.shardTimeout = d
+}
+
+// SetParallelTimeout sets the deadline of the parallel query for all of the shards
+// zero means no deadline.
+func (xpr *XormParallel) SetParallelTimeout(d time.Duration) {
+	xpr.timeout = d
+}
+
+// SetPartialResults sets the partial results mode of the SELECT query
+// when some of the shards are timed out, the results of the other shards are returned with errors.ErrPartialResult.
+func (xpr *XormParallel) SetPartialResults(b bool) {
+	xpr.partialResults = b
+}
+
+// shardSession is the session for the shard
+type shardSession struct {
+	Session
+	shard int
+	db    Engine
+}
+
+// err returns the error with the shard
+func (s shardSession) err(err error) error {
+	return errors.NewNodeErr(s.shard, s.db, err)
+}
+
+// sessionsOf returns the sessions of the shards
+func sessionsOf(list []shardSession) []Session {
+	sessions := make([]Session, len(list))
+	for i, s := range list {
+		sessions[i] = s.Session
+	}
+	return sessions
+}
+
+// execute runs the query on all of the shards with the concurrency limit and the deadlines
+// the results are in the same order of the sessions, and all of the sessions are closed.
+// when the context of the caller is done, the error of the context is returned.
+func (xpr *XormParallel) execute(ctx context.Context, sessions []shardSession, fn func(Session, *ShardResult) error) (ParallelResult, error) {
+	queryCtx := ctx
+	if xpr.timeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, xpr.timeout)
+		defer cancel()
+	}
+
+	// the slot is released when the query returns, not when the deadline passes
+	var slots chan struct{}
+	if xpr.concurrency > 0 {
+		slots = make(chan struct{}, xpr.concurrency)
+	}
+
+	// each goroutine writes the result of its own shard only
+	results := make([]ShardResult, len(sessions))
+	var wg sync.WaitGroup
+	wg.Add(len(sessions))
+	for i := range sessions {
+		go func(i int) {
+			defer wg.Done()
+			results[i] = xpr.executeShard(queryCtx, sessions[i], slots, fn)
+		}(i)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return ParallelResult{}, err
+	}
+	return ParallelResult{Shards: results}, nil
+}
+
+// executeShard runs the query on the shard with the per-shard deadline
+// the query which does not support the context keeps running after the deadline,
+// and the session is closed and the slot is released after it.
+func (xpr *XormParallel) executeShard(ctx context.Context, s shardSession, slots chan struct{}, fn func(Session, *ShardResult) error) ShardResult {
+	timeout := func(err error) ShardResult {
+		return ShardResult{
+			Shard:    s.shard,
+			DB:       s.db,
+			Err:      s.err(err),
+			TimedOut: err == context.DeadlineExceeded,
+		}
+	}
+	release := func() {}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			release = func() { <-slots }
+		case <-ctx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		s.Close()
+		release()
+		return timeout(err)
+	}
+	if xpr.shardTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, xpr.shardTimeout)
+		defer cancel()
+	}
+
+	done := make(chan ShardResult, 1)
+	go func() {
+		// the result is not shared until it's sent, because the query may outlive the deadline
+		r := ShardResult{Shard: s.shard, DB: s.db}
+		err := fn(withContext(ctx, s.Session), &r)
+		s.Close()
+		release()
+		if err != nil {
+			r.Err = s.err(err)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		r.TimedOut = r.Err != nil && ctx.Err() == context.DeadlineExceeded
+		return r
+	case <-ctx.Done():
+		return timeout(ctx.Err())
+	}
+}
+
+// resultError returns the error of the results
+// when all of the errors are timeout in the partial results mode, errors.ErrPartialResult is returned.
+func (xpr *XormParallel) resultError(result ParallelResult, partial bool) error {
+	var errList []error
+	timedOut := true
+	for _, r := range result.Shards {
+		if r.Err == nil {
+			continue
+		}
+		errList = append(errList, r.Err)
+		timedOut = timedOut && r.TimedOut
+	}
+
+	switch {
+	case len(errList) == 0:
+		return nil
+	case partial && timedOut:
+		return errors.NewErrPartialResult(errList)
+	}
+	return errors.NewErrParallelQuery(errList)
 }
 
 // FindParallel executes SELECT query to all of the shards
 func (xpr *XormParallel) FindParallel(listPtr interface{}, table interface{}, where string, args ...interface{}) error {
+	return xpr.FindParallelContext(context.Background(), listPtr, table, where, args...)
+}
+
+// FindParallelContext executes SELECT query to all of the shards with the context
+func (xpr *XormParallel) FindParallelContext(ctx context.Context, listPtr interface{}, table interface{}, where string, args ...interface{}) error {
 	cond := NewFindCondition(table)
 	cond.And(where, args...)
-	return xpr.FindParallelByCondition(listPtr, cond)
+	return xpr.FindParallelByConditionContext(ctx, listPtr, cond)
 }
 
 // FindParallelByCondition executes SELECT query to all of the shards with conditions
 func (xpr *XormParallel) FindParallelByCondition(listPtr interface{}, cond FindCondition) error {
+	return xpr.FindParallelByConditionContext(context.Background(), listPtr, cond)
+}
+
+// FindParallelByConditionContext executes SELECT query to all of the shards with conditions and the context
+// when the context is done, the queries in progress are aborted and the error of the context is returned
+// in the merge mode, the sorted results of the shards are merged and paginated by Limit and Offset.
+func (xpr *XormParallel) FindParallelByConditionContext(ctx context.Context, listPtr interface{}, cond FindCondition) error {
+	_, err := xpr.FindParallelResultByConditionContext(ctx, listPtr, cond)
+	return err
+}
+
+// FindParallelResultByCondition executes SELECT query to all of the shards with conditions
+// and returns the rows of each shard as well.
+func (xpr *XormParallel) FindParallelResultByCondition(listPtr interface{}, cond FindCondition) (ParallelResult, error) {
+	return xpr.FindParallelResultByConditionContext(context.Background(), listPtr, cond)
+}
+
+// FindParallelResultByConditionContext executes SELECT query to all of the shards with conditions and the context
+// and returns the rows of each shard as well.
+// the rows of the shards are set into listPtr in the same way of FindParallelByConditionContext.
+func (xpr *XormParallel) FindParallelResultByConditionContext(ctx context.Context, listPtr interface{}, cond FindCondition) (ParallelResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ParallelResult{}, err
+	}
 	vt := reflect.TypeOf(listPtr)
 	if vt.Kind() != reflect.Ptr {
-		return errors.NewErrArgType("listPtr must be a pointer")
+		return ParallelResult{}, errors.NewErrArgType("listPtr must be a pointer")
 	}
 	elem := vt.Elem()
 	if elem.Kind() != reflect.Slice && elem.Kind() != reflect.Map {
-		return errors.NewErrArgType("listPtr must be a pointer of slice or map")
+		return ParallelResult{}, errors.NewErrArgType("listPtr must be a pointer of slice or map")
 	}
 
-	// create session with the condition
-	sessions := xpr.CreateFindSessions(cond)
-	length := len(sessions)
+	var keys []sortKey
+	if cond.Merge {
+		if elem.Kind() != reflect.Slice {
+			return ParallelResult{}, errors.NewErrArgType("listPtr must be a pointer of slice for merging")
+		}
+		var err error
+		keys, err = newSortKeys(elem.Elem(), cond.OrderBy)
+		if err != nil {
+			return ParallelResult{}, err
+		}
+	}
 
 	// execute query
-	var errList []error
-	results := make(chan reflect.Value, length)
-	for _, s := range sessions {
+	result, err := xpr.execute(ctx, xpr.createFindSessions(cond), func(s Session, r *ShardResult) error {
 		list := reflect.New(elem)
-		go func(s Session, list reflect.Value) {
-			defer s.Close()
-			err := s.Find(list.Interface())
-			if err != nil {
-				errList = append(errList, err)
-			}
-			results <- list
-		}(s, list)
+		if err := s.Find(list.Interface()); err != nil {
+			return err
+		}
+		r.Rows = list.Elem().Interface()
+		r.Count = int64(list.Elem().Len())
+		return nil
+	})
+	if err != nil {
+		return result, err
 	}
 
-	// wait for the results
 	e := reflect.ValueOf(listPtr).Elem()
-	for i := 0; i < length; i++ {
-		v := <-results
-		e.Set(reflect.AppendSlice(e, v.Elem()))
-	}
-	if len(errList) > 0 {
-		return errors.NewErrParallelQuery(errList)
+	if !cond.Merge {
+		for _, r := range result.Shards {
+			if r.Rows != nil {
+				e.Set(reflect.AppendSlice(e, reflect.ValueOf(r.Rows)))
+			}
+		}
+		return result, xpr.resultError(result, xpr.partialResults)
 	}
 
-	return nil
+	lists := make([]reflect.Value, len(result.Shards))
+	for i, r := range result.Shards {
+		lists[i] = reflect.MakeSlice(elem, 0, 0)
+		if r.Rows != nil {
+			lists[i] = reflect.ValueOf(r.Rows)
+		}
+	}
+	e.Set(reflect.AppendSlice(e, mergeSorted(elem, lists, keys, cond.Offset, cond.Limit)))
+	return result, xpr.resultError(result, xpr.partialResults)
 }
 
 // CountParallelByCondition executes SELECT COUNT(*) query to all of the shards with conditions
+// the counts are in the order of the shard index.
 func (xpr *XormParallel) CountParallelByCondition(objPtr interface{}, cond FindCondition) ([]int64, error) {
-	vt := reflect.TypeOf(objPtr)
-	if vt.Kind() != reflect.Ptr {
-		return nil, errors.NewErrArgType("objPtr must be a pointer")
-	}
-
-	// create session with the condition
-	sessions := xpr.CreateFindSessions(cond)
-	length := len(sessions)
+	return xpr.CountParallelByConditionContext(context.Background(), objPtr, cond)
+}
 
-	// execute query
-	var errList []error
-	results := make(chan int64, length)
-	for _, s := range sessions {
-		go func(s Session) {
-			defer s.Close()
-			count, err := s.Count(objPtr)
-			if err != nil {
-				errList = append(errList, err)
-			}
-			results <- count
-		}(s)
+// CountParallelByConditionContext executes SELECT COUNT(*) query to all of the shards with conditions and the context
+// when the context is done, the queries in progress are aborted and the error of the context is returned
+func (xpr *XormParallel) CountParallelByConditionContext(ctx context.Context, objPtr interface{}, cond FindCondition) ([]int64, error) {
+	result, err := xpr.CountParallelResultByConditionContext(ctx, objPtr, cond)
+	if result.Shards == nil {
+		return nil, err
 	}
+	return result.Counts(), err
+}
+
+// CountParallelResultByCondition executes SELECT COUNT(*) query to all of the shards with conditions
+// and returns the count and the error of each shard.
+func (xpr *XormParallel) CountParallelResultByCondition(objPtr interface{}, cond FindCondition) (ParallelResult, error) {
+	return xpr.CountParallelResultByConditionContext(context.Background(), objPtr, cond)
+}
 
-	// wait for the results
-	var counts []int64
-	for i := 0; i < length; i++ {
-		v := <-results
-		counts = append(counts, v)
+// CountParallelResultByConditionContext executes SELECT COUNT(*) query to all of the shards with conditions and the context
+// and returns the count and the error of each shard.
+func (xpr *XormParallel) CountParallelResultByConditionContext(ctx context.Context, objPtr interface{}, cond FindCondition) (ParallelResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ParallelResult{}, err
 	}
-	if len(errList) > 0 {
-		return counts, errors.NewErrParallelQuery(errList)
+	vt := reflect.TypeOf(objPtr)
+	if vt.Kind() != reflect.Ptr {
+		return ParallelResult{}, errors.NewErrArgType("objPtr must be a pointer")
 	}
 
-	return counts, nil
+	// execute query
+	result, err := xpr.execute(ctx, xpr.createFindSessions(cond), func(s Session, r *ShardResult) error {
+		var err error
+		r.Count, err = s.Count(objPtr)
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, xpr.resultError(result, xpr.partialResults)
 }
 
 // CreateFindSessions creates new sessions with conditional clause
 func (xpr *XormParallel) CreateFindSessions(cond FindCondition) []Session {
-	var sessions []Session
-	slaves := xpr.orm.Slaves(cond.Table)
+	return sessionsOf(xpr.createFindSessions(cond))
+}
+
+// createFindSessions creates new sessions with conditional clause for each shard
+func (xpr *XormParallel) createFindSessions(cond FindCondition) []shardSession {
+	defer xpr.orm.usage.pin()()
+	var sessions []shardSession
+	slaves, nodes := xpr.orm.slaveNodes(cond.Table)
 
-	for _, slave := range slaves {
-		s := slave.NewSession()
+	for i, slave := range slaves {
+		s := xpr.orm.openSession(slave, nodes[i])
 		if len(cond.Columns) != 0 {
 			s.Cols(cond.Columns...)
 		}
@@ -133,53 +354,90 @@ func (xpr *XormParallel) CreateFindSessions(cond FindCondition) []Session {
 				s.Asc(o.Name)
 			}
 		}
-		if cond.Limit > 0 {
+		switch {
+		case cond.Merge && cond.Limit > 0:
+			// the rows in the global offset can be in any shard
+			s.Limit(cond.Limit+cond.Offset, 0)
+		case cond.Limit > 0:
 			s.Limit(cond.Limit, cond.Offset)
 		}
-		sessions = append(sessions, s)
+		sessions = append(sessions, shardSession{Session: s, shard: i, db: slave})
 	}
 	return sessions
 }
 
 // UpdateParallelByCondition executes UPDATE query to all of the shards with conditions
 func (xpr *XormParallel) UpdateParallelByCondition(objPtr interface{}, cond UpdateCondition) (int64, error) {
-	// create session with the condition
-	sessions := xpr.CreateUpdateSessions(cond)
-	length := len(sessions)
+	return xpr.UpdateParallelByConditionContext(context.Background(), objPtr, cond)
+}
 
-	// execute query
-	var errList []error
-	results := make(chan int64, length)
-	for _, s := range sessions {
-		go func(s Session, obj interface{}) {
-			defer s.Close()
-			count, err := s.Update(obj)
-			if err != nil {
-				errList = append(errList, err)
-			}
-			results <- count
-		}(s, objPtr)
+// UpdateParallelByConditionContext executes UPDATE query to all of the shards with conditions and the context
+// when the context is done, the queries in progress are aborted and the error of the context is returned
+func (xpr *XormParallel) UpdateParallelByConditionContext(ctx context.Context, objPtr interface{}, cond UpdateCondition) (int64, error) {
+	result, err := xpr.UpdateParallelResultByConditionContext(ctx, objPtr, cond)
+	return result.TotalCount(), err
+}
+
+// UpdateParallelResultByCondition executes UPDATE query to all of the shards with conditions
+// and returns the number of the updated rows and the error of each shard.
+func (xpr *XormParallel) UpdateParallelResultByCondition(objPtr interface{}, cond UpdateCondition) (ParallelResult, error) {
+	return xpr.UpdateParallelResultByConditionContext(context.Background(), objPtr, cond)
+}
+
+// UpdateParallelResultByConditionContext executes UPDATE query to all of the shards with conditions and the context
+// and returns the number of the updated rows and the error of each shard.
+func (xpr *XormParallel) UpdateParallelResultByConditionContext(ctx context.Context, objPtr interface{}, cond UpdateCondition) (ParallelResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ParallelResult{}, err
+	}
+
+	update := func(s Session, r *ShardResult) error {
+		var err error
+		r.Count, err = s.Update(objPtr)
+		return err
 	}
 
-	// wait for the results
-	var counts int64
-	for i := 0; i < length; i++ {
-		v := <-results
-		counts += v
+	// execute query
+	// the partial results mode is not used, because the updates in the timed out shards may be committed.
+	result, err := xpr.execute(ctx, xpr.createUpdateSessions(cond), update)
+	if err != nil {
+		return result, err
 	}
-	if len(errList) > 0 {
-		return counts, errors.NewErrParallelQuery(errList)
+	if err := xpr.resultError(result, false); err != nil {
+		return result, err
 	}
 
-	return counts, nil
+	// while the shards are migrating, the new shards are updated too as best-effort.
+	// the rows of the new shards are the copies of the current shards, so they are not counted.
+	migrated, err := xpr.execute(ctx, xpr.createMigrationUpdateSessions(cond), update)
+	if err != nil {
+		return result, err
+	}
+	return result, xpr.resultError(migrated, false)
 }
 
 // CreateUpdateSessions creates new sessions with conditional clause for UPDATE query
 func (xpr *XormParallel) CreateUpdateSessions(cond UpdateCondition) []Session {
-	var sessions []Session
-	masters := xpr.orm.Masters(cond.Table)
-	for _, master := range masters {
-		s := master.NewSession()
+	return sessionsOf(xpr.createUpdateSessions(cond))
+}
+
+// createUpdateSessions creates new sessions with conditional clause for UPDATE query for each shard
+func (xpr *XormParallel) createUpdateSessions(cond UpdateCondition) []shardSession {
+	defer xpr.orm.usage.pin()()
+	return xpr.updateSessions(cond, xpr.orm.Masters(cond.Table))
+}
+
+// createMigrationUpdateSessions creates new sessions for UPDATE query to the migration destinations
+func (xpr *XormParallel) createMigrationUpdateSessions(cond UpdateCondition) []shardSession {
+	defer xpr.orm.usage.pin()()
+	return xpr.updateSessions(cond, xpr.orm.AllMigrationMasters(cond.Table))
+}
+
+// updateSessions creates new sessions with conditional clause for UPDATE query for the master dbs
+func (xpr *XormParallel) updateSessions(cond UpdateCondition, masters []Engine) []shardSession {
+	var sessions []shardSession
+	for i, master := range masters {
+		s := xpr.orm.openSession(master, nil)
 		for _, w := range cond.Where {
 			s.And(w.Statement, w.Args...)
 		}
@@ -210,7 +468,7 @@ func (xpr *XormParallel) CreateUpdateSessions(cond UpdateCondition) []Session {
 			s.Decr(exp.Statement, exp.Args...)
 		}
 
-		sessions = append(sessions, s)
+		sessions = append(sessions, shardSession{Session: s, shard: i, db: master})
 	}
 	return sessions
 }
@@ -1,9 +1,15 @@
 package xorm
 
 import (
+	"context"
+	stderrors "errors"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
 )
 
 func TestFindParallel(t *testing.T) {
@@ -71,6 +77,92 @@ func TestFindParallelByCondition(t *testing.T) {
 	assert.Contains(list, testUser{ID: 501, Name: "Betty"})
 }
 
+func TestFindParallelByConditionMerge(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	var err error
+	var list []testUser
+
+	// order by name, limit 3 offset 1
+	cond := NewFindCondition(testUser{})
+	cond.OrderByAscWith("name", CompareBinary)
+	cond.SetLimit(3)
+	cond.SetOffset(1)
+	cond.SetMerge(true)
+
+	err = orm.FindParallelByCondition(&list, cond)
+	assert.Nil(err)
+	assert.Equal([]testUser{
+		{ID: 500, Name: "Alice"},
+		{ID: 2, Name: "Benjamin"},
+		{ID: 501, Name: "Betty"},
+	}, list)
+
+	// order by desc without limit
+	list = []testUser{}
+	cond = NewFindCondition(testUser{})
+	cond.And("id > ?", 1)
+	cond.OrderByDesc("id")
+	cond.SetMerge(true)
+
+	err = orm.FindParallelByCondition(&list, cond)
+	assert.Nil(err)
+	assert.Len(list, 5)
+	assert.Equal(testUser{ID: 502, Name: "Christina"}, list[0])
+	assert.Equal(testUser{ID: 2, Name: "Benjamin"}, list[4])
+
+	// offset is out of the range
+	list = []testUser{}
+	cond.SetLimit(2)
+	cond.SetOffset(10)
+	err = orm.FindParallelByCondition(&list, cond)
+	assert.Nil(err)
+	assert.Len(list, 0)
+
+	// unknown column
+	cond = NewFindCondition(testUser{})
+	cond.OrderByAsc("unknown")
+	cond.SetMerge(true)
+	err = orm.FindParallelByCondition(&list, cond)
+	assert.NotNil(err)
+}
+
+func TestAggregateParallelByCondition(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	// group by the initial letter of the name, which is in both of the shards
+	cond := NewFindCondition(testUser{})
+	cond.GroupBy("substr(name, 1, 1)")
+	cond.Aggregate(AggregateCount, "*", "cnt")
+	cond.Aggregate(AggregateSum, "id", "total")
+	cond.Aggregate(AggregateAvg, "id", "avg_id")
+	cond.Aggregate(AggregateMax, "id", "max_id")
+	cond.HavingBy("total", ">", 502)
+	cond.OrderByDesc("total")
+
+	list, err := orm.AggregateParallelByCondition(cond)
+	assert.Nil(err)
+	assert.Len(list, 2)
+	assert.Equal("C", list[0].String("substr(name, 1, 1)"))
+	assert.EqualValues(2, list[0].Int64("cnt"))
+	assert.EqualValues(505, list[0].Int64("total"))
+	assert.Equal(252.5, list[0].Float64("avg_id"))
+	assert.EqualValues(502, list[0].Int64("max_id"))
+	assert.Equal("B", list[1].String("substr(name, 1, 1)"))
+
+	// without GROUP BY
+	cond = NewFindCondition(testUser{})
+	cond.Aggregate(AggregateAvg, "id", "avg_id")
+	list, err = orm.AggregateParallelByCondition(cond)
+	assert.Nil(err)
+	assert.Len(list, 1)
+	assert.Equal(251.5, list[0].Float64("avg_id"))
+}
+
 func TestCountParallelByCondition(t *testing.T) {
 	assert := assert.New(t)
 	wiz := testCreateWizard()
@@ -89,3 +181,278 @@ func TestCountParallelByCondition(t *testing.T) {
 	assert.Contains(counts, int64(3))
 	assert.Contains(counts, int64(2))
 }
+
+func TestParallelResultByCondition(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	// find
+	var list []testUser
+	cond := NewFindCondition(testUser{})
+	cond.And("id > ?", 1)
+	cond.OrderByAsc("id")
+
+	result, err := orm.FindParallelResultByCondition(&list, cond)
+	assert.Nil(err)
+	assert.Len(list, 5)
+	assert.Len(result.Shards, 2)
+	assert.Equal(0, result.Shards[0].Shard)
+	assert.Equal([]testUser{{ID: 2, Name: "Benjamin"}, {ID: 3, Name: "Charles"}}, result.Shards[0].Rows)
+	assert.EqualValues(2, result.Shards[0].Count)
+	assert.Equal(1, result.Shards[1].Shard)
+	assert.EqualValues(3, result.Shards[1].Count)
+	assert.Empty(result.Errors())
+
+	db := orm.Slaves(testUser{})[1]
+	r, ok := result.GetByDB(db)
+	assert.True(ok)
+	assert.Equal(1, r.Shard)
+
+	// count
+	var testObj testUser
+	result, err = orm.CountParallelResultByCondition(&testObj, cond)
+	assert.Nil(err)
+	assert.Equal([]int64{2, 3}, result.Counts())
+	assert.EqualValues(5, result.TotalCount())
+
+	counts, err := orm.CountParallelByCondition(&testObj, cond)
+	assert.Nil(err)
+	assert.Equal([]int64{2, 3}, counts, "counts are ordered by the shards")
+}
+
+func TestParallelResult(t *testing.T) {
+	assert := assert.New(t)
+
+	errShard := errors.NewNodeErr(1, nil, context.DeadlineExceeded)
+	result := ParallelResult{Shards: []ShardResult{
+		{Shard: 0, Count: 2},
+		{Shard: 1, Err: errShard, TimedOut: true},
+		{Shard: 2, Count: 3},
+	}}
+
+	r, ok := result.Get(2)
+	assert.True(ok)
+	assert.EqualValues(3, r.Count)
+	_, ok = result.Get(3)
+	assert.False(ok)
+	_, ok = result.GetByDB(nil)
+	assert.True(ok)
+
+	assert.Equal([]int64{2, 0, 3}, result.Counts())
+	assert.EqualValues(5, result.TotalCount())
+	assert.Equal(map[int]error{1: errShard}, result.Errors())
+	assert.Equal([]int{1}, result.TimedOut())
+}
+
+func TestParallelContext(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var list []testUser
+	err := orm.FindParallelContext(ctx, &list, testUser{}, "id > ? ", 1)
+	assert.Nil(err)
+	assert.Len(list, 5)
+
+	counts, err := orm.CountParallelByConditionContext(ctx, &testUser{}, NewFindCondition(testUser{}))
+	assert.Nil(err)
+	assert.Len(counts, 2)
+
+	// cancelled
+	cancel()
+	list = nil
+	err = orm.FindParallelByConditionContext(ctx, &list, NewFindCondition(testUser{}))
+	assert.Equal(context.Canceled, err)
+	assert.Len(list, 0)
+
+	_, err = orm.CountParallelByConditionContext(ctx, &testUser{}, NewFindCondition(testUser{}))
+	assert.Equal(context.Canceled, err)
+
+	cond := NewUpdateCondition(testUser{})
+	cond.And("id = ?", 1)
+	_, err = orm.UpdateParallelByConditionContext(ctx, &testUser{Name: "Adam2"}, cond)
+	assert.Equal(context.Canceled, err)
+}
+
+// testShardSession is Session which counts Close()
+type testShardSession struct {
+	Session
+	closed int32
+}
+
+func (s *testShardSession) Close() {
+	atomic.AddInt32(&s.closed, 1)
+}
+
+func (s *testShardSession) Init() {}
+
+func testShardSessions(n int) ([]shardSession, []*testShardSession) {
+	var list []shardSession
+	var sessions []*testShardSession
+	for i := 0; i < n; i++ {
+		s := &testShardSession{}
+		sessions = append(sessions, s)
+		list = append(list, shardSession{Session: s, shard: i})
+	}
+	return list, sessions
+}
+
+func TestParallelExecute(t *testing.T) {
+	assert := assert.New(t)
+	xpr := &XormParallel{}
+	ctx := context.Background()
+
+	// concurrency
+	var running, maxRunning int32
+	xpr.SetParallelConcurrency(2)
+	list, sessions := testShardSessions(5)
+	results, err := xpr.execute(ctx, list, func(s Session, r *ShardResult) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		r.Rows = s
+		return nil
+	})
+	assert.Nil(err)
+	assert.EqualValues(2, maxRunning)
+	for i, r := range results.Shards {
+		assert.Equal(i, r.Shard)
+		assert.Equal(sessions[i], r.Rows, "results are ordered by the shards")
+		assert.EqualValues(1, atomic.LoadInt32(&sessions[i].closed))
+	}
+	assert.Nil(xpr.resultError(results, true))
+
+	// shard timeout
+	release := make(chan struct{})
+	xpr.SetParallelConcurrency(0)
+	xpr.SetParallelShardTimeout(20 * time.Millisecond)
+	list, sessions = testShardSessions(3)
+	results, err = xpr.execute(ctx, list, func(s Session, r *ShardResult) error {
+		if s == sessions[1] {
+			<-release
+		}
+		r.Count = 1
+		return nil
+	})
+	assert.Nil(err)
+	assert.EqualValues(1, results.Shards[0].Count)
+	assert.True(results.Shards[1].TimedOut)
+	assert.True(stderrors.Is(results.Shards[1].Err, context.DeadlineExceeded))
+	assert.Equal([]int{1}, results.TimedOut())
+	assert.EqualValues(0, atomic.LoadInt32(&sessions[1].closed), "session is closed after the query")
+
+	err = xpr.resultError(results, true)
+	partial, ok := err.(errors.ErrPartialResult)
+	assert.True(ok)
+	assert.Equal([]int{1}, partial.TimedOut)
+	assert.True(stderrors.Is(err, errors.ErrShardTimeout))
+	err = xpr.resultError(results, false)
+	assert.True(stderrors.Is(err, errors.ErrParallelQuery))
+	assert.True(stderrors.Is(err, context.DeadlineExceeded))
+
+	// the error except timeout
+	results.Shards[0].Err = errors.NewNodeErr(0, nil, errors.NewErr(1, "error"))
+	_, ok = xpr.resultError(results, true).(errors.ErrPartialResult)
+	assert.False(ok)
+
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	assert.EqualValues(1, atomic.LoadInt32(&sessions[1].closed))
+
+	// overall timeout
+	release = make(chan struct{})
+	xpr.SetParallelConcurrency(1)
+	xpr.SetParallelShardTimeout(0)
+	xpr.SetParallelTimeout(20 * time.Millisecond)
+	list, sessions = testShardSessions(3)
+	results, err = xpr.execute(ctx, list, func(s Session, r *ShardResult) error {
+		<-release
+		return nil
+	})
+	assert.Nil(err)
+	for i, r := range results.Shards {
+		assert.True(r.TimedOut, "shard %d", i)
+	}
+	var closed int32
+	for _, s := range sessions {
+		closed += atomic.LoadInt32(&s.closed)
+	}
+	assert.EqualValues(2, closed, "not started shards are closed")
+	close(release)
+
+	// the timed out query keeps the slot until it returns
+	wait := make(chan struct{})
+	xpr.SetParallelShardTimeout(20 * time.Millisecond)
+	xpr.SetParallelTimeout(0)
+	list, _ = testShardSessions(2)
+	var started int32
+	done := make(chan ParallelResult)
+	go func() {
+		results, _ := xpr.execute(ctx, list, func(s Session, r *ShardResult) error {
+			if atomic.AddInt32(&started, 1) == 1 {
+				<-wait
+			}
+			return nil
+		})
+		done <- results
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(1, atomic.LoadInt32(&started), "next shard waits for the abandoned query")
+	close(wait)
+	results = <-done
+	assert.EqualValues(2, atomic.LoadInt32(&started))
+	assert.Len(results.TimedOut(), 1)
+	xpr.SetParallelShardTimeout(0)
+
+	// cancelled by the caller
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	list, _ = testShardSessions(3)
+	_, err = xpr.execute(ctx, list, func(s Session, r *ShardResult) error {
+		return nil
+	})
+	assert.Equal(context.Canceled, err)
+}
+
+func TestParallelExecuteErrors(t *testing.T) {
+	assert := assert.New(t)
+	xpr := &XormParallel{}
+	ctx := context.Background()
+
+	// the errors of the shards failing at the same time are collected without the data race
+	for _, concurrency := range []int{0, 3} {
+		xpr.SetParallelConcurrency(concurrency)
+		list, _ := testShardSessions(8)
+		results, err := xpr.execute(ctx, list, func(s Session, r *ShardResult) error {
+			if r.Shard%2 == 0 {
+				r.Count = 1
+				return nil
+			}
+			return errors.NewErr(r.Shard, "error")
+		})
+		assert.Nil(err)
+		assert.EqualValues(4, results.TotalCount())
+
+		errs := results.Errors()
+		assert.Len(errs, 4, "concurrency %d", concurrency)
+		for shard, err := range errs {
+			assert.Equal(errors.NewNodeErr(shard, nil, errors.NewErr(shard, "error")), err)
+		}
+
+		err = xpr.resultError(results, true)
+		assert.True(stderrors.Is(err, errors.ErrParallelQuery))
+		var shards []int
+		for _, e := range err.(errors.MultiErr).NodeErrors() {
+			shards = append(shards, e.Shard)
+		}
+		assert.Equal([]int{1, 3, 5, 7}, shards, "errors are ordered by the shard index")
+	}
+}
@@ -1,26 +1,101 @@
 package xorm
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // SessionList contains db sessions list for one group
 type SessionList struct {
 	readOnly bool
 	autoTx   bool
 
+	readYourWrites bool
+	rywWindow      time.Duration
+	dirtyMu        sync.RWMutex
+	dirty          map[interface{}]time.Time
+
 	sessMu   sync.RWMutex
 	sessions map[interface{}]Session
 
 	txMu         sync.RWMutex
 	transactions map[interface{}]Session
+	txContexts   map[interface{}]context.Context
+
+	compMu        sync.Mutex
+	compensations []compensation
+
+	twoPhase  bool
+	branchMu  sync.Mutex
+	gtid      string
+	branchSeq int
+	branches  map[interface{}]*branch
+
+	lastUsed int64 // unix nano
+	active   int32 // the callers using the sessions
+
+	bindMu sync.RWMutex
+	bound  context.Context
 }
 
 func newSessionList() *SessionList {
 	return &SessionList{
 		sessions:     make(map[interface{}]Session),
 		transactions: make(map[interface{}]Session),
+		txContexts:   make(map[interface{}]context.Context),
+		dirty:        make(map[interface{}]time.Time),
+		branches:     make(map[interface{}]*branch),
+		lastUsed:     time.Now().UnixNano(),
+	}
+}
+
+// touch updates the last used time
+func (l *SessionList) touch() {
+	atomic.StoreInt64(&l.lastUsed, time.Now().UnixNano())
+}
+
+// idleTime returns the duration since the last used time
+func (l *SessionList) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&l.lastUsed)))
+}
+
+// use marks the SessionList in use until the returned function is called
+func (l *SessionList) use() func() {
+	atomic.AddInt32(&l.active, 1)
+	l.touch()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.touch()
+			atomic.AddInt32(&l.active, -1)
+		})
 	}
 }
 
+// inUse checks any caller is using the sessions
+func (l *SessionList) inUse() bool {
+	return atomic.LoadInt32(&l.active) > 0
+}
+
+// bind sets the context which the SessionList is bound to
+func (l *SessionList) bind(ctx context.Context) {
+	l.bindMu.Lock()
+	defer l.bindMu.Unlock()
+	l.bound = ctx
+}
+
+// boundErr returns the error of the context which the SessionList is bound to
+func (l *SessionList) boundErr() error {
+	l.bindMu.RLock()
+	defer l.bindMu.RUnlock()
+	if l.bound == nil {
+		return nil
+	}
+	return l.bound.Err()
+}
+
 func (l *SessionList) hasSession(db interface{}) bool {
 	l.sessMu.RLock()
 	defer l.sessMu.RUnlock()
@@ -40,8 +115,16 @@ func (l *SessionList) addSession(db interface{}, s Session) {
 	l.sessions[db] = s
 }
 
+// getSessions returns the copy of the sessions
 func (l *SessionList) getSessions() map[interface{}]Session {
-	return l.sessions
+	l.sessMu.RLock()
+	defer l.sessMu.RUnlock()
+
+	list := make(map[interface{}]Session, len(l.sessions))
+	for db, s := range l.sessions {
+		list[db] = s
+	}
+	return list
 }
 
 func (l *SessionList) clearSessions() {
@@ -60,16 +143,191 @@ func (l *SessionList) addTransaction(db interface{}, s Session) {
 	l.txMu.Lock()
 	defer l.txMu.Unlock()
 	l.transactions[db] = s
+	delete(l.txContexts, db)
+}
+
+// addTransactionContext adds the transaction which is cancelled when the context is done
+func (l *SessionList) addTransactionContext(ctx context.Context, db interface{}, s Session) {
+	l.txMu.Lock()
+	defer l.txMu.Unlock()
+	l.transactions[db] = s
+	l.txContexts[db] = ctx
+}
+
+// transactionErr returns the error of the context of the transaction for the db
+func (l *SessionList) transactionErr(db interface{}) error {
+	l.txMu.RLock()
+	defer l.txMu.RUnlock()
+	ctx, ok := l.txContexts[db]
+	if !ok {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// doneTransaction returns the db of the transaction whose context is done and the error of the context
+func (l *SessionList) doneTransaction() (interface{}, error) {
+	l.txMu.RLock()
+	defer l.txMu.RUnlock()
+	for db, ctx := range l.txContexts {
+		if err := ctx.Err(); err != nil {
+			return db, err
+		}
+	}
+	return nil, nil
 }
 
+// getTransactions returns the copy of the transactions
 func (l *SessionList) getTransactions() map[interface{}]Session {
-	return l.transactions
+	l.txMu.RLock()
+	defer l.txMu.RUnlock()
+
+	list := make(map[interface{}]Session, len(l.transactions))
+	for db, s := range l.transactions {
+		list[db] = s
+	}
+	return list
+}
+
+// removeTransaction removes the transaction for the db if it's the given session
+func (l *SessionList) removeTransaction(db interface{}, s Session) bool {
+	l.txMu.Lock()
+	defer l.txMu.Unlock()
+
+	if l.transactions[db] != s {
+		return false
+	}
+	delete(l.transactions, db)
+	delete(l.txContexts, db)
+	return true
+}
+
+// takeTransactions removes all of the transactions and returns them
+func (l *SessionList) takeTransactions() map[interface{}]Session {
+	l.txMu.Lock()
+	defer l.txMu.Unlock()
+
+	list := l.transactions
+	l.transactions = make(map[interface{}]Session)
+	l.txContexts = make(map[interface{}]context.Context)
+	return list
 }
 
 func (l *SessionList) clearTransactions() {
 	l.txMu.Lock()
 	defer l.txMu.Unlock()
 	l.transactions = make(map[interface{}]Session)
+	l.txContexts = make(map[interface{}]context.Context)
+}
+
+// compensation is the action to undo the committed write
+type compensation struct {
+	db Engine
+	fn func(Session) error
+}
+
+func (l *SessionList) addCompensation(db Engine, fn func(Session) error) {
+	l.compMu.Lock()
+	defer l.compMu.Unlock()
+	l.compensations = append(l.compensations, compensation{db: db, fn: fn})
+}
+
+func (l *SessionList) hasCompensations() bool {
+	l.compMu.Lock()
+	defer l.compMu.Unlock()
+	return len(l.compensations) > 0
+}
+
+// takeCompensations removes all of the compensations and returns them in the registered order
+func (l *SessionList) takeCompensations() []compensation {
+	l.compMu.Lock()
+	defer l.compMu.Unlock()
+	list := l.compensations
+	l.compensations = nil
+	return list
+}
+
+// nextXID returns xid for the new branch of the global transaction
+func (l *SessionList) nextXID(newGTID func() string) string {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+
+	if l.gtid == "" {
+		l.gtid = newGTID()
+	}
+	l.branchSeq++
+	return branchXID(l.gtid, l.branchSeq)
+}
+
+func (l *SessionList) getGTID() string {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+	return l.gtid
+}
+
+func (l *SessionList) addBranch(db interface{}, b *branch) {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+	l.branches[db] = b
+}
+
+func (l *SessionList) getBranch(db interface{}) *branch {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+	return l.branches[db]
+}
+
+func (l *SessionList) removeBranch(db interface{}) *branch {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+	b := l.branches[db]
+	delete(l.branches, db)
+	return b
+}
+
+func (l *SessionList) hasBranches() bool {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+	return len(l.branches) > 0
+}
+
+// clearBranches removes all of the branches and returns the global transaction id
+func (l *SessionList) clearBranches() string {
+	l.branchMu.Lock()
+	defer l.branchMu.Unlock()
+
+	gtid := l.gtid
+	l.gtid = ""
+	l.branchSeq = 0
+	l.branches = make(map[interface{}]*branch)
+	return gtid
+}
+
+// markDirty saves the time of writing to the master db
+func (l *SessionList) markDirty(db interface{}) {
+	if !l.readYourWrites {
+		return
+	}
+	l.dirtyMu.Lock()
+	defer l.dirtyMu.Unlock()
+	l.dirty[db] = time.Now()
+}
+
+// isDirty checks the master db is written within the read-your-writes window
+func (l *SessionList) isDirty(db interface{}) bool {
+	if !l.readYourWrites {
+		return false
+	}
+	l.dirtyMu.RLock()
+	defer l.dirtyMu.RUnlock()
+	t, ok := l.dirty[db]
+	switch {
+	case !ok:
+		return false
+	case l.rywWindow <= 0:
+		return true
+	}
+	return time.Since(t) < l.rywWindow
 }
 
 // ReadOnly set write proof flag
@@ -91,3 +349,31 @@ func (l *SessionList) SetAutoTransaction(b bool) {
 func (l *SessionList) IsAutoTransaction() bool {
 	return l.autoTx
 }
+
+// SetTwoPhaseCommit sets two-phase commit flag
+// when the flag is on, the transactions started after it are committed by two-phase commit
+func (l *SessionList) SetTwoPhaseCommit(b bool) {
+	l.twoPhase = b
+}
+
+// IsTwoPhaseCommit checks in two-phase commit mode or not
+func (l *SessionList) IsTwoPhaseCommit() bool {
+	return l.twoPhase
+}
+
+// SetReadYourWrites sets read-your-writes flag
+// when the flag is on, slave session is replaced by master session after writing to the master
+func (l *SessionList) SetReadYourWrites(b bool) {
+	l.readYourWrites = b
+}
+
+// IsReadYourWrites checks in read-your-writes mode or not
+func (l *SessionList) IsReadYourWrites() bool {
+	return l.readYourWrites
+}
+
+// SetReadYourWritesWindow sets the duration to use master session after writing
+// zero value means to use master session until the SessionList is closed
+func (l *SessionList) SetReadYourWritesWindow(d time.Duration) {
+	l.rywWindow = d
+}
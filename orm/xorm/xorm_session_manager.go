@@ -1,16 +1,25 @@
 package xorm
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	"github.com/evalphobia/wizard"
 	"github.com/evalphobia/wizard/errors"
+	"github.com/go-xorm/xorm"
 )
 
+// drainInterval is the interval to check the sessions of the draining engines
+const drainInterval = 10 * time.Millisecond
+
 // XormSessionManager manages database session list for xorm
 type XormSessionManager struct {
-	orm    *Xorm
-	listMu sync.RWMutex
-	list   map[Identifier]*SessionList
+	orm         *Xorm
+	listMu      sync.RWMutex
+	list        map[Identifier]*SessionList
+	coordinator *Coordinator
+	usage       engineUsage // the open sessions of the engines
 }
 
 // Identifier is unique object for using same sessions
@@ -24,6 +33,23 @@ func newSession(db Engine, obj interface{}) (Session, error) {
 	return db.NewSession(), nil
 }
 
+// contextSession is interface for the session supporting context.Context
+type contextSession interface {
+	Context(context.Context) *xorm.Session
+}
+
+// withContext sets the context into the session when the xorm version supports it
+// the context which is never cancelled (e.g. context.Background()) is not set.
+func withContext(ctx context.Context, s Session) Session {
+	if ctx.Done() == nil {
+		return s
+	}
+	if cs, ok := s.(contextSession); ok {
+		cs.Context(ctx)
+	}
+	return s
+}
+
 // SetAutoTransaction sets auto transaction flag of the SessionList
 func (xse *XormSessionManager) SetAutoTransaction(id Identifier, b bool) {
 	sl := xse.getOrCreateSessionList(id)
@@ -48,43 +74,100 @@ func (xse *XormSessionManager) IsReadOnly(id Identifier) bool {
 	return sl.IsReadOnly()
 }
 
+// SetReadYourWrites sets read-your-writes flag of the SessionList
+func (xse *XormSessionManager) SetReadYourWrites(id Identifier, b bool) {
+	sl := xse.getOrCreateSessionList(id)
+	sl.SetReadYourWrites(b)
+}
+
+// IsReadYourWrites checks read-your-writes flag of the SessionList
+func (xse *XormSessionManager) IsReadYourWrites(id Identifier) bool {
+	sl := xse.getOrCreateSessionList(id)
+	return sl.IsReadYourWrites()
+}
+
+// SetReadYourWritesWindow sets the duration of read-your-writes of the SessionList
+func (xse *XormSessionManager) SetReadYourWritesWindow(id Identifier, d time.Duration) {
+	sl := xse.getOrCreateSessionList(id)
+	sl.SetReadYourWritesWindow(d)
+}
+
 // NewMasterSession returns new master session for the db of given object
 func (xse *XormSessionManager) NewMasterSession(obj interface{}) (Session, error) {
+	return xse.NewMasterSessionContext(context.Background(), obj)
+}
+
+// NewMasterSessionContext returns new master session with the context for the db of given object
+func (xse *XormSessionManager) NewMasterSessionContext(ctx context.Context, obj interface{}) (Session, error) {
+	defer xse.usage.pin()()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	db := xse.orm.Master(obj)
 	if db == nil {
-		return nil, errors.NewErrNilDB(NormalizeValue(obj))
+		return nil, xse.orm.nilDBErr(obj)
 	}
 
-	return db.NewSession(), nil
+	return withContext(ctx, xse.openSession(db, nil)), nil
 }
 
 // UseMasterSession returns new master session for the db of given object
 func (xse *XormSessionManager) UseMasterSession(id Identifier, obj interface{}) (Session, error) {
+	return xse.UseMasterSessionContext(context.Background(), id, obj)
+}
+
+// UseMasterSessionContext returns new master session with the context for the db of given object
+// in the AutoTransaction mode, the transaction whose context is done is rolled back by the next call for it or CommitAll()
+func (xse *XormSessionManager) UseMasterSessionContext(ctx context.Context, id Identifier, obj interface{}) (Session, error) {
+	defer xse.usage.pin()()
 	db := xse.orm.Master(obj)
-	sl := xse.getOrCreateSessionList(id)
-	if sl.IsAutoTransaction() {
-		return xse.transaction(id, obj, db)
-	}
-	return xse.session(id, obj, db)
+	return xse.masterSession(ctx, id, obj, db)
 }
 
 // UseMasterSessionByKey returns new master session by shard key
 func (xse *XormSessionManager) UseMasterSessionByKey(id Identifier, obj interface{}, key interface{}) (Session, error) {
+	return xse.UseMasterSessionByKeyContext(context.Background(), id, obj, key)
+}
+
+// UseMasterSessionByKeyContext returns new master session with the context by shard key
+func (xse *XormSessionManager) UseMasterSessionByKeyContext(ctx context.Context, id Identifier, obj interface{}, key interface{}) (Session, error) {
+	defer xse.usage.pin()()
 	db := xse.orm.MasterByKey(obj, key)
+	if db == nil {
+		return nil, xse.orm.nilDBErrByKey(obj, key)
+	}
+	return xse.masterSession(ctx, id, obj, db)
+}
+
+// masterSession returns the session for the master db
+// in the AutoTransaction mode, the session with transaction is returned
+func (xse *XormSessionManager) masterSession(ctx context.Context, id Identifier, obj interface{}, db Engine) (Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	sl := xse.getOrCreateSessionList(id)
 	if sl.IsAutoTransaction() {
-		return xse.transaction(id, obj, db)
+		return xse.transaction(ctx, id, obj, db)
 	}
-	return xse.session(id, obj, db)
+	return xse.session(ctx, id, obj, db)
 }
 
 // UseAllMasterSessions returns all of master sessions for the db of given object
 func (xse *XormSessionManager) UseAllMasterSessions(id Identifier, obj interface{}) ([]Session, error) {
+	return xse.UseAllMasterSessionsContext(context.Background(), id, obj)
+}
+
+// UseAllMasterSessionsContext returns all of master sessions with the context for the db of given object
+func (xse *XormSessionManager) UseAllMasterSessionsContext(ctx context.Context, id Identifier, obj interface{}) ([]Session, error) {
+	defer xse.usage.pin()()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	dbs := xse.orm.Masters(obj)
 
 	var sessions []Session
 	var errList []error
-	for _, db := range dbs {
+	for i, db := range dbs {
 		var s Session
 		var err error
 
@@ -92,11 +175,11 @@ func (xse *XormSessionManager) UseAllMasterSessions(id Identifier, obj interface
 		// case xse.orm.IsAutoTransaction():
 		// s, err = xse.orm.transaction(obj, db)
 		default:
-			s, err = xse.session(id, obj, db)
+			s, err = xse.session(ctx, id, obj, db)
 		}
 
 		if err != nil {
-			errList = append(errList, err)
+			errList = append(errList, errors.NewNodeErr(i, db, err))
 			continue
 		}
 		sessions = append(sessions, s)
@@ -108,38 +191,190 @@ func (xse *XormSessionManager) UseAllMasterSessions(id Identifier, obj interface
 	return sessions, nil
 }
 
+// UseMigrationMasterSessions returns master sessions of the migration destinations for the db of given object
+// while the shard is migrating, the writes with UseMasterSession() must be applied to these sessions too.
+// the transactions are returned when they exist for the dbs, e.g. AutoTransaction mode, Transaction().
+func (xse *XormSessionManager) UseMigrationMasterSessions(id Identifier, obj interface{}) ([]Session, error) {
+	return xse.UseMigrationMasterSessionsContext(context.Background(), id, obj)
+}
+
+// UseMigrationMasterSessionsContext returns master sessions with the context of the migration destinations for the db of given object
+func (xse *XormSessionManager) UseMigrationMasterSessionsContext(ctx context.Context, id Identifier, obj interface{}) ([]Session, error) {
+	defer xse.usage.pin()()
+	return xse.migrationSessions(ctx, id, obj, xse.orm.MigrationMasters(obj))
+}
+
+// UseMigrationMasterSessionsByKey returns master sessions of the migration destinations by shard key
+func (xse *XormSessionManager) UseMigrationMasterSessionsByKey(id Identifier, obj interface{}, key interface{}) ([]Session, error) {
+	return xse.UseMigrationMasterSessionsByKeyContext(context.Background(), id, obj, key)
+}
+
+// UseMigrationMasterSessionsByKeyContext returns master sessions with the context of the migration destinations by shard key
+func (xse *XormSessionManager) UseMigrationMasterSessionsByKeyContext(ctx context.Context, id Identifier, obj interface{}, key interface{}) ([]Session, error) {
+	defer xse.usage.pin()()
+	return xse.migrationSessions(ctx, id, obj, xse.orm.MigrationMastersByKey(obj, key))
+}
+
+// migrationSessions returns the sessions of the migration destinations
+// every writing path to the master uses it to write to the new shards while migrating.
+func (xse *XormSessionManager) migrationSessions(ctx context.Context, id Identifier, obj interface{}, dbs []Engine) ([]Session, error) {
+	var sessions []Session
+	for _, db := range dbs {
+		s, err := xse.getTransactionFromList(id, db)
+		if err != nil {
+			return sessions, err
+		}
+		if s != nil {
+			sessions = append(sessions, withContext(ctx, s))
+			continue
+		}
+		s, err = xse.masterSession(ctx, id, obj, db)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
 // UseSlaveSession returns new slave session for the slave db of given object
+// in read-your-writes mode, master session is returned after writing to the master
 func (xse *XormSessionManager) UseSlaveSession(id Identifier, obj interface{}) (Session, error) {
-	db := xse.orm.Slave(obj)
-	return xse.session(id, obj, db)
+	return xse.UseSlaveSessionContext(context.Background(), id, obj)
+}
+
+// UseSlaveSessionContext returns new slave session with the context for the slave db of given object
+func (xse *XormSessionManager) UseSlaveSessionContext(ctx context.Context, id Identifier, obj interface{}) (Session, error) {
+	defer xse.usage.pin()()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if xse.IsReadYourWrites(id) {
+		master := xse.orm.Master(obj)
+		if xse.isDirty(id, master) {
+			return xse.readSession(ctx, id, obj, master)
+		}
+	}
+
+	db, node := xse.orm.slaveNode(obj)
+	return xse.slaveSession(ctx, id, obj, db, node)
 }
 
 // UseSlaveSessionByKey returns new slave session by shard key
+// in read-your-writes mode, master session is returned after writing to the master
 func (xse *XormSessionManager) UseSlaveSessionByKey(id Identifier, obj interface{}, key interface{}) (Session, error) {
-	db := xse.orm.SlaveByKey(obj, key)
-	return xse.session(id, obj, db)
+	return xse.UseSlaveSessionByKeyContext(context.Background(), id, obj, key)
+}
+
+// UseSlaveSessionByKeyContext returns new slave session with the context by shard key
+func (xse *XormSessionManager) UseSlaveSessionByKeyContext(ctx context.Context, id Identifier, obj interface{}, key interface{}) (Session, error) {
+	defer xse.usage.pin()()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if xse.IsReadYourWrites(id) {
+		master := xse.orm.MasterByKey(obj, key)
+		if xse.isDirty(id, master) {
+			return xse.readSession(ctx, id, obj, master)
+		}
+	}
+
+	db, node := xse.orm.slaveNodeByKey(obj, key)
+	if db == nil {
+		return nil, xse.orm.nilDBErrByKey(obj, key)
+	}
+	return xse.slaveSession(ctx, id, obj, db, node)
+}
+
+// readSession returns the session for reading from the master db
+// if the transaction exists for the db, return it to read uncommitted writes
+func (xse *XormSessionManager) readSession(ctx context.Context, id Identifier, obj interface{}, db Engine) (Session, error) {
+	if db == nil {
+		return nil, xse.orm.nilDBErr(obj)
+	}
+	s, err := xse.getTransactionFromList(id, db)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		return withContext(ctx, s), nil
+	}
+	return xse.session(ctx, id, obj, db)
+}
+
+// markDirty marks the master db is written in the SessionList
+// it's called after writing by Insert()/Update(), writing by the master session and committing the transaction.
+func (xse *XormSessionManager) markDirty(sl *SessionList, db interface{}) {
+	if db == nil {
+		return
+	}
+	sl.markDirty(db)
+}
+
+// isDirty checks the master db is written in the SessionList
+func (xse *XormSessionManager) isDirty(id Identifier, db Engine) bool {
+	if db == nil || !xse.hasSessionList(id) {
+		return false
+	}
+	sl := xse.getOrCreateSessionList(id)
+	return sl.isDirty(db)
 }
 
 // session returns the session for the db of given object
 // if old session exists for the object, return it,
 // if no session exists for the object, create new one and return it
-func (xse *XormSessionManager) session(id Identifier, obj interface{}, db Engine) (Session, error) {
+func (xse *XormSessionManager) session(ctx context.Context, id Identifier, obj interface{}, db Engine) (Session, error) {
+	return xse.slaveSession(ctx, id, obj, db, nil)
+}
+
+// slaveSession returns the session for the db of given object
+// the new session counts the in-flight queries of the node until it's closed by CloseAll().
+// the session without the node is for the master, and the writes by it mark the master dirty.
+func (xse *XormSessionManager) slaveSession(ctx context.Context, id Identifier, obj interface{}, db Engine, node *wizard.Node) (Session, error) {
 	if db == nil {
-		return nil, errors.NewErrNilDB(NormalizeValue(obj))
+		return nil, xse.orm.nilDBErr(obj)
+	}
+	if err := xse.checkBound(id); err != nil {
+		return nil, err
 	}
 	// use old session
 
 	s := xse.getSessionFromList(id, db)
 	if s != nil {
-		return s, nil
+		return withContext(ctx, s), nil
 	}
 
 	// create new session
-	s = db.NewSession()
+	ts := xse.openSession(db, node)
+	if node == nil {
+		xse.trackWrites(xse.getOrCreateSessionList(id), db, ts)
+	}
+	s = withContext(ctx, ts)
 	xse.addSessionIntoList(id, db, s)
 	return s, nil
 }
 
+// SetTwoPhaseCommit sets two-phase commit flag of the SessionList
+// the coordinator must be set by SetCoordinator()
+func (xse *XormSessionManager) SetTwoPhaseCommit(id Identifier, b bool) {
+	sl := xse.getOrCreateSessionList(id)
+	sl.SetTwoPhaseCommit(b)
+}
+
+// IsTwoPhaseCommit checks two-phase commit flag of the SessionList
+func (xse *XormSessionManager) IsTwoPhaseCommit(id Identifier) bool {
+	sl := xse.getOrCreateSessionList(id)
+	return sl.IsTwoPhaseCommit()
+}
+
+// SetCoordinator sets the coordinator of two-phase commit
+func (xse *XormSessionManager) SetCoordinator(c *Coordinator) {
+	if c != nil {
+		c.shardIndex = xse.orm.Wiz.ShardIndex
+	}
+	xse.coordinator = c
+}
+
 // getSessionFromList returns the session for the db
 func (xse *XormSessionManager) getSessionFromList(id Identifier, db interface{}) Session {
 	if !xse.hasSessionList(id) {
@@ -158,20 +393,137 @@ func (xse *XormSessionManager) addSessionIntoList(id Identifier, db interface{},
 
 // CloseAll closes all of sessions and engines
 func (xse *XormSessionManager) CloseAll(id Identifier) {
-	sl := xse.getOrCreateSessionList(id)
+	xse.closeSessionList(xse.getOrCreateSessionList(id))
+
+	xse.listMu.Lock()
+	defer xse.listMu.Unlock()
+	delete(xse.list, id)
+}
 
+// closeSessionList closes all of sessions in the SessionList
+func (xse *XormSessionManager) closeSessionList(sl *SessionList) {
 	for _, s := range sl.getSessions() {
 		s.Close()
 	}
-	for _, s := range sl.getTransactions() {
+	for db, s := range sl.getTransactions() {
+		if sl.getBranch(db) != nil {
+			xse.rollbackTransaction(sl, db, s)
+		}
 		s.Close()
 	}
 	sl.clearSessions()
 	sl.clearTransactions()
+	xse.finishBranches(sl)
+}
 
+// MarkInUse marks the identifier in use until the returned function is called
+// the Sweeper never reclaims the identifier in use even when no manager call is made for the idle TTL.
+// the functions of XormFunction, RunInTransaction() and Middleware mark it automatically.
+// e.g. defer orm.MarkInUse(id)() before the long query on the session of UseMasterSession()
+func (xse *XormSessionManager) MarkInUse(id Identifier) func() {
+	return xse.getOrCreateSessionList(id).use()
+}
+
+// BindContext binds the SessionList of the identifier to the context
+// when the context is done, uncommitted transactions are rolled back and all of sessions are closed
+// by the next call for the identifier, e.g. UseMasterSession(), Transaction(), CommitAll().
+// no goroutine watches the context, so the sessions are never closed while the caller uses them.
+// e.g. BindContext(req.Context(), req)
+func (xse *XormSessionManager) BindContext(ctx context.Context, id Identifier) {
+	if ctx.Done() == nil {
+		return
+	}
+	xse.getOrCreateSessionList(id).bind(ctx)
+}
+
+// checkBound releases the SessionList of the identifier when the bound context is done
+func (xse *XormSessionManager) checkBound(id Identifier) error {
+	sl, ok := xse.getSessionList(id)
+	if !ok {
+		return nil
+	}
+	if err := sl.boundErr(); err != nil {
+		xse.release(id)
+		return err
+	}
+	return nil
+}
+
+// release rolls back the uncommitted transactions and closes all of the sessions of the identifier
+func (xse *XormSessionManager) release(id Identifier) {
+	if sl, ok := xse.getSessionList(id); ok {
+		// the transactions must be rolled back even in read only mode
+		sl.ReadOnly(false)
+	}
+	xse.RollbackAll(id)
+	xse.CloseAll(id)
+}
+
+// releaseSessionList rolls back the uncommitted transactions and closes all of the sessions in the SessionList
+// the SessionList must be removed from the manager before.
+func (xse *XormSessionManager) releaseSessionList(sl *SessionList) {
+	xse.rollbackSessionList(sl)
+	xse.closeSessionList(sl)
+}
+
+// idleSessionLists returns the identifiers of the SessionLists not used for the duration
+func (xse *XormSessionManager) idleSessionLists(d time.Duration) []Identifier {
+	xse.listMu.RLock()
+	defer xse.listMu.RUnlock()
+
+	var result []Identifier
+	for id, sl := range xse.list {
+		if !sl.inUse() && sl.idleTime() >= d {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// takeIdleSessionList removes the SessionList from the manager when it's still idle for the duration and not in use
+// the SessionList is checked and removed under the lock, so no caller can take it after the check.
+func (xse *XormSessionManager) takeIdleSessionList(id Identifier, d time.Duration) (*SessionList, bool) {
 	xse.listMu.Lock()
 	defer xse.listMu.Unlock()
+
+	sl, ok := xse.list[id]
+	if !ok || sl.inUse() || sl.idleTime() < d {
+		return nil, false
+	}
 	delete(xse.list, id)
+	return sl, true
+}
+
+// drain closes the engines after all of the sessions using them are closed
+// every session created by the manager is counted, e.g. CloseAll(), Close() of the session, the end of the transaction.
+// the clusters must be replaced before drain, and the lookups from the old clusters are waited too.
+func (xse *XormSessionManager) drain(engines []Engine, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	epoch := xse.usage.advance()
+	for {
+		var busy []Engine
+		for _, e := range engines {
+			if !xse.usage.closeIfIdle(e, epoch) {
+				busy = append(busy, e)
+			}
+		}
+
+		engines = busy
+		switch {
+		case len(engines) == 0:
+			return nil
+		case !deadline.IsZero() && time.Now().After(deadline):
+			for _, e := range engines {
+				e.Close()
+			}
+			return errors.NewErrDrainTimeout(len(engines))
+		}
+		time.Sleep(drainInterval)
+	}
 }
 
 func (xse *XormSessionManager) newSessionList(id Identifier) *SessionList {
@@ -181,10 +533,24 @@ func (xse *XormSessionManager) newSessionList(id Identifier) *SessionList {
 	if xse.list == nil {
 		xse.list = make(map[Identifier]*SessionList)
 	}
+	if sl, ok := xse.list[id]; ok {
+		// created by another goroutine
+		sl.touch()
+		return sl
+	}
 	xse.list[id] = newSessionList()
 	return xse.list[id]
 }
 
+// getSessionList returns the SessionList without creating it
+func (xse *XormSessionManager) getSessionList(id Identifier) (*SessionList, bool) {
+	xse.listMu.RLock()
+	defer xse.listMu.RUnlock()
+
+	sl, ok := xse.list[id]
+	return sl, ok
+}
+
 func (xse *XormSessionManager) hasSessionList(id Identifier) bool {
 	xse.listMu.RLock()
 	defer xse.listMu.RUnlock()
@@ -194,11 +560,16 @@ func (xse *XormSessionManager) hasSessionList(id Identifier) bool {
 }
 
 func (xse *XormSessionManager) getOrCreateSessionList(id Identifier) *SessionList {
-	if !xse.hasSessionList(id) {
-		xse.newSessionList(id)
+	xse.listMu.RLock()
+	sl, ok := xse.list[id]
+	if ok {
+		// touched under the lock, so the Sweeper never takes the SessionList returned here
+		sl.touch()
 	}
+	xse.listMu.RUnlock()
 
-	xse.listMu.RLock()
-	defer xse.listMu.RUnlock()
-	return xse.list[id]
+	if !ok {
+		sl = xse.newSessionList(id)
+	}
+	return sl
 }
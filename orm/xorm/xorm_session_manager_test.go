@@ -1,7 +1,10 @@
 package xorm
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -89,6 +92,23 @@ func TestSetIsAutoTransaction(t *testing.T) {
 	assert.False(orm.IsAutoTransaction(testID))
 }
 
+func TestSetReadYourWrites(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	sl := orm.XormSessionManager.getOrCreateSessionList(testID)
+
+	assert.False(orm.IsReadYourWrites(testID))
+	orm.SetReadYourWrites(testID, true)
+	assert.True(sl.readYourWrites)
+	assert.True(orm.IsReadYourWrites(testID))
+	orm.SetReadYourWrites(testID, false)
+	assert.False(orm.IsReadYourWrites(testID))
+
+	orm.SetReadYourWritesWindow(testID, time.Second)
+	assert.Equal(time.Second, sl.rywWindow)
+}
+
 func TestUseMasterSession(t *testing.T) {
 	assert := assert.New(t)
 	wiz := testCreateWizard()
@@ -240,3 +260,144 @@ func TestUseSlaveSessionByKey(t *testing.T) {
 	assert.Nil(err)
 	assert.True(has)
 }
+
+func TestUseSlaveSessionReadYourWrites(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+
+	var row = &testUser{ID: 4}
+	var s, tx Session
+	var has bool
+	var err error
+
+	// write without read-your-writes
+	orm.SetAutoTransaction(testID, true)
+	tx, err = orm.UseMasterSession(testID, row)
+	assert.Nil(err)
+	tx.Insert(row)
+
+	s, err = orm.UseSlaveSession(testID, row)
+	assert.Nil(err)
+	assert.NotEqual(tx, s)
+	has, _ = s.Get(&testUser{ID: 4})
+	assert.False(has, "slave cannot read uncommitted row")
+	orm.RollbackAll(testID)
+	orm.CloseAll(testID)
+
+	// write with read-your-writes
+	orm.SetAutoTransaction(testID, true)
+	orm.SetReadYourWrites(testID, true)
+	s, err = orm.UseSlaveSession(testID, row)
+	assert.Nil(err)
+	has, _ = s.Get(&testUser{ID: 4})
+	assert.False(has, "slave session is used before writing")
+
+	tx, err = orm.UseMasterSession(testID, row)
+	assert.Nil(err)
+	s, err = orm.UseSlaveSession(testID, row)
+	assert.Nil(err)
+	assert.NotEqual(tx, s, "slave session is used before writing even if the master session is used")
+
+	orm.Insert(testID, row, func(s Session) (int64, error) {
+		return s.Insert(row)
+	})
+
+	s, err = orm.UseSlaveSession(testID, row)
+	assert.Nil(err)
+	assert.Equal(tx, s, "transaction of the master is used after writing")
+	has, _ = s.Get(&testUser{ID: 4})
+	assert.True(has)
+
+	s, err = orm.UseSlaveSessionByKey(testID, testUser{}, 4)
+	assert.Nil(err)
+	assert.Equal(tx, s)
+
+	s, err = orm.UseSlaveSession(testID, &testUser{ID: 500})
+	assert.Nil(err)
+	assert.NotEqual(tx, s, "slave session is used for the other shard")
+
+	// expired window
+	orm.SetReadYourWritesWindow(testID, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	s, err = orm.UseSlaveSession(testID, row)
+	assert.Nil(err)
+	assert.NotEqual(tx, s, "slave session is used after the window")
+
+	orm.RollbackAll(testID)
+	orm.CloseAll(testID)
+
+	// write by the master session
+	orm.SetReadYourWrites(testID, true)
+	ms, err := orm.UseMasterSession(testID, row)
+	assert.Nil(err)
+	s, _ = orm.UseSlaveSession(testID, row)
+	assert.NotEqual(ms, s, "slave session is used before writing")
+	_, err = ms.Insert(row)
+	assert.Nil(err)
+	s, _ = orm.UseSlaveSession(testID, row)
+	assert.Equal(ms, s, "master session is used after writing by it")
+	orm.CloseAll(testID)
+
+	initTestDB()
+}
+
+func TestBindContext(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+	id := "bind context"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	orm.BindContext(ctx, id)
+	s, err := orm.Transaction(id, testUser{ID: 1})
+	assert.Nil(err)
+	s.Insert(&testUser{ID: 4})
+	_, err = orm.UseSlaveSession(id, testFoobar{})
+	assert.Nil(err)
+
+	// released by the next call after cancel
+	cancel()
+	assert.True(xsm.hasSessionList(id), "sessions are not closed in background")
+	_, err = orm.Transaction(id, testUser{ID: 1})
+	assert.Equal(context.Canceled, err)
+	assert.False(xsm.hasSessionList(id), "sessions are closed")
+	assert.EqualValues(3, countUserMaster(orm), "transaction is rolled back")
+
+	// closed before cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	orm.BindContext(ctx, id)
+	orm.CloseAll(id)
+	orm.SetAutoTransaction(id, true)
+	cancel()
+	_, err = orm.UseSlaveSession(id, testFoobar{})
+	assert.Nil(err)
+	assert.True(xsm.hasSessionList(id), "new SessionList is not closed")
+	orm.CloseAll(id)
+}
+
+func TestBindContextWhileQuerying(t *testing.T) {
+	assert := assert.New(t)
+	xse := &XormSessionManager{}
+	id := "bind context while querying"
+	db := &testEngine{}
+	s := &testShardSession{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	xse.BindContext(ctx, id)
+	xse.addSessionIntoList(id, db, s)
+
+	go cancel()
+	for {
+		sess, err := xse.slaveSession(context.Background(), id, nil, db, nil)
+		if err != nil {
+			assert.Equal(context.Canceled, err)
+			break
+		}
+		// the query runs on the session
+		assert.EqualValues(0, atomic.LoadInt32(&sess.(*testShardSession).closed), "the session is not closed while querying")
+	}
+	assert.EqualValues(1, atomic.LoadInt32(&s.closed))
+	assert.False(xse.hasSessionList(id))
+}
@@ -1,17 +1,29 @@
 package xorm
 
 import (
+	"context"
+
 	"github.com/evalphobia/wizard/errors"
 )
 
 // ForceNewTransaction returns the session with new transaction
+// the session must be closed after the transaction ends.
 func (xse *XormSessionManager) ForceNewTransaction(obj interface{}) (Session, error) {
-	db := xse.orm.Master(obj)
-	s, err := newSession(db, obj)
-	if err != nil {
+	return xse.ForceNewTransactionContext(context.Background(), obj)
+}
+
+// ForceNewTransactionContext returns the session with new transaction with the context
+func (xse *XormSessionManager) ForceNewTransactionContext(ctx context.Context, obj interface{}) (Session, error) {
+	defer xse.usage.pin()()
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	err = s.Begin()
+	db := xse.orm.Master(obj)
+	if db == nil {
+		return nil, xse.orm.nilDBErr(obj)
+	}
+	s := xse.openSession(db, nil)
+	err := withContext(ctx, s).Begin()
 	if err != nil {
 		return nil, err
 	}
@@ -20,66 +32,220 @@ func (xse *XormSessionManager) ForceNewTransaction(obj interface{}) (Session, er
 
 // Transaction returns the session with transaction for the db of given object
 func (xse *XormSessionManager) Transaction(id Identifier, obj interface{}) (Session, error) {
+	return xse.TransactionContext(context.Background(), id, obj)
+}
+
+// TransactionContext returns the session with transaction for the db of given object
+// when the context is done before committing, the transaction is rolled back by the next call for it or CommitAll()
+func (xse *XormSessionManager) TransactionContext(ctx context.Context, id Identifier, obj interface{}) (Session, error) {
+	defer xse.usage.pin()()
 	db := xse.orm.Master(obj)
-	return xse.transaction(id, obj, db)
+	s, err := xse.transaction(ctx, id, obj, db)
+	if err != nil {
+		return nil, err
+	}
+	return s, xse.migrationTransactions(ctx, id, obj, xse.orm.MigrationMasters(obj))
 }
 
 // TransactionByKey returns the session with transaction by shard key
 func (xse *XormSessionManager) TransactionByKey(id Identifier, obj interface{}, key interface{}) (Session, error) {
+	return xse.TransactionByKeyContext(context.Background(), id, obj, key)
+}
+
+// TransactionByKeyContext returns the session with transaction by shard key
+// when the context is done before committing, the transaction is rolled back by the next call for it or CommitAll()
+func (xse *XormSessionManager) TransactionByKeyContext(ctx context.Context, id Identifier, obj interface{}, key interface{}) (Session, error) {
+	defer xse.usage.pin()()
 	db := xse.orm.MasterByKey(obj, key)
-	return xse.transaction(id, obj, db)
+	if db == nil {
+		return nil, xse.orm.nilDBErrByKey(obj, key)
+	}
+	s, err := xse.transaction(ctx, id, obj, db)
+	if err != nil {
+		return nil, err
+	}
+	return s, xse.migrationTransactions(ctx, id, obj, xse.orm.MigrationMastersByKey(obj, key))
+}
+
+// migrationTransactions starts the transactions of the migration destinations
+// the writes to them are committed with the transaction of the current master by CommitAll().
+func (xse *XormSessionManager) migrationTransactions(ctx context.Context, id Identifier, obj interface{}, dbs []Engine) error {
+	for _, db := range dbs {
+		_, err := xse.transaction(ctx, id, obj, db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // transaction returns the session with transaction for the db of given object
 // if old transaction exists for the object, return it,
 // if no transaction exists for the object, create new one and return it
-func (xse *XormSessionManager) transaction(id Identifier, obj interface{}, db Engine) (Session, error) {
+func (xse *XormSessionManager) transaction(ctx context.Context, id Identifier, obj interface{}, db Engine) (Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if db == nil {
-		return nil, errors.NewErrNilDB(NormalizeValue(obj))
+		return nil, xse.orm.nilDBErr(obj)
 	}
+	if err := xse.checkBound(id); err != nil {
+		return nil, err
+	}
+	sl := xse.getOrCreateSessionList(id)
 	// use old transaction
-	s := xse.getTransactionFromList(id, db)
+	s := sl.getTransaction(db)
 	if s != nil {
-		return s, nil
+		if err := xse.rollbackIfDone(sl, db, s); err != nil {
+			return nil, err
+		}
+		return withContext(ctx, s), nil
 	}
 
 	// create new transaction
-	s = db.NewSession()
-	err := s.Begin()
-	if err != nil {
-		return nil, err
+	var err error
+	if sl.IsTwoPhaseCommit() {
+		s, err = xse.openBranch(ctx, sl, db)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s = withContext(ctx, xse.trackWrites(sl, db, xse.openTxSession(db)))
+		if err = s.Begin(); err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
 
 	// save created session with transaction
-	xse.addTransactionIntoList(id, db, s)
+	sl.addTransactionContext(ctx, db, s)
 	return s, nil
 }
 
-// getTransactionFromList returns the session with transaction for the db
-func (xse *XormSessionManager) getTransactionFromList(id Identifier, db interface{}) Session {
-	if !xse.hasSessionList(id) {
+// rollbackIfDone rolls back the transaction when its context is done
+// the cancelled transaction is not reused nor committed, and the error of the context is returned.
+// the manager checks it on its own calls, so no goroutine watches the context.
+func (xse *XormSessionManager) rollbackIfDone(sl *SessionList, db interface{}, s Session) error {
+	err := sl.transactionErr(db)
+	if err == nil {
 		return nil
 	}
-	sl := xse.getOrCreateSessionList(id)
-	return sl.getTransaction(db)
+	if sl.removeTransaction(db, s) {
+		xse.rollbackTransaction(sl, db, s)
+	}
+	return err
+}
+
+// openBranch returns the session of new branch of the global transaction in two-phase commit mode
+// the branch runs on the dedicated connection without the transaction of database/sql,
+// and the connection is closed when the branch ends.
+func (xse *XormSessionManager) openBranch(ctx context.Context, sl *SessionList, db Engine) (Session, error) {
+	c := xse.coordinator
+	if c == nil {
+		return nil, errors.NewErrNoCoordinator()
+	}
+	d, err := c.dialect(db)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.opener(db)
+	if err != nil {
+		return nil, err
+	}
+
+	xse.usage.acquire(db)
+	s := newTrackedSession(conn.NewSession(), func() {
+		conn.Close()
+		xse.usage.release(db)
+	})
+	s.tx = true
+
+	xid := sl.nextXID(c.newGTID)
+	if err := d.Start(withContext(ctx, s), xid); err != nil {
+		s.Close()
+		return nil, err
+	}
+	sl.addBranch(db, &branch{xid: xid, dialect: d})
+	return s, nil
 }
 
-// addTransactionIntoList saves the session with transaction for the db
-func (xse *XormSessionManager) addTransactionIntoList(id Identifier, db interface{}, s Session) {
+// newTxErr returns the error with the shard and the db of the transaction
+func (xse *XormSessionManager) newTxErr(db interface{}, err error) error {
+	return errors.NewNodeErr(xse.orm.Wiz.ShardIndex(db), db, err)
+}
+
+// rollbackTransaction rolls back the transaction and its branch of the global transaction
+func (xse *XormSessionManager) rollbackTransaction(sl *SessionList, db interface{}, s Session) error {
+	var err error
+	if b := sl.removeBranch(db); b != nil {
+		// the branch is not the transaction of database/sql
+		if b.prepared {
+			err = b.dialect.Rollback(s, b.xid)
+		} else {
+			err = b.dialect.Abort(s, b.xid)
+		}
+	} else {
+		err = s.Rollback()
+	}
+	endTransaction(s)
+	return err
+}
+
+// finishBranches removes all of the branches and unmarks the global transaction
+func (xse *XormSessionManager) finishBranches(sl *SessionList) {
+	gtid := sl.clearBranches()
+	if gtid != "" && xse.coordinator != nil {
+		xse.coordinator.finish(gtid)
+	}
+}
+
+// getTransactionFromList returns the session with transaction for the db
+// the transaction is rolled back and the error is returned when its context is done.
+func (xse *XormSessionManager) getTransactionFromList(id Identifier, db interface{}) (Session, error) {
+	if !xse.hasSessionList(id) {
+		return nil, nil
+	}
+	if err := xse.checkBound(id); err != nil {
+		return nil, err
+	}
 	sl := xse.getOrCreateSessionList(id)
-	sl.addTransaction(db, s)
+	s := sl.getTransaction(db)
+	if s == nil {
+		return nil, nil
+	}
+	if err := xse.rollbackIfDone(sl, db, s); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // AutoTransaction starts transaction for the session and store it
 // if not in the AutoTransaction mode, nothing happens
 // if old transaction exists, return it
 func (xse *XormSessionManager) AutoTransaction(id Identifier, obj interface{}, s Session) error {
+	return xse.AutoTransactionContext(context.Background(), id, obj, s)
+}
+
+// AutoTransactionContext starts transaction with the context for the session and store it
+// when the context is done before committing, the transaction is rolled back by the next call for it or CommitAll()
+func (xse *XormSessionManager) AutoTransactionContext(ctx context.Context, id Identifier, obj interface{}, s Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := xse.checkBound(id); err != nil {
+		return err
+	}
 	sl := xse.getOrCreateSessionList(id)
 	if !sl.IsAutoTransaction() {
 		return nil
 	}
 	db := xse.orm.Master(obj)
 	oldTx := sl.getTransaction(db)
+	if oldTx != nil {
+		if err := xse.rollbackIfDone(sl, db, oldTx); err != nil {
+			return err
+		}
+	}
 	switch {
 	case oldTx == s:
 		return nil
@@ -87,20 +253,102 @@ func (xse *XormSessionManager) AutoTransaction(id Identifier, obj interface{}, s
 		return errors.NewErrAnotherTx(NormalizeValue(obj))
 	}
 
-	err := s.Begin()
+	if sl.IsTwoPhaseCommit() {
+		// the given session cannot be moved onto the dedicated connection of the branch
+		return errors.NewErrTwoPhaseSession(NormalizeValue(obj))
+	}
+	err := withContext(ctx, s).Begin()
 	if err != nil {
 		return err
 	}
 
-	sl.addTransaction(db, s)
+	sl.addTransactionContext(ctx, db, s)
 	return nil
 }
 
+// RunInTransaction executes the function as a transaction unit and commits all of the transactions
+// see RunInTransactionContext() for the details.
+func (xse *XormSessionManager) RunInTransaction(id Identifier, fn func() error) error {
+	return xse.RunInTransactionContext(context.Background(), id, fn)
+}
+
+// RunInTransactionContext executes the function as a transaction unit and commits all of the transactions
+// the writes in the function run in the AutoTransaction mode, and all of the transactions are rolled back when the function fails.
+// the whole function is re-run by the retry policy when the error is retryable.
+// the error of CommitAll() for multiple dbs is not retried, because some of them may be already committed.
+// the connection error of CommitAll() is not retried either, because the result of COMMIT is unknown.
+func (xse *XormSessionManager) RunInTransactionContext(ctx context.Context, id Identifier, fn func() error) error {
+	sl := xse.getOrCreateSessionList(id)
+	if len(sl.getTransactions()) > 0 {
+		return errors.NewErrDuplicateTx()
+	}
+	defer sl.use()()
+
+	autoTx := sl.IsAutoTransaction()
+	sl.SetAutoTransaction(true)
+	defer sl.SetAutoTransaction(autoTx)
+
+	return xse.orm.retryPolicy.do(ctx, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := xse.runTransaction(id, fn); err != nil {
+			xse.RollbackAll(id)
+			return err
+		}
+
+		count := len(sl.getTransactions())
+		return commitErr(xse.CommitAllContext(ctx, id), count)
+	})
+}
+
+// commitErr returns the error of CommitAll() which is retryable only when nothing is committed
+// e.g. deadlock, serialization failure of the single db.
+func commitErr(err error, count int) error {
+	if err == nil {
+		return nil
+	}
+	if count > 1 || errors.IsConnectionError(err) {
+		return permanentErr{err}
+	}
+	return err
+}
+
+// runTransaction executes the function and rolls back all of the transactions on panic
+func (xse *XormSessionManager) runTransaction(id Identifier, fn func() error) error {
+	defer func() {
+		if r := recover(); r != nil {
+			xse.RollbackAll(id)
+			panic(r)
+		}
+	}()
+	return fn()
+}
+
+// inTransaction checks the identifier uses the transaction
+func (xse *XormSessionManager) inTransaction(id Identifier) bool {
+	sl, ok := xse.getSessionList(id)
+	if !ok {
+		return false
+	}
+	return sl.IsAutoTransaction() || len(sl.getTransactions()) > 0
+}
+
 // CommitAll commits all of transactions
 func (xse *XormSessionManager) CommitAll(id Identifier) error {
+	return xse.CommitAllContext(context.Background(), id)
+}
+
+// CommitAllContext commits all of transactions
+// when the context is done, the transactions not committed yet are rolled back
+// when the context of any transaction is done, all of the transactions are rolled back without committing.
+func (xse *XormSessionManager) CommitAllContext(ctx context.Context, id Identifier) error {
 	if !xse.hasSessionList(id) {
 		return nil
 	}
+	if err := xse.checkBound(id); err != nil {
+		return err
+	}
 
 	sl := xse.getOrCreateSessionList(id)
 	switch {
@@ -109,14 +357,36 @@ func (xse *XormSessionManager) CommitAll(id Identifier) error {
 	case sl.IsReadOnly():
 		return nil
 	}
+	if db, err := sl.doneTransaction(); err != nil {
+		xse.RollbackAll(id)
+		return errors.NewErrCommitAll([]error{xse.newTxErr(db, err)})
+	}
+
+	switch {
+	case sl.IsTwoPhaseCommit() && sl.hasBranches():
+		return xse.commitTwoPhase(ctx, sl)
+	case sl.hasCompensations():
+		return xse.commitWithCompensation(ctx, sl)
+	}
 
 	var errList []error
-	for _, s := range sl.getTransactions() {
+	for db, s := range sl.getTransactions() {
+		if err := ctx.Err(); err != nil {
+			errList = append(errList, xse.newTxErr(db, err))
+			if err := s.Rollback(); err != nil {
+				errList = append(errList, xse.newTxErr(db, err))
+			}
+			endTransaction(s)
+			continue
+		}
+
 		err := s.Commit()
 		if err != nil {
-			errList = append(errList, err)
+			errList = append(errList, xse.newTxErr(db, err))
+		} else {
+			xse.markDirty(sl, db)
 		}
-		s.Init()
+		endTransaction(s)
 	}
 
 	sl.clearTransactions()
@@ -139,19 +409,206 @@ func (xse *XormSessionManager) RollbackAll(id Identifier) error {
 	case sl.IsReadOnly():
 		return nil
 	}
+	return xse.rollbackSessionList(sl)
+}
 
+// rollbackSessionList aborts all of transactions in the SessionList
+func (xse *XormSessionManager) rollbackSessionList(sl *SessionList) error {
 	var errList []error
-	for _, s := range sl.getTransactions() {
-		err := s.Rollback()
+	for db, s := range sl.getTransactions() {
+		err := xse.rollbackTransaction(sl, db, s)
 		if err != nil {
-			errList = append(errList, err)
+			errList = append(errList, xse.newTxErr(db, err))
 		}
-		s.Init()
 	}
+	sl.takeCompensations()
 
 	sl.clearTransactions()
+	xse.finishBranches(sl)
 	if len(errList) > 0 {
 		return errors.NewErrRollbackAll(errList)
 	}
 	return nil
 }
+
+// Compensate registers the compensation for the write to the master db of the object
+// when CommitAll() partially fails, the compensations for the committed dbs are run in reverse order.
+// the write without transaction is treated as committed at the time of writing.
+func (xse *XormSessionManager) Compensate(id Identifier, obj interface{}, fn func(Session) error) error {
+	db := xse.orm.Master(obj)
+	if db == nil {
+		return xse.orm.nilDBErr(obj)
+	}
+	sl := xse.getOrCreateSessionList(id)
+	sl.addCompensation(db, fn)
+	return nil
+}
+
+// commitWithCompensation commits all of transactions in the order of the writes
+// when committing fails, the remaining transactions are rolled back,
+// and the compensations for the committed dbs are run in reverse order.
+func (xse *XormSessionManager) commitWithCompensation(ctx context.Context, sl *SessionList) error {
+	comps := sl.takeCompensations()
+	txs := sl.takeTransactions()
+
+	var committed, compensated, rolledBack, failed []interface{}
+	isCommitted := make(map[interface{}]bool)
+	// the writes without transaction are already committed
+	for _, c := range comps {
+		if _, ok := txs[c.db]; ok || isCommitted[c.db] {
+			continue
+		}
+		isCommitted[c.db] = true
+		committed = append(committed, c.db)
+	}
+
+	var errList []error
+	aborted := false
+	for _, db := range commitOrder(txs, comps) {
+		s := txs[db]
+		if !aborted {
+			if err := ctx.Err(); err != nil {
+				errList = append(errList, xse.newTxErr(db, err))
+				aborted = true
+			}
+		}
+		if aborted {
+			s.Rollback()
+			endTransaction(s)
+			rolledBack = append(rolledBack, db)
+			continue
+		}
+
+		err := s.Commit()
+		endTransaction(s)
+		if err != nil {
+			errList = append(errList, xse.newTxErr(db, err))
+			failed = append(failed, db)
+			aborted = true
+			continue
+		}
+		isCommitted[db] = true
+		committed = append(committed, db)
+		xse.markDirty(sl, db)
+	}
+	if !aborted {
+		return nil
+	}
+
+	// compensate in reverse order
+	compFailed := make(map[interface{}]bool)
+	for i := len(comps) - 1; i >= 0; i-- {
+		c := comps[i]
+		if !isCommitted[c.db] {
+			continue
+		}
+		if err := xse.runCompensation(c); err != nil {
+			errList = append(errList, xse.newTxErr(c.db, err))
+			compFailed[c.db] = true
+		}
+	}
+	hasComp := make(map[interface{}]bool)
+	for _, c := range comps {
+		hasComp[c.db] = true
+	}
+	for _, db := range committed {
+		switch {
+		case compFailed[db]:
+			failed = append(failed, db)
+		case hasComp[db]:
+			compensated = append(compensated, db)
+		}
+	}
+	return errors.NewErrCompensation(committed, compensated, rolledBack, failed, errList)
+}
+
+// commitOrder returns the dbs of the transactions in the order of the first compensation
+// the dbs without compensation follow them.
+func commitOrder(txs map[interface{}]Session, comps []compensation) []interface{} {
+	seen := make(map[interface{}]bool)
+	var list []interface{}
+	for _, c := range comps {
+		if _, ok := txs[c.db]; !ok || seen[c.db] {
+			continue
+		}
+		seen[c.db] = true
+		list = append(list, c.db)
+	}
+	for db := range txs {
+		if !seen[db] {
+			list = append(list, db)
+		}
+	}
+	return list
+}
+
+// runCompensation runs the compensation on the new session
+func (xse *XormSessionManager) runCompensation(c compensation) error {
+	s := xse.openSession(c.db, nil)
+	defer s.Close()
+	return c.fn(s)
+}
+
+// commitTwoPhase commits all of transactions by two-phase commit
+// all of the branches are prepared, and committed after the commit decision is saved into the log.
+// when preparing fails, all of the transactions are rolled back.
+// when committing fails after the decision, the branches are committed by Coordinator.Recover().
+// the transactions without branch (started before two-phase commit mode) are committed after the decision.
+func (xse *XormSessionManager) commitTwoPhase(ctx context.Context, sl *SessionList) error {
+	txs := sl.takeTransactions()
+	gtid := sl.getGTID()
+	defer xse.finishBranches(sl)
+	// compensations are not needed for the atomic commit
+	sl.takeCompensations()
+
+	// phase 1: prepare
+	var errList []error
+	for db, s := range txs {
+		b := sl.getBranch(db)
+		if b == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			errList = append(errList, xse.newTxErr(db, err))
+			break
+		}
+		if err := b.dialect.Prepare(s, b.xid); err != nil {
+			errList = append(errList, xse.newTxErr(db, err))
+			break
+		}
+		b.prepared = true
+	}
+	if len(errList) == 0 {
+		if err := xse.coordinator.log.Commit(gtid); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if len(errList) > 0 {
+		for db, s := range txs {
+			if err := xse.rollbackTransaction(sl, db, s); err != nil {
+				errList = append(errList, xse.newTxErr(db, err))
+			}
+		}
+		return errors.NewErrTwoPhasePrepare(gtid, errList)
+	}
+
+	// phase 2: commit
+	for db, s := range txs {
+		var err error
+		if b := sl.removeBranch(db); b != nil {
+			err = b.dialect.Commit(s, b.xid)
+		} else {
+			err = s.Commit()
+		}
+		if err != nil {
+			errList = append(errList, xse.newTxErr(db, err))
+		} else {
+			xse.markDirty(sl, db)
+		}
+		endTransaction(s)
+	}
+	if len(errList) > 0 {
+		return errors.NewErrTwoPhaseInDoubt(gtid, errList)
+	}
+	return xse.coordinator.log.Done(gtid)
+}
@@ -1,9 +1,16 @@
 package xorm
 
 import (
+	"context"
+	"database/sql/driver"
+	stderrors "errors"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
 )
 
 func TestForceNewTransaction(t *testing.T) {
@@ -261,3 +268,247 @@ func TestTransactionNilDB(t *testing.T) {
 	assert.NotNil(err)
 	assert.Nil(s)
 }
+
+func TestTransactionContext(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+	id := "transaction context"
+	sl := xsm.getOrCreateSessionList(id)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, err := orm.TransactionContext(ctx, id, testUser{ID: 1})
+	assert.Nil(err)
+	assert.NotNil(s)
+	assert.Len(sl.getTransactions(), 1, "transaction is added")
+
+	s.Insert(&testUser{ID: 4})
+	assert.EqualValues(4, countUserBySession(s), "users count after insert in the transaction")
+
+	// the transaction is rolled back by the next use after cancel
+	cancel()
+	assert.Len(sl.getTransactions(), 1, "transaction is not touched by background")
+	_, err = orm.TransactionContext(ctx, id, testUser{ID: 1})
+	assert.Equal(context.Canceled, err)
+	_, err = orm.Transaction(id, testUser{ID: 1})
+	assert.Equal(context.Canceled, err)
+	assert.Len(sl.getTransactions(), 0, "transaction is removed")
+	assert.EqualValues(3, countUserMaster(orm), "users count after cancel")
+	assert.Nil(orm.CommitAll(id))
+
+	// the transaction is rolled back by CommitAll after cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	s, err = orm.TransactionContext(ctx, id, testUser{ID: 1})
+	assert.Nil(err)
+	s.Insert(&testUser{ID: 4})
+	cancel()
+	err = orm.CommitAll(id)
+	assert.True(stderrors.Is(err, context.Canceled))
+	assert.Len(sl.getTransactions(), 0, "transaction is removed")
+	assert.EqualValues(3, countUserMaster(orm), "users count after cancel")
+	orm.CloseAll(id)
+}
+
+type testTxSession struct {
+	Session
+	rolledBack int32
+}
+
+func (s *testTxSession) Rollback() error {
+	atomic.AddInt32(&s.rolledBack, 1)
+	return nil
+}
+
+func (s *testTxSession) Init() {}
+
+func TestRollbackIfDone(t *testing.T) {
+	assert := assert.New(t)
+	xse := &XormSessionManager{}
+	sl := newSessionList()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &testTxSession{}
+	sl.addTransactionContext(ctx, "db", s)
+	assert.Nil(xse.rollbackIfDone(sl, "db", s))
+	assert.Equal(s, sl.getTransaction("db"))
+
+	cancel()
+	assert.EqualValues(0, atomic.LoadInt32(&s.rolledBack), "the transaction is not rolled back in background")
+	db, err := sl.doneTransaction()
+	assert.Equal("db", db)
+	assert.Equal(context.Canceled, err)
+
+	assert.Equal(context.Canceled, xse.rollbackIfDone(sl, "db", s))
+	assert.EqualValues(1, atomic.LoadInt32(&s.rolledBack))
+	assert.Nil(sl.getTransaction("db"))
+	_, err = sl.doneTransaction()
+	assert.Nil(err)
+}
+
+func TestCommitAllContext(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	id := "commit context"
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, err := orm.Transaction(id, testUser{ID: 1})
+	assert.Nil(err)
+	s.Insert(&testUser{ID: 4})
+
+	cancel()
+	err = orm.CommitAllContext(ctx, id)
+	assert.NotNil(err, "transactions are rolled back after cancel")
+	assert.EqualValues(3, countUserMaster(orm))
+
+	s, err = orm.Transaction(id, testUser{ID: 1})
+	assert.Nil(err)
+	s.Insert(&testUser{ID: 4})
+	err = orm.CommitAllContext(context.Background(), id)
+	assert.Nil(err)
+	assert.EqualValues(4, countUserMaster(orm))
+	orm.CloseAll(id)
+
+	initTestDB()
+}
+
+// failSession is Session which fails to commit
+type failSession struct {
+	Session
+}
+
+func (s *failSession) Commit() error {
+	return errors.NewErr(1, "commit error")
+}
+
+func (s *failSession) Rollback() error { return nil }
+func (s *failSession) Init()           {}
+
+func TestCommitAllCompensation(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	xsm := orm.XormSessionManager
+	id := "compensation"
+
+	user1 := testUser{ID: 1}
+	user500 := testUser{ID: 500}
+	dbA := orm.Master(user1)
+	dbB := orm.Master(user500)
+	dbFoobar := orm.Master(testFoobar{})
+	orm.SetAutoTransaction(id, true)
+	sl := xsm.getOrCreateSessionList(id)
+
+	var compensated []string
+	_, err := orm.InsertWithCompensation(id, user1, func(s Session) (int64, error) {
+		return s.Insert(&testUser{ID: 4, Name: "Daniel"})
+	}, func(s Session) error {
+		compensated = append(compensated, "A")
+		_, err := s.Delete(&testUser{ID: 4})
+		return err
+	})
+	assert.Nil(err)
+
+	// user B fails to commit
+	sl.addTransaction(dbB, &failSession{})
+	err = orm.Compensate(id, user500, func(s Session) error {
+		compensated = append(compensated, "B")
+		return nil
+	})
+	assert.Nil(err)
+
+	_, err = orm.InsertWithCompensation(id, testFoobar{}, func(s Session) (int64, error) {
+		return s.Insert(&testFoobar{ID: 100, Name: "foobar"})
+	}, func(s Session) error {
+		compensated = append(compensated, "foobar")
+		return nil
+	})
+	assert.Nil(err)
+
+	err = orm.CommitAll(id)
+	e, ok := err.(errors.ErrCompensation)
+	assert.True(ok)
+	assert.Equal([]interface{}{dbA}, e.Committed)
+	assert.Equal([]interface{}{dbA}, e.Compensated)
+	assert.Equal([]interface{}{dbFoobar}, e.RolledBack)
+	assert.Equal([]interface{}{dbB}, e.Failed)
+	assert.Equal([]string{"A"}, compensated, "only committed db is compensated")
+	assert.EqualValues(3, countUserMaster(orm), "users count after compensation")
+	assert.Len(sl.getTransactions(), 0, "transaction is removed")
+	assert.False(sl.hasCompensations(), "compensation is removed")
+
+	// success
+	orm.SetAutoTransaction(id, false)
+	_, err = orm.InsertWithCompensation(id, user1, func(s Session) (int64, error) {
+		return s.Insert(&testUser{ID: 4, Name: "Daniel"})
+	}, func(s Session) error {
+		compensated = append(compensated, "A")
+		return nil
+	})
+	assert.Nil(err)
+	assert.Nil(orm.CommitAll(id))
+	assert.Len(compensated, 1, "compensation is not run")
+	assert.False(sl.hasCompensations(), "compensation is removed")
+	orm.CloseAll(id)
+
+	initTestDB()
+}
+
+func TestRunInTransaction(t *testing.T) {
+	assert := assert.New(t)
+	wiz := testCreateWizard()
+	orm := New(wiz)
+	p := NewRetryPolicy(3)
+	p.SetBackoff(time.Millisecond, time.Millisecond)
+	orm.SetRetryPolicy(p)
+	id := "run in transaction"
+	insertFn := func(row *testUser) func(Session) (int64, error) {
+		return func(s Session) (int64, error) {
+			return s.Insert(row)
+		}
+	}
+
+	// retried as a whole
+	count := 0
+	err := orm.RunInTransaction(id, func() error {
+		count++
+		_, err := orm.Insert(id, testUser{ID: 1}, insertFn(&testUser{ID: 4}))
+		if err != nil {
+			return err
+		}
+		_, err = orm.Insert(id, testUser{ID: 500}, insertFn(&testUser{ID: 504}))
+		if err != nil {
+			return err
+		}
+		if count < 2 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(2, count)
+	assert.False(orm.IsAutoTransaction(id), "auto transaction mode is restored")
+	assert.EqualValues(4, countUserMaster(orm), "users count after commit")
+	assert.EqualValues(4, countUserMasterB(orm), "users count after commit")
+
+	// not retryable
+	count = 0
+	err = orm.RunInTransaction(id, func() error {
+		count++
+		orm.Insert(id, testUser{ID: 1}, insertFn(&testUser{ID: 5}))
+		return errors.NewErr(1, "error")
+	})
+	assert.Equal(errors.NewErr(1, "error"), err)
+	assert.Equal(1, count)
+	assert.EqualValues(4, countUserMaster(orm), "users count after rollback")
+
+	// nested transaction
+	orm.Transaction(id, testUser{ID: 1})
+	err = orm.RunInTransaction(id, func() error { return nil })
+	assert.Equal(errors.NewErrDuplicateTx(), err)
+	orm.RollbackAll(id)
+	orm.CloseAll(id)
+
+	initTestDB()
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/evalphobia/wizard"
+	"github.com/evalphobia/wizard/errors"
 	"github.com/go-xorm/xorm"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -176,3 +177,51 @@ func TestNew(t *testing.T) {
 	orm := New(wiz)
 	assert.Equal(wiz, orm.Wiz)
 }
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	f := "xorm_test_reload.db"
+	defer os.Remove(f)
+	oldEngine, _ := xorm.NewEngine("sqlite3", f)
+
+	wiz := wizard.NewWizard()
+	wiz.CreateCluster(testFoobar{}, oldEngine)
+	wiz.SetDefault(wizard.NewCluster(dbOther))
+	orm := New(wiz)
+	id := "reload identifier"
+
+	// hold the session of the old engine
+	_, err := orm.UseMasterSession(id, testFoobar{})
+	assert.Nil(err)
+
+	next := wizard.NewWizard()
+	next.CreateCluster(testFoobar{}, dbFoobarMaster)
+	next.SetDefault(wizard.NewCluster(dbOther))
+
+	done := make(chan error)
+	go func() {
+		done <- orm.Reload(next, 0)
+	}()
+	testWaitForIO()
+	assert.Equal(dbFoobarMaster, orm.Master(testFoobar{}), "new clusters are used after reloading")
+	assert.Nil(oldEngine.Ping(), "old engine is not closed while its session is used")
+
+	orm.CloseAll(id)
+	assert.Nil(<-done)
+	assert.NotNil(oldEngine.Ping(), "old engine is closed after draining")
+	assert.Nil(dbOther.Ping(), "engine used in the new clusters is not closed")
+
+	// timeout
+	oldEngine, _ = xorm.NewEngine("sqlite3", f)
+	wiz = wizard.NewWizard()
+	wiz.CreateCluster(testFoobar{}, oldEngine)
+	orm = New(wiz)
+	_, err = orm.UseMasterSession(id, testFoobar{})
+	assert.Nil(err)
+
+	err = orm.Reload(wizard.NewWizard(), 50*time.Millisecond)
+	assert.Equal(errors.NewErrDrainTimeout(1), err)
+	assert.NotNil(oldEngine.Ping())
+	orm.CloseAll(id)
+}
@@ -2,6 +2,7 @@ package xorm
 
 import (
 	"github.com/evalphobia/wizard"
+	"github.com/evalphobia/wizard/errors"
 )
 
 // XormWizard is struct for database selector
@@ -42,26 +43,96 @@ func (xwiz XormWizard) Masters(obj interface{}) []Engine {
 
 // Slave randomly returns one of the slave db for the given object
 func (xwiz XormWizard) Slave(obj interface{}) Engine {
-	db := xwiz.UseSlave(obj)
-	if db == nil {
-		return nil
-	}
-	return db.(Engine)
+	db, _ := xwiz.slaveNode(obj)
+	return db
 }
 
 // SlaveByKey randomly returns one of the slave db by shard key
 func (xwiz XormWizard) SlaveByKey(obj interface{}, key interface{}) Engine {
-	db := xwiz.UseSlaveByKey(obj, key)
-	if db == nil {
-		return nil
-	}
-	return db.(Engine)
+	db, _ := xwiz.slaveNodeByKey(obj, key)
+	return db
 }
 
 // Slaves randomly returns all of sharded slave db for the given object
 func (xwiz XormWizard) Slaves(obj interface{}) []Engine {
+	results, _ := xwiz.slaveNodes(obj)
+	return results
+}
+
+// slaveNode returns the slave db and its node for the given object
+func (xwiz XormWizard) slaveNode(obj interface{}) (Engine, *wizard.Node) {
+	return nodeEngine(xwiz.UseSlaveNode(obj))
+}
+
+// slaveNodeByKey returns the slave db and its node by shard key
+func (xwiz XormWizard) slaveNodeByKey(obj interface{}, key interface{}) (Engine, *wizard.Node) {
+	return nodeEngine(xwiz.UseSlaveNodeByKey(obj, key))
+}
+
+// slaveNodes returns all of sharded slave db and their nodes for the given object
+func (xwiz XormWizard) slaveNodes(obj interface{}) ([]Engine, []*wizard.Node) {
+	var results []Engine
+	var nodes []*wizard.Node
+	for _, node := range xwiz.UseSlaveNodes(obj) {
+		e, n := nodeEngine(node)
+		if e == nil {
+			continue
+		}
+		results = append(results, e)
+		nodes = append(nodes, n)
+	}
+	return results, nodes
+}
+
+// nodeEngine returns the engine of the node
+func nodeEngine(node *wizard.Node) (Engine, *wizard.Node) {
+	if node == nil {
+		return nil, nil
+	}
+	e, ok := node.DB().(Engine)
+	if !ok || e == nil {
+		return nil, nil
+	}
+	return e, node
+}
+
+// nilDBErr returns the error for the missing db of the given object
+// the error of the shard lookup is returned when it exists, e.g. ErrRangeOutOfRange
+func (xwiz XormWizard) nilDBErr(obj interface{}) error {
+	if _, err := xwiz.SelectErr(obj); err != nil {
+		return err
+	}
+	return errors.NewErrNilDB(NormalizeValue(obj))
+}
+
+// nilDBErrByKey returns the error for the missing db of the shard key
+// the error of the shard lookup is returned when it exists, e.g. ErrRangeOutOfRange
+func (xwiz XormWizard) nilDBErrByKey(obj interface{}, key interface{}) error {
+	if _, err := xwiz.SelectByKeyErr(obj, key); err != nil {
+		return err
+	}
+	return errors.NewErrNilDB(NormalizeValue(obj))
+}
+
+// MigrationMasters returns master dbs of the migration destinations for the given object
+func (xwiz XormWizard) MigrationMasters(obj interface{}) []Engine {
+	return enginesOf(xwiz.UseMigrationMasters(obj))
+}
+
+// MigrationMastersByKey returns master dbs of the migration destinations by shard key
+func (xwiz XormWizard) MigrationMastersByKey(obj interface{}, key interface{}) []Engine {
+	return enginesOf(xwiz.UseMigrationMastersByKey(obj, key))
+}
+
+// AllMigrationMasters returns master dbs of the destinations of all migrations for the given object
+func (xwiz XormWizard) AllMigrationMasters(obj interface{}) []Engine {
+	return enginesOf(xwiz.UseAllMigrationMasters(obj))
+}
+
+// enginesOf returns xorm engines of the dbs
+func enginesOf(dbs []interface{}) []Engine {
 	var results []Engine
-	for _, db := range xwiz.UseSlaves(obj) {
+	for _, db := range dbs {
 		e, ok := db.(Engine)
 		if !ok || e == nil {
 			continue
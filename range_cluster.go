@@ -0,0 +1,439 @@
+package wizard
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+// RangeCluster is struct for database cluster sharded by the range of raw key values
+// e.g. user id 0-10,000,000 on shard01, created_at in 2017 on shard02
+type RangeCluster struct {
+	List []*RangeSet // sharded database clusters; use RegisterRange() to add the ranges at runtime
+
+	mu         sync.RWMutex
+	validation atomic.Value // cached result of Validate()
+}
+
+// NewRangeCluster returns initialized empty RangeCluster
+func NewRangeCluster() *RangeCluster {
+	return &RangeCluster{}
+}
+
+// Master is dummy method for interface
+func (c *RangeCluster) Master() *Node {
+	return nil
+}
+
+// Masters returns all db masters from the sharded clusters
+func (c *RangeCluster) Masters() []*Node {
+	var result []*Node
+	for _, r := range c.ranges() {
+		if r.set == nil {
+			continue
+		}
+		result = append(result, r.set.Master())
+	}
+	return result
+}
+
+// Slave is dummy method for interface
+func (c *RangeCluster) Slave() *Node {
+	return nil
+}
+
+// Slaves randomly returns all db slaves from the sharded clusters
+func (c *RangeCluster) Slaves() []*Node {
+	var result []*Node
+	for _, r := range c.ranges() {
+		if r.set == nil {
+			continue
+		}
+		result = append(result, r.set.Slave())
+	}
+	return result
+}
+
+// Nodes returns all of the nodes in the sharded clusters
+func (c *RangeCluster) Nodes() []*Node {
+	var result []*Node
+	for _, r := range c.ranges() {
+		if r.set == nil {
+			continue
+		}
+		result = append(result, r.set.Nodes()...)
+	}
+	return result
+}
+
+// Validate checks the ranges are registered with the clusters
+// the result is cached until the ranges are changed by RegisterRange()
+func (c *RangeCluster) Validate() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if v, ok := c.validation.Load().(*validation); ok && v != nil {
+		return v.err
+	}
+	err := c.validate()
+	c.validation.Store(&validation{err: err})
+	return err
+}
+
+// validate checks the ranges
+// c.mu must be locked by the caller
+func (c *RangeCluster) validate() error {
+	if len(c.List) == 0 {
+		return errors.NewErrValidation("range", []error{errors.NewErrNoShards()})
+	}
+
+	var problems []error
+	for _, r := range c.List {
+		if r.set == nil {
+			problems = append(problems, errors.NewErrNilDB(r.String()))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.NewErrValidation("range", problems)
+	}
+	return nil
+}
+
+// SelectByKey returns sharded cluster by the raw key value
+// if the key is out of all ranges, nil is returned
+func (c *RangeCluster) SelectByKey(key interface{}) *StandardCluster {
+	s, _ := c.Lookup(key)
+	return s
+}
+
+// Lookup returns sharded cluster by the raw key value
+// if the key is out of all ranges, error is returned
+func (c *RangeCluster) Lookup(key interface{}) (*StandardCluster, error) {
+	v, ok := newRangeValue(key)
+	if !ok {
+		return nil, errors.NewErrRangeKeyType(key)
+	}
+	for _, r := range c.ranges() {
+		if rv, ok := r.value(); ok && !rv.isComparable(v) {
+			return nil, errors.NewErrRangeKeyType(key)
+		}
+		if r.contains(v) {
+			return r.set, nil
+		}
+	}
+	return nil, errors.NewErrRangeOutOfRange(key)
+}
+
+// RegisterRange adds cluster with the range of the key
+// e.g. RegisterRange(Closed(0), Open(10000000), cluster) for [0, 10000000)
+func (c *RangeCluster) RegisterRange(lower, upper Bound, s *StandardCluster) error {
+	r := &RangeSet{
+		lower: lower,
+		upper: upper,
+		set:   s,
+	}
+	err := r.check()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, old := range c.List {
+		if !old.isComparable(r) {
+			return errors.NewErrRangeKeyType(r.String())
+		}
+		if old.overlaps(r) {
+			return errors.NewErrRangeOverlapped(r.String())
+		}
+	}
+
+	// the list is replaced, so the readers can use the old list without the lock
+	list := make([]*RangeSet, len(c.List), len(c.List)+1)
+	copy(list, c.List)
+	c.List = append(list, r)
+	c.validation.Store((*validation)(nil))
+	return nil
+}
+
+// ranges returns the current range list
+func (c *RangeCluster) ranges() []*RangeSet {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.List
+}
+
+// Bound is the endpoint of the range
+type Bound struct {
+	value     rangeValue
+	inclusive bool
+	unbounded bool
+	invalid   bool
+}
+
+// Closed returns the bound which includes the value
+func Closed(v interface{}) Bound {
+	rv, ok := newRangeValue(v)
+	return Bound{
+		value:     rv,
+		inclusive: true,
+		invalid:   !ok,
+	}
+}
+
+// Open returns the bound which excludes the value
+func Open(v interface{}) Bound {
+	rv, ok := newRangeValue(v)
+	return Bound{
+		value:   rv,
+		invalid: !ok,
+	}
+}
+
+// Unbounded returns the bound which has no limit
+func Unbounded() Bound {
+	return Bound{unbounded: true}
+}
+
+// RangeSet is struct of range sharded cluster
+type RangeSet struct {
+	lower Bound
+	upper Bound
+	set   *StandardCluster
+}
+
+// Cluster returns the database cluster of the range
+func (r RangeSet) Cluster() *StandardCluster {
+	return r.set
+}
+
+// String returns the range in interval notation
+func (r RangeSet) String() string {
+	lower, upper := "(-inf", "+inf)"
+	if !r.lower.unbounded {
+		lower = "(" + r.lower.value.String()
+		if r.lower.inclusive {
+			lower = "[" + r.lower.value.String()
+		}
+	}
+	if !r.upper.unbounded {
+		upper = r.upper.value.String() + ")"
+		if r.upper.inclusive {
+			upper = r.upper.value.String() + "]"
+		}
+	}
+	return lower + ", " + upper
+}
+
+// InRange checks given value is in range of this shard
+func (r RangeSet) InRange(key interface{}) bool {
+	v, ok := newRangeValue(key)
+	return ok && r.contains(v)
+}
+
+// contains checks given value is in range of this shard
+func (r RangeSet) contains(v rangeValue) bool {
+	if !r.lower.unbounded {
+		if !r.lower.value.isComparable(v) {
+			return false
+		}
+		c := v.compare(r.lower.value)
+		if c < 0 || (c == 0 && !r.lower.inclusive) {
+			return false
+		}
+	}
+	if !r.upper.unbounded {
+		if !r.upper.value.isComparable(v) {
+			return false
+		}
+		c := v.compare(r.upper.value)
+		if c > 0 || (c == 0 && !r.upper.inclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// check checks the range is valid
+func (r RangeSet) check() error {
+	switch {
+	case r.lower.invalid:
+		return errors.NewErrRangeKeyType(r.lower.value.raw)
+	case r.upper.invalid:
+		return errors.NewErrRangeKeyType(r.upper.value.raw)
+	case r.lower.unbounded || r.upper.unbounded:
+		return nil
+	case !r.lower.value.isComparable(r.upper.value):
+		return errors.NewErrRangeKeyType(r.String())
+	}
+
+	c := r.lower.value.compare(r.upper.value)
+	if c > 0 || (c == 0 && !(r.lower.inclusive && r.upper.inclusive)) {
+		return errors.NewErrRangeInvalid(r.String())
+	}
+	return nil
+}
+
+// isComparable checks the key types of the ranges are comparable
+func (r RangeSet) isComparable(other *RangeSet) bool {
+	v1, ok1 := r.value()
+	v2, ok2 := other.value()
+	if !ok1 || !ok2 {
+		return true
+	}
+	return v1.isComparable(v2)
+}
+
+// value returns one of the bounded value of the range
+func (r RangeSet) value() (rangeValue, bool) {
+	switch {
+	case !r.lower.unbounded:
+		return r.lower.value, true
+	case !r.upper.unbounded:
+		return r.upper.value, true
+	}
+	return rangeValue{}, false
+}
+
+// overlaps checks the ranges are overlapped
+func (r RangeSet) overlaps(other *RangeSet) bool {
+	return !isBefore(r.upper, other.lower) && !isBefore(other.upper, r.lower)
+}
+
+// isBefore checks the upper bound is placed before the lower bound
+func isBefore(upper, lower Bound) bool {
+	if upper.unbounded || lower.unbounded {
+		return false
+	}
+	c := upper.value.compare(lower.value)
+	return c < 0 || (c == 0 && !(upper.inclusive && lower.inclusive))
+}
+
+type rangeKind int
+
+const (
+	rangeKindInt rangeKind = iota + 1
+	rangeKindFloat
+	rangeKindTime
+	rangeKindString
+)
+
+// rangeValue is comparable value for the range sharding
+type rangeValue struct {
+	kind rangeKind
+	i    int64
+	f    float64
+	t    time.Time
+	s    string
+	raw  interface{}
+}
+
+// newRangeValue converts the raw value into rangeValue
+func newRangeValue(v interface{}) (rangeValue, bool) {
+	rv := rangeValue{raw: v}
+	switch t := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		rv.kind = rangeKindInt
+		rv.i = getInt64(t)
+	case float32:
+		rv.kind = rangeKindFloat
+		rv.f = float64(t)
+	case float64:
+		rv.kind = rangeKindFloat
+		rv.f = t
+	case time.Time:
+		rv.kind = rangeKindTime
+		rv.t = t
+	case *time.Time:
+		if t == nil {
+			return rv, false
+		}
+		rv.kind = rangeKindTime
+		rv.t = *t
+	case string:
+		rv.kind = rangeKindString
+		rv.s = t
+	default:
+		return rv, false
+	}
+	return rv, true
+}
+
+// isNumber checks the value is integer or float
+func (v rangeValue) isNumber() bool {
+	return v.kind == rangeKindInt || v.kind == rangeKindFloat
+}
+
+// isComparable checks the values can be compared
+func (v rangeValue) isComparable(other rangeValue) bool {
+	if v.isNumber() && other.isNumber() {
+		return true
+	}
+	return v.kind == other.kind
+}
+
+// compare returns -1, 0 or 1 by comparing with the other value
+// the values must be comparable
+func (v rangeValue) compare(other rangeValue) int {
+	switch {
+	case v.kind == rangeKindInt && other.kind == rangeKindInt:
+		return compareInt64(v.i, other.i)
+	case v.isNumber():
+		return compareFloat64(v.float(), other.float())
+	case v.kind == rangeKindTime:
+		switch {
+		case v.t.Before(other.t):
+			return -1
+		case v.t.After(other.t):
+			return 1
+		}
+		return 0
+	}
+
+	switch {
+	case v.s < other.s:
+		return -1
+	case v.s > other.s:
+		return 1
+	}
+	return 0
+}
+
+// float returns the number as float64
+func (v rangeValue) float() float64 {
+	if v.kind == rangeKindInt {
+		return float64(v.i)
+	}
+	return v.f
+}
+
+// String returns string expression of the value
+func (v rangeValue) String() string {
+	if v.kind == rangeKindTime {
+		return v.t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v.raw)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat64(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
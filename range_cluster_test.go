@@ -0,0 +1,179 @@
+package wizard
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeClusterMasters(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewRangeCluster()
+	assert.Nil(c.Master(), "Master() should be always nil on RangeCluster")
+	assert.Nil(c.Slave(), "Slave() should be always nil on RangeCluster")
+	assert.Len(c.Masters(), 0)
+
+	c.RegisterRange(Closed(0), Open(100), testCreateCluster("shard01"))
+	c.RegisterRange(Closed(100), Unbounded(), testCreateCluster("shard02"))
+	assert.Len(c.Masters(), 2)
+	assert.Len(c.Slaves(), 2)
+}
+
+func TestRangeClusterSelectByKey(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewRangeCluster()
+	c.RegisterRange(Closed(0), Open(10000000), testCreateCluster("shard01"))
+	c.RegisterRange(Closed(10000000), Closed(19999999), testCreateCluster("shard02"))
+	c.RegisterRange(Open(19999999), Unbounded(), testCreateCluster("shard03"))
+
+	assert.Equal("shard01-master", c.SelectByKey(0).Master().DB())
+	assert.Equal("shard01-master", c.SelectByKey(int32(9999999)).Master().DB())
+	assert.Equal("shard02-master", c.SelectByKey(uint(10000000)).Master().DB())
+	assert.Equal("shard02-master", c.SelectByKey(19999999).Master().DB())
+	assert.Equal("shard03-master", c.SelectByKey(19999999.5).Master().DB())
+	assert.Equal("shard03-master", c.SelectByKey(int64(20000000)).Master().DB())
+	assert.Nil(c.SelectByKey(-1))
+	assert.Nil(c.SelectByKey("foobar"))
+}
+
+func TestRangeClusterLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	y2016 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	y2017 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	y2018 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := NewRangeCluster()
+	c.RegisterRange(Closed(y2016), Open(y2017), testCreateCluster("2016"))
+	c.RegisterRange(Closed(y2017), Open(y2018), testCreateCluster("2017"))
+
+	s, err := c.Lookup(y2016)
+	assert.Nil(err)
+	assert.Equal("2016-master", s.Master().DB())
+
+	s, err = c.Lookup(y2018.Add(-time.Nanosecond))
+	assert.Nil(err)
+	assert.Equal("2017-master", s.Master().DB())
+
+	s, err = c.Lookup(&y2017)
+	assert.Nil(err)
+	assert.Equal("2017-master", s.Master().DB())
+
+	s, err = c.Lookup(y2018)
+	assert.NotNil(err, "key is out of all ranges")
+	assert.Nil(s)
+
+	s, err = c.Lookup(1)
+	assert.NotNil(err, "key type is mismatched")
+	assert.Nil(s)
+
+	s, err = c.Lookup(struct{}{})
+	assert.NotNil(err, "key type is unsupported")
+	assert.Nil(s)
+}
+
+func TestRangeClusterRegisterRange(t *testing.T) {
+	assert := assert.New(t)
+
+	var err error
+	c := NewRangeCluster()
+
+	err = c.RegisterRange(Closed(10), Open(20), testCreateCluster("shard01"))
+	assert.Nil(err)
+
+	err = c.RegisterRange(Closed(20), Closed(20), testCreateCluster("shard02"))
+	assert.Nil(err, "single point range")
+
+	err = c.RegisterRange(Open(30), Open(30), testCreateCluster("invalid"))
+	assert.NotNil(err, "empty range")
+
+	err = c.RegisterRange(Closed(50), Closed(40), testCreateCluster("invalid"))
+	assert.NotNil(err, "lower bound is greater than upper bound")
+
+	err = c.RegisterRange(Closed(0), Closed(10), testCreateCluster("overlapped"))
+	assert.NotNil(err, "range is overlapped")
+
+	err = c.RegisterRange(Unbounded(), Closed(15), testCreateCluster("overlapped"))
+	assert.NotNil(err, "range is overlapped")
+
+	err = c.RegisterRange(Closed(0), Closed(100), testCreateCluster("overlapped"))
+	assert.NotNil(err, "range contains the other range")
+
+	err = c.RegisterRange(Closed("a"), Closed("b"), testCreateCluster("string"))
+	assert.NotNil(err, "key type is mismatched")
+
+	err = c.RegisterRange(Closed(struct{}{}), Unbounded(), testCreateCluster("struct"))
+	assert.NotNil(err, "key type is unsupported")
+
+	err = c.RegisterRange(Unbounded(), Open(10), testCreateCluster("shard03"))
+	assert.Nil(err)
+	assert.Len(c.List, 3)
+}
+
+func TestRangeClusterRegisterRangeWhileLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewRangeCluster()
+	c.RegisterRange(Closed(0), Open(10), testCreateCluster("shard00"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 100; i++ {
+			c.RegisterRange(Closed(i*10), Open((i+1)*10), testCreateCluster("shard"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s, err := c.Lookup(5)
+		assert.Nil(err)
+		assert.NotNil(s)
+		c.Masters()
+		c.Validate()
+	}
+	wg.Wait()
+	assert.Len(c.List, 100)
+}
+
+func TestRangeClusterValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewRangeCluster()
+	assert.NotNil(c.Validate(), "no ranges")
+
+	err := c.RegisterRange(Closed(0), Open(100), testCreateCluster("shard01"))
+	assert.Nil(err)
+	assert.Nil(c.Validate(), "the cached result is cleared by RegisterRange()")
+
+	err = c.RegisterRange(Closed(100), Open(200), nil)
+	assert.Nil(err)
+	assert.NotNil(c.Validate(), "nil cluster")
+}
+
+func TestRangeSetString(t *testing.T) {
+	assert := assert.New(t)
+
+	r := RangeSet{lower: Closed(1), upper: Open(10)}
+	assert.Equal("[1, 10)", r.String())
+
+	r = RangeSet{lower: Unbounded(), upper: Closed("z")}
+	assert.Equal("(-inf, z]", r.String())
+
+	r = RangeSet{lower: Open(1.5), upper: Unbounded()}
+	assert.Equal("(1.5, +inf)", r.String())
+}
+
+func TestRangeSetInRange(t *testing.T) {
+	assert := assert.New(t)
+
+	r := RangeSet{lower: Closed("b"), upper: Open("d")}
+	assert.False(r.InRange("a"))
+	assert.True(r.InRange("b"))
+	assert.True(r.InRange("c"))
+	assert.False(r.InRange("d"))
+	assert.False(r.InRange(1))
+}
@@ -20,9 +20,19 @@ func NormalizeValue(p interface{}) interface{} {
 }
 
 func getShardKey(p interface{}) int64 {
+	v := getShardKeyValue(p)
+	if v == nil {
+		return 0
+	}
+	return getInt64(v)
+}
+
+// getShardKeyValue returns the raw value of the shard key field
+// if the shard key is not found, nil is returned
+func getShardKeyValue(p interface{}) interface{} {
 	v := toValue(p)
 	if v.Kind() != reflect.Struct {
-		return 0
+		return nil
 	}
 	return getShardKeyFromStruct(p, TagName)
 }
@@ -45,7 +55,7 @@ func toType(p interface{}) reflect.Type {
 	return t
 }
 
-func getShardKeyFromStruct(p interface{}, tagName string) int64 {
+func getShardKeyFromStruct(p interface{}, tagName string) interface{} {
 	t := toType(p)
 	values := toValue(p)
 	for i, max := 0, t.NumField(); i < max; i++ {
@@ -64,9 +74,9 @@ func getShardKeyFromStruct(p interface{}, tagName string) int64 {
 			continue
 		}
 		v := values.Field(i)
-		return getInt64(v.Interface())
+		return v.Interface()
 	}
-	return 0
+	return nil
 }
 
 // parseTag returns the first tag value of the struct field
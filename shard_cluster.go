@@ -1,24 +1,48 @@
 package wizard
 
 import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
 	"github.com/evalphobia/wizard/errors"
 )
 
 // ShardCluster is struct for sharded database cluster
 type ShardCluster struct {
-	List     []*ShardSet // sharded database clusters
+	List     []*ShardSet // sharded database clusters; use the methods to change the shards at runtime
 	slotsize int64
+	strategy ShardStrategy
+
+	mu         sync.RWMutex
+	migrations []*Migration
+	validation atomic.Value // cached result of Validate()
+}
+
+// validation is the cached result of Validate()
+type validation struct {
+	err error
+}
+
+// NewShardCluster returns the ShardCluster with the shard strategy
+func NewShardCluster(strategy ShardStrategy) *ShardCluster {
+	c := &ShardCluster{strategy: strategy}
+	if m, ok := strategy.(*ModuloStrategy); ok {
+		c.slotsize = m.slotsize
+	}
+	return c
 }
 
 // Master is dummy method for interface
-func (c ShardCluster) Master() *Node {
+func (c *ShardCluster) Master() *Node {
 	return nil
 }
 
 // Masters returns all db masters from the sharded clusters
-func (c ShardCluster) Masters() []*Node {
+func (c *ShardCluster) Masters() []*Node {
 	var result []*Node
-	for _, s := range c.List {
+	for _, s := range c.shards() {
 		if s.set == nil {
 			continue
 		}
@@ -28,14 +52,14 @@ func (c ShardCluster) Masters() []*Node {
 }
 
 // Slave is dummy method for interface
-func (c ShardCluster) Slave() *Node {
+func (c *ShardCluster) Slave() *Node {
 	return nil
 }
 
 // Slaves randomly returns all db slaves from the sharded clusters
-func (c ShardCluster) Slaves() []*Node {
+func (c *ShardCluster) Slaves() []*Node {
 	var result []*Node
-	for _, s := range c.List {
+	for _, s := range c.shards() {
 		if s.set == nil {
 			continue
 		}
@@ -44,57 +68,485 @@ func (c ShardCluster) Slaves() []*Node {
 	return result
 }
 
-// SelectByKey returns sharded cluster by shard key
-func (c ShardCluster) SelectByKey(key interface{}) *StandardCluster {
-	i := getInt64(key)
-	mod := i % c.slotsize
-	for _, shard := range c.List {
-		if shard.InRange(mod) {
-			return shard.set
+// Nodes returns all of the nodes in the shards and the migration targets
+func (c *ShardCluster) Nodes() []*Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var result []*Node
+	for _, ss := range c.List {
+		if ss.set == nil {
+			continue
 		}
+		result = append(result, ss.set.Nodes()...)
 	}
-	return nil
+	for _, m := range c.migrations {
+		if m.to == nil {
+			continue
+		}
+		result = append(result, m.to.Nodes()...)
+	}
+	return result
+}
+
+// SelectByKey returns sharded cluster by shard key
+func (c *ShardCluster) SelectByKey(key interface{}) *StandardCluster {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	shard := c.getStrategy().Select(key)
+	if shard == nil {
+		return nil
+	}
+	return shard.set
 }
 
 // RegisterShard adds cluster with hash slot range(min and max)
 func (c *ShardCluster) RegisterShard(min, max int64, s *StandardCluster) error {
-	err := c.checkOverlapped(min, max)
+	return c.addShard(&ShardSet{
+		min:      min,
+		max:      max,
+		hasSlots: true,
+		set:      s,
+	})
+}
+
+// RegisterNamedShard adds cluster with the name for the strategy without hash slot range
+// e.g. HashRingStrategy
+func (c *ShardCluster) RegisterNamedShard(name string, s *StandardCluster) error {
+	return c.addShard(&ShardSet{
+		name: name,
+		set:  s,
+	})
+}
+
+// addShard adds the shard into the strategy and the list
+func (c *ShardCluster) addShard(ss *ShardSet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.getStrategy().Add(ss)
 	if err != nil {
 		return err
 	}
 
-	ss := &ShardSet{
-		min: min,
-		max: max,
-		set: s,
+	c.List = append(c.List, ss)
+	c.resetValidation()
+	return nil
+}
+
+// SplitShard splits the shard which contains the slot into two shards
+// the slots from the given slot to the max of the shard are reassigned to the new cluster
+func (c *ShardCluster) SplitShard(slot int64, s *StandardCluster) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isSlotStrategy() {
+		return errors.NewErrUnsupportedStrategy(fmt.Sprintf("%T", c.strategy))
 	}
-	err = ss.checkSlotSize(c.slotsize)
+
+	var list []*ShardSet
+	found := false
+	for _, ss := range c.List {
+		if !ss.hasRange() || !ss.InRange(slot) || ss.min == slot {
+			list = append(list, ss)
+			continue
+		}
+
+		found = true
+		list = append(list,
+			&ShardSet{min: ss.min, max: slot - 1, hasSlots: true, set: ss.set},
+			&ShardSet{min: slot, max: ss.max, hasSlots: true, set: s},
+		)
+	}
+	if !found {
+		return errors.NewErrNoShard(slot)
+	}
+	return c.replaceShards(list)
+}
+
+// ReassignSlots reassigns the slot range(min and max) to the cluster
+// the shards overlapped with the range are shrunk or removed
+func (c *ShardCluster) ReassignSlots(min, max int64, s *StandardCluster) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isSlotStrategy() {
+		return errors.NewErrUnsupportedStrategy(fmt.Sprintf("%T", c.strategy))
+	}
+
+	list, err := c.reassignedShards(min, max, s)
 	if err != nil {
 		return err
 	}
+	return c.replaceShards(list)
+}
 
-	c.List = append(c.List, ss)
+// RemoveShard removes all of the shards for the cluster
+// the slots of the removed shards are not mapped to any cluster
+func (c *ShardCluster) RemoveShard(s *StandardCluster) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var list []*ShardSet
+	for _, ss := range c.List {
+		if ss.set == s {
+			continue
+		}
+		list = append(list, ss)
+	}
+	if len(list) == len(c.List) {
+		return errors.NewErrNoShard(fmt.Sprintf("cluster=%p", s))
+	}
+	return c.replaceShards(list)
+}
+
+// reassignedShards returns new shard list with the slot range reassigned to the cluster
+func (c *ShardCluster) reassignedShards(min, max int64, s *StandardCluster) ([]*ShardSet, error) {
+	newSet := &ShardSet{min: min, max: max, hasSlots: true, set: s}
+	err := newSet.checkSlotRange(c.slotsize)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*ShardSet
+	for _, ss := range c.List {
+		if !ss.hasRange() || ss.max < min || max < ss.min {
+			list = append(list, ss)
+			continue
+		}
+
+		// keep the remainder of the shard
+		if ss.min < min {
+			list = append(list, &ShardSet{min: ss.min, max: min - 1, hasSlots: true, set: ss.set})
+		}
+		if max < ss.max {
+			list = append(list, &ShardSet{min: max + 1, max: ss.max, hasSlots: true, set: ss.set})
+		}
+	}
+	return append(list, newSet), nil
+}
+
+// replaceShards rebuilds the strategy with the list and replaces the shards
+// c.mu must be locked by the caller
+func (c *ShardCluster) replaceShards(list []*ShardSet) error {
+	var strategy ShardStrategy
+	switch v := c.strategy.(type) {
+	case nil:
+		strategy = &ModuloStrategy{slotsize: c.slotsize}
+	case *ModuloStrategy:
+		strategy = NewModuloStrategy(v.slotsize)
+	case *HashRingStrategy:
+		strategy = NewHashRingStrategy(v.replicas)
+	default:
+		return errors.NewErrUnsupportedStrategy(fmt.Sprintf("%T", v))
+	}
+
+	for _, ss := range list {
+		err := strategy.Add(ss)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.strategy != nil {
+		c.strategy = strategy
+	}
+	c.List = list
+	c.resetValidation()
 	return nil
 }
 
+// Validate checks the shards cover all of the slots without overlapping
+// the result is cached until the shards are changed
+func (c *ShardCluster) Validate() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if v, ok := c.validation.Load().(*validation); ok && v != nil {
+		return v.err
+	}
+	err := c.validate()
+	c.validation.Store(&validation{err: err})
+	return err
+}
+
+// resetValidation clears the cached result of Validate()
+// c.mu must be locked by the caller
+func (c *ShardCluster) resetValidation() {
+	c.validation.Store((*validation)(nil))
+}
+
+// validate checks the shards
+// c.mu must be locked by the caller
+func (c *ShardCluster) validate() error {
+	if len(c.List) == 0 {
+		return errors.NewErrValidation("shard", []error{errors.NewErrNoShards()})
+	}
+
+	var problems []error
+	for _, ss := range c.List {
+		if ss.set == nil {
+			problems = append(problems, errors.NewErrNilDB(ss.Name()))
+		}
+	}
+	if c.isSlotStrategy() {
+		problems = append(problems, c.validateSlots()...)
+	}
+
+	if len(problems) > 0 {
+		return errors.NewErrValidation("shard", problems)
+	}
+	return nil
+}
+
+// validateSlots returns the gaps and overlaps of the hash slot ranges
+func (c *ShardCluster) validateSlots() []error {
+	list := make([]*ShardSet, len(c.List))
+	copy(list, c.List)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].min < list[j].min
+	})
+
+	var problems []error
+	var next int64 // the first slot not covered yet
+	var prev *ShardSet
+	for _, ss := range list {
+		if prev != nil && ss.min <= prev.max {
+			problems = append(problems, errors.NewErrShardOverlapped(prev.Name(), ss.Name()))
+		}
+		if ss.min > next {
+			problems = append(problems, errors.NewErrSlotGap(next, ss.min-1))
+		}
+		if ss.max+1 > next {
+			next = ss.max + 1
+		}
+		if prev == nil || ss.max > prev.max {
+			prev = ss
+		}
+	}
+	if next < c.slotsize {
+		problems = append(problems, errors.NewErrSlotGap(next, c.slotsize-1))
+	}
+	return problems
+}
+
+// StartMigration starts the migration of the slot range(min and max) to the cluster
+// while migrating, reads are served by the current shard and
+// writes should be sent to the both of current and new shard (see MigrationTargets)
+func (c *ShardCluster) StartMigration(min, max int64, s *StandardCluster) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isSlotStrategy() {
+		return errors.NewErrUnsupportedStrategy(fmt.Sprintf("%T", c.strategy))
+	}
+	m := &Migration{min: min, max: max, to: s}
+	err := (&ShardSet{min: min, max: max}).checkSlotRange(c.slotsize)
+	if err != nil {
+		return err
+	}
+	for _, old := range c.migrations {
+		if old.overlaps(m) {
+			return errors.NewErrMigrationOverlapped(fmt.Sprintf("%d-%d", min, max))
+		}
+	}
+
+	c.migrations = append(c.migrations, m)
+	return nil
+}
+
+// CompleteMigration reassigns the slot range of the migration to the new cluster and finishes it
+func (c *ShardCluster) CompleteMigration(min, max int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.findMigration(min, max)
+	if i < 0 {
+		return errors.NewErrNoMigration(fmt.Sprintf("%d-%d", min, max))
+	}
+
+	m := c.migrations[i]
+	list, err := c.reassignedShards(m.min, m.max, m.to)
+	if err != nil {
+		return err
+	}
+	err = c.replaceShards(list)
+	if err != nil {
+		return err
+	}
+	c.removeMigration(i)
+	return nil
+}
+
+// AbortMigration cancels the migration without changing the shards
+func (c *ShardCluster) AbortMigration(min, max int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.findMigration(min, max)
+	if i < 0 {
+		return errors.NewErrNoMigration(fmt.Sprintf("%d-%d", min, max))
+	}
+	c.removeMigration(i)
+	return nil
+}
+
+// MigrationTargets returns the new clusters of the migrations for the shard key
+// writes for the key should be sent to these clusters in addition to SelectByKey()
+func (c *ShardCluster) MigrationTargets(key interface{}) []*StandardCluster {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.migrations) == 0 {
+		return nil
+	}
+
+	var current *StandardCluster
+	if shard := c.getStrategy().Select(key); shard != nil {
+		current = shard.set
+	}
+
+	slot := getInt64(key) % c.slotsize
+	var result []*StandardCluster
+	for _, m := range c.migrations {
+		if m.InRange(slot) && m.to != current {
+			result = append(result, m.to)
+		}
+	}
+	return result
+}
+
+// AllMigrationTargets returns the new clusters of all of the migrations in progress
+// the clusters which are already the current shards are not included.
+func (c *ShardCluster) AllMigrationTargets() []*StandardCluster {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	current := make(map[*StandardCluster]bool)
+	for _, shard := range c.List {
+		current[shard.set] = true
+	}
+
+	var result []*StandardCluster
+	for _, m := range c.migrations {
+		if current[m.to] {
+			continue
+		}
+		current[m.to] = true
+		result = append(result, m.to)
+	}
+	return result
+}
+
+// findMigration returns the index of the migration
+func (c *ShardCluster) findMigration(min, max int64) int {
+	for i, m := range c.migrations {
+		if m.min == min && m.max == max {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeMigration removes the migration by the index
+func (c *ShardCluster) removeMigration(i int) {
+	list := make([]*Migration, 0, len(c.migrations)-1)
+	list = append(list, c.migrations[:i]...)
+	c.migrations = append(list, c.migrations[i+1:]...)
+}
+
+// isSlotStrategy checks the strategy uses the hash slot
+func (c *ShardCluster) isSlotStrategy() bool {
+	switch c.strategy.(type) {
+	case nil, *ModuloStrategy:
+		return true
+	}
+	return false
+}
+
+// shards returns the current shard list
+func (c *ShardCluster) shards() []*ShardSet {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.List
+}
+
+// getStrategy returns the shard strategy
+// if the strategy is not set, ModuloStrategy with the registered shards is used
+func (c *ShardCluster) getStrategy() ShardStrategy {
+	if c.strategy != nil {
+		return c.strategy
+	}
+	return &ModuloStrategy{
+		slotsize: c.slotsize,
+		list:     c.List,
+	}
+}
+
 // checkOverlapped checks the hash slot range is not overlapped among the shards
 func (c *ShardCluster) checkOverlapped(min, max int64) error {
-	for _, ss := range c.List {
+	return checkOverlapped(c.List, min, max)
+}
+
+// checkOverlapped checks the hash slot range is not overlapped among the list
+func checkOverlapped(list []*ShardSet, min, max int64) error {
+	for _, ss := range list {
 		switch {
 		case ss.InRange(min):
 			return errors.NewErrSlotMinOverlapped(min)
 		case ss.InRange(max):
 			return errors.NewErrSlotMaxOverlapped(max)
+		case min <= ss.min && ss.max <= max:
+			return errors.NewErrSlotRangeOverlapped(min, max)
 		}
 	}
 	return nil
 }
 
-// ShardSet is struct of sharded cluster
-type ShardSet struct {
+// Migration is the slot range moving to the new cluster
+type Migration struct {
 	min int64
 	max int64
-	set *StandardCluster
+	to  *StandardCluster
+}
+
+// InRange checks given number is in range of this migration
+func (m Migration) InRange(v int64) bool {
+	return m.min <= v && v <= m.max
+}
+
+// overlaps checks the slot ranges are overlapped
+func (m Migration) overlaps(other *Migration) bool {
+	return m.min <= other.max && other.min <= m.max
+}
+
+// ShardSet is struct of sharded cluster
+type ShardSet struct {
+	name     string
+	min      int64
+	max      int64
+	hasSlots bool
+	set      *StandardCluster
+}
+
+// Name returns the name of the shard
+// if the name is not set, the hash slot range is used
+func (ss ShardSet) Name() string {
+	if ss.name != "" {
+		return ss.name
+	}
+	return fmt.Sprintf("%d-%d", ss.min, ss.max)
+}
+
+// Cluster returns the database cluster of the shard
+func (ss ShardSet) Cluster() *StandardCluster {
+	return ss.set
+}
+
+// hasRange checks the shard has hash slot range
+func (ss ShardSet) hasRange() bool {
+	return ss.hasSlots
 }
 
 // InRange checks given number is in range of this shard
@@ -113,6 +565,14 @@ func (ss ShardSet) checkSlotSize(slot int64) error {
 	return nil
 }
 
+// checkSlotRange checks given range is valid within slotsize
+func (ss ShardSet) checkSlotRange(slot int64) error {
+	if ss.min > ss.max {
+		return errors.NewErrRangeInvalid(ss.Name())
+	}
+	return ss.checkSlotSize(slot)
+}
+
 // isMinAboveZero checks given number is not minus
 func (ss ShardSet) isMinAboveZero() bool {
 	return ss.min >= 0
@@ -1,9 +1,12 @@
 package wizard
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
 )
 
 func testCreateCluster(prefix string) *StandardCluster {
@@ -124,6 +127,11 @@ func TestShardClusterCheckOverlapped(t *testing.T) {
 	err = s.checkOverlapped(0, 5)
 	assert.NotNil(err, "Slot max is already registered")
 
+	err = s.checkOverlapped(0, 9)
+	assert.NotNil(err, "Slot range contains the registered shard")
+	err = s.RegisterShard(4, 7, testCreateCluster("shard02"))
+	assert.NotNil(err)
+
 	err = s.checkOverlapped(0, 4)
 	assert.Nil(err)
 	err = s.checkOverlapped(7, 9)
@@ -193,3 +201,280 @@ func TestShardSetIsMinAboveZero(t *testing.T) {
 	assert.True(ShardSet{min: 0}.isMinAboveZero())
 	assert.True(ShardSet{min: 1}.isMinAboveZero())
 }
+
+func TestNewShardCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+
+	s = NewShardCluster(NewModuloStrategy(10))
+	assert.Equal(int64(10), s.slotsize)
+
+	s = NewShardCluster(NewHashRingStrategy(10))
+	assert.Equal(int64(0), s.slotsize)
+}
+
+func TestShardClusterRegisterNamedShard(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+	var err error
+
+	s = &ShardCluster{slotsize: 10}
+	err = s.RegisterNamedShard("shard01", testCreateCluster("shard01"))
+	assert.NotNil(err, "Slot range is required for modulo strategy")
+	assert.Len(s.List, 0)
+
+	s = NewShardCluster(NewHashRingStrategy(10))
+	err = s.RegisterNamedShard("shard01", testCreateCluster("shard01"))
+	assert.Nil(err)
+	err = s.RegisterNamedShard("shard02", testCreateCluster("shard02"))
+	assert.Nil(err)
+	err = s.RegisterNamedShard("shard02", testCreateCluster("shard03"))
+	assert.NotNil(err, "Shard name is already registered")
+	assert.Len(s.List, 2)
+	assert.Len(s.Masters(), 2)
+
+	c := s.SelectByKey("foobar")
+	assert.NotNil(c)
+	assert.Equal(c, s.SelectByKey("foobar"))
+}
+
+func TestShardSetName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("shard01", ShardSet{name: "shard01"}.Name())
+	assert.Equal("10-20", ShardSet{min: 10, max: 20}.Name())
+}
+
+func TestShardClusterSplitShard(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+	var err error
+
+	s = &ShardCluster{slotsize: 10}
+	shard01 := testCreateCluster("shard01")
+	shard02 := testCreateCluster("shard02")
+	s.RegisterShard(0, 9, shard01)
+
+	err = s.SplitShard(5, shard02)
+	assert.Nil(err)
+	assert.Len(s.List, 2)
+	assert.Equal(shard01, s.SelectByKey(4))
+	assert.Equal(shard02, s.SelectByKey(5))
+	assert.Equal(shard02, s.SelectByKey(9))
+
+	err = s.SplitShard(5, shard01)
+	assert.NotNil(err, "Slot is already the edge of the shard")
+
+	err = s.SplitShard(10, shard01)
+	assert.NotNil(err, "Slot is out of range")
+
+	s = NewShardCluster(NewModuloStrategy(10))
+	s.RegisterShard(0, 9, shard01)
+	err = s.SplitShard(1, shard02)
+	assert.Nil(err)
+	assert.Equal(shard01, s.SelectByKey(0))
+	assert.Equal(shard02, s.SelectByKey(1))
+
+	s = NewShardCluster(NewHashRingStrategy(10))
+	s.RegisterNamedShard("shard01", shard01)
+	err = s.SplitShard(1, shard02)
+	assert.NotNil(err, "HashRingStrategy does not support slot operation")
+}
+
+func TestShardClusterReassignSlots(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+	var err error
+
+	s = &ShardCluster{slotsize: 10}
+	shard01 := testCreateCluster("shard01")
+	shard02 := testCreateCluster("shard02")
+	shard03 := testCreateCluster("shard03")
+	s.RegisterShard(0, 4, shard01)
+	s.RegisterShard(5, 9, shard02)
+
+	err = s.ReassignSlots(3, 6, shard03)
+	assert.Nil(err)
+	assert.Len(s.List, 3)
+	assert.Equal(shard01, s.SelectByKey(2))
+	assert.Equal(shard03, s.SelectByKey(3))
+	assert.Equal(shard03, s.SelectByKey(6))
+	assert.Equal(shard02, s.SelectByKey(7))
+
+	err = s.ReassignSlots(0, 9, shard01)
+	assert.Nil(err)
+	assert.Len(s.List, 1)
+	assert.Equal(shard01, s.SelectByKey(7))
+
+	err = s.ReassignSlots(5, 10, shard01)
+	assert.NotNil(err, "Slotsize cannot be greater equal than slotsize")
+	err = s.ReassignSlots(6, 5, shard01)
+	assert.NotNil(err, "min must be less equal than max")
+}
+
+func TestShardClusterRemoveShard(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+	var err error
+
+	s = &ShardCluster{slotsize: 10}
+	shard01 := testCreateCluster("shard01")
+	shard02 := testCreateCluster("shard02")
+	s.RegisterShard(0, 4, shard01)
+	s.RegisterShard(5, 9, shard02)
+
+	err = s.RemoveShard(shard02)
+	assert.Nil(err)
+	assert.Len(s.List, 1)
+	assert.Nil(s.SelectByKey(5))
+
+	err = s.RemoveShard(shard02)
+	assert.NotNil(err, "Shard is already removed")
+
+	s = NewShardCluster(NewHashRingStrategy(10))
+	s.RegisterNamedShard("shard01", shard01)
+	s.RegisterNamedShard("shard02", shard02)
+	err = s.RemoveShard(shard02)
+	assert.Nil(err)
+	for i := 0; i < 100; i++ {
+		assert.Equal(shard01, s.SelectByKey(i))
+	}
+}
+
+func TestShardClusterMigration(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+	var err error
+
+	s = &ShardCluster{slotsize: 10}
+	shard01 := testCreateCluster("shard01")
+	shard02 := testCreateCluster("shard02")
+	s.RegisterShard(0, 9, shard01)
+	assert.Nil(s.MigrationTargets(1))
+
+	err = s.StartMigration(5, 9, shard02)
+	assert.Nil(err)
+	err = s.StartMigration(0, 5, shard02)
+	assert.NotNil(err, "Migration is overlapped")
+	err = s.StartMigration(5, 10, shard02)
+	assert.NotNil(err, "Slotsize cannot be greater equal than slotsize")
+
+	assert.Equal(shard01, s.SelectByKey(5), "reads are served by the current shard")
+	assert.Equal([]*StandardCluster{shard02}, s.MigrationTargets(5))
+	assert.Equal([]*StandardCluster{shard02}, s.MigrationTargets(19))
+	assert.Nil(s.MigrationTargets(4))
+	assert.Equal([]*StandardCluster{shard02}, s.AllMigrationTargets())
+
+	err = s.CompleteMigration(5, 9)
+	assert.Nil(err)
+	assert.Equal(shard02, s.SelectByKey(5))
+	assert.Nil(s.MigrationTargets(5))
+	assert.Nil(s.AllMigrationTargets())
+
+	err = s.CompleteMigration(5, 9)
+	assert.NotNil(err, "Migration is already completed")
+
+	err = s.StartMigration(0, 4, shard02)
+	assert.Nil(err)
+	assert.Nil(s.AllMigrationTargets(), "the current shards are not included")
+	err = s.AbortMigration(0, 4)
+	assert.Nil(err)
+	assert.Nil(s.MigrationTargets(1))
+	assert.Equal(shard01, s.SelectByKey(1))
+	assert.NotNil(s.AbortMigration(0, 4))
+
+	s = NewShardCluster(NewHashRingStrategy(10))
+	err = s.StartMigration(0, 4, shard02)
+	assert.NotNil(err, "HashRingStrategy does not support slot operation")
+}
+
+func TestShardClusterConcurrentResharding(t *testing.T) {
+	s := &ShardCluster{slotsize: 10}
+	shard01 := testCreateCluster("shard01")
+	shard02 := testCreateCluster("shard02")
+	s.RegisterShard(0, 9, shard01)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if s.SelectByKey(j) == nil {
+					t.Error("SelectByKey() should not return nil while resharding")
+					return
+				}
+				s.Masters()
+				s.MigrationTargets(j)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		s.ReassignSlots(0, 4, shard02)
+		s.ReassignSlots(0, 4, shard01)
+	}
+	wg.Wait()
+}
+
+func TestShardClusterValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewShardCluster(NewModuloStrategy(10))
+	err := s.Validate()
+	assert.NotNil(err, "Empty shard list")
+	e, ok := err.(errors.ErrValidation)
+	assert.True(ok)
+	assert.Len(e.Problems, 1)
+	assert.Equal(errors.NewErrNoShards(), e.Problems[0])
+
+	s.RegisterShard(2, 3, testCreateCluster("shard01"))
+	s.RegisterShard(6, 8, testCreateCluster("shard02"))
+	e = s.Validate().(errors.ErrValidation)
+	assert.Equal([]error{
+		errors.NewErrSlotGap(0, 1),
+		errors.NewErrSlotGap(4, 5),
+		errors.NewErrSlotGap(9, 9),
+	}, e.Problems)
+
+	s.RegisterShard(0, 1, testCreateCluster("shard03"))
+	s.RegisterShard(4, 5, testCreateCluster("shard04"))
+	s.RegisterShard(9, 9, testCreateCluster("shard05"))
+	assert.Nil(s.Validate())
+
+	// overlapped shards given directly
+	s = &ShardCluster{slotsize: 10}
+	s.List = []*ShardSet{
+		{min: 0, max: 9, hasSlots: true, set: testCreateCluster("shard01")},
+		{min: 3, max: 5, hasSlots: true, set: testCreateCluster("shard02")},
+	}
+	e = s.Validate().(errors.ErrValidation)
+	assert.Equal([]error{errors.NewErrShardOverlapped("0-9", "3-5")}, e.Problems)
+
+	// hash ring
+	s = NewShardCluster(NewHashRingStrategy(10))
+	assert.NotNil(s.Validate())
+	s.RegisterNamedShard("shard01", testCreateCluster("shard01"))
+	assert.Nil(s.Validate())
+}
+
+func TestShardClusterValidateCache(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewShardCluster(NewModuloStrategy(10))
+	s.RegisterShard(0, 4, testCreateCluster("shard01"))
+	assert.NotNil(s.Validate())
+	assert.NotNil(s.Validate(), "cached result")
+
+	shard02 := testCreateCluster("shard02")
+	s.RegisterShard(5, 9, shard02)
+	assert.Nil(s.Validate(), "cache is cleared after registration")
+
+	s.RemoveShard(shard02)
+	assert.NotNil(s.Validate(), "cache is cleared after removal")
+}
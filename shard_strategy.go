@@ -0,0 +1,136 @@
+package wizard
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/evalphobia/wizard/errors"
+)
+
+const defaultVirtualNodes = 100
+
+// ShardStrategy is interface for mapping the shard key to the shard
+type ShardStrategy interface {
+	Add(*ShardSet) error
+	Select(key interface{}) *ShardSet
+}
+
+// ModuloStrategy maps the shard key onto the hash slot ranges by `key % slotsize`
+type ModuloStrategy struct {
+	slotsize int64
+	list     []*ShardSet
+}
+
+// NewModuloStrategy returns initialized ModuloStrategy
+func NewModuloStrategy(slot int64) *ModuloStrategy {
+	if slot < 1 {
+		slot = 1
+	}
+	return &ModuloStrategy{slotsize: slot}
+}
+
+// Add adds the shard with hash slot range
+func (m *ModuloStrategy) Add(ss *ShardSet) error {
+	if !ss.hasRange() {
+		return errors.NewErrSlotRangeRequired(ss.Name())
+	}
+	err := checkOverlapped(m.list, ss.min, ss.max)
+	if err != nil {
+		return err
+	}
+	err = ss.checkSlotSize(m.slotsize)
+	if err != nil {
+		return err
+	}
+
+	m.list = append(m.list, ss)
+	return nil
+}
+
+// Select returns the shard whose range contains the hash slot of the key
+func (m *ModuloStrategy) Select(key interface{}) *ShardSet {
+	mod := getInt64(key) % m.slotsize
+	for _, shard := range m.list {
+		if shard.InRange(mod) {
+			return shard
+		}
+	}
+	return nil
+}
+
+// HashRingStrategy maps the shard key onto the consistent hash ring with virtual nodes
+// adding a shard moves only a small fraction of keys to the new shard
+type HashRingStrategy struct {
+	replicas int
+
+	mu     sync.RWMutex
+	points []uint64
+	owners map[uint64]*ShardSet
+}
+
+// NewHashRingStrategy returns initialized HashRingStrategy
+// replicas is the number of virtual nodes per shard
+func NewHashRingStrategy(replicas int) *HashRingStrategy {
+	if replicas < 1 {
+		replicas = defaultVirtualNodes
+	}
+	return &HashRingStrategy{
+		replicas: replicas,
+		owners:   make(map[uint64]*ShardSet),
+	}
+}
+
+// Add adds the virtual nodes of the shard onto the ring
+// the position of the nodes are decided by the name of the shard
+func (h *HashRingStrategy) Add(ss *ShardSet) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := ss.Name()
+	for _, owner := range h.owners {
+		if owner.Name() == name {
+			return errors.NewErrShardAlreadyRegistered(name)
+		}
+	}
+
+	for i := 0; i < h.replicas; i++ {
+		p := ringHash(fmt.Sprintf("%s#%d", name, i))
+		if _, ok := h.owners[p]; ok {
+			continue
+		}
+		h.owners[p] = ss
+		h.points = append(h.points, p)
+	}
+	sort.Slice(h.points, func(i, j int) bool {
+		return h.points[i] < h.points[j]
+	})
+	return nil
+}
+
+// Select returns the shard of the first virtual node clockwise from the hash of the key
+func (h *HashRingStrategy) Select(key interface{}) *ShardSet {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.points) == 0 {
+		return nil
+	}
+
+	p := ringHash(key)
+	i := sort.Search(len(h.points), func(i int) bool {
+		return h.points[i] >= p
+	})
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// ringHash converts any value to the position on the hash ring
+// md5 is used for even distribution like ketama
+func ringHash(v interface{}) uint64 {
+	sum := md5.Sum([]byte(fmt.Sprint(v)))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,87 @@
+package wizard
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuloStrategyAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewModuloStrategy(10)
+	assert.Nil(m.Add(&ShardSet{min: 0, max: 4, hasSlots: true}))
+	assert.Len(m.list, 1)
+
+	assert.NotNil(m.Add(&ShardSet{min: 4, max: 9, hasSlots: true}), "Slot min is already registered")
+	assert.NotNil(m.Add(&ShardSet{min: 5, max: 10, hasSlots: true}), "Slotsize cannot be greater equal than slotsize")
+	assert.NotNil(m.Add(&ShardSet{name: "shard"}), "Slot range is required")
+	assert.Len(m.list, 1)
+}
+
+func TestModuloStrategySelect(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewModuloStrategy(2)
+	assert.Nil(m.Select(0))
+
+	ss1 := &ShardSet{min: 0, max: 0, hasSlots: true}
+	ss2 := &ShardSet{min: 1, max: 1, hasSlots: true}
+	m.Add(ss1)
+	m.Add(ss2)
+	assert.Equal(ss1, m.Select(0))
+	assert.Equal(ss2, m.Select(1))
+	assert.Equal(ss1, m.Select(2))
+	assert.Equal(ss2, m.Select(3))
+}
+
+func TestHashRingStrategyAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHashRingStrategy(10)
+	assert.Nil(h.Add(&ShardSet{name: "shard01"}))
+	assert.Len(h.points, 10)
+	assert.Nil(h.Add(&ShardSet{name: "shard02"}))
+	assert.Len(h.points, 20)
+	assert.NotNil(h.Add(&ShardSet{name: "shard01"}), "Shard name is already registered")
+
+	for i := 1; i < len(h.points); i++ {
+		assert.True(h.points[i-1] < h.points[i], "points should be sorted")
+	}
+}
+
+func TestHashRingStrategySelect(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHashRingStrategy(0)
+	assert.Nil(h.Select(1))
+
+	ss1 := &ShardSet{name: "shard01"}
+	ss2 := &ShardSet{name: "shard02"}
+	h.Add(ss1)
+	h.Add(ss2)
+
+	before := make(map[int]*ShardSet)
+	for i := 0; i < 1000; i++ {
+		ss := h.Select(i)
+		assert.NotNil(ss)
+		assert.Equal(ss, h.Select(i), "same key should be mapped onto the same shard")
+		before[i] = ss
+	}
+
+	// add new shard
+	ss3 := &ShardSet{name: "shard03"}
+	h.Add(ss3)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		ss := h.Select(i)
+		if ss == before[i] {
+			continue
+		}
+		assert.Equal(ss3, ss, "keys should be moved onto the new shard only")
+		moved++
+	}
+	assert.True(moved > 0)
+	assert.True(moved < 600, fmt.Sprintf("too many keys are moved: %d", moved))
+}
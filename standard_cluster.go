@@ -3,6 +3,8 @@ package wizard
 import (
 	"math/rand"
 	"time"
+
+	"github.com/evalphobia/wizard/errors"
 )
 
 func init() {
@@ -12,8 +14,10 @@ func init() {
 
 // StandardCluster is struct for typical(non-sharded) database cluster
 type StandardCluster struct {
-	master *Node
-	slaves []*Node
+	master   *Node
+	slaves   []*Node
+	balancer Balancer
+	maxLag   time.Duration
 }
 
 // NewCluster returns the StandardCluster initialized with master database
@@ -32,13 +36,24 @@ func (c StandardCluster) Masters() []*Node {
 	return []*Node{c.master}
 }
 
-// Slave ramdomly returns the slave database.
-// if no slave is registered, master is returned
+// Slave returns the slave database selected by the balancer.
+// if balancer is not set, the slave is randomly selected.
+// if no healthy slave is registered, master is returned
+// if all of the slaves are over the max replication lag, master is returned
 func (c StandardCluster) Slave() *Node {
-	if len(c.slaves) == 0 {
+	slaves := c.availableSlaves()
+	if len(slaves) == 0 {
+		return c.master
+	}
+	if c.balancer == nil {
+		return slaves[rand.Intn(len(slaves))]
+	}
+
+	node := c.balancer.Select(slaves)
+	if node == nil {
 		return c.master
 	}
-	return c.slaves[rand.Intn(len(c.slaves))]
+	return node
 }
 
 // Slaves is dummy method for interface
@@ -46,17 +61,77 @@ func (c StandardCluster) Slaves() []*Node {
 	return []*Node{c.Slave()}
 }
 
+// Nodes returns master and all of the slaves
+func (c StandardCluster) Nodes() []*Node {
+	nodes := make([]*Node, 0, len(c.slaves)+1)
+	if c.master != nil {
+		nodes = append(nodes, c.master)
+	}
+	return append(nodes, c.slaves...)
+}
+
+// availableSlaves returns the slaves except unhealthy or lagging ones
+func (c StandardCluster) availableSlaves() []*Node {
+	for i, node := range c.slaves {
+		if c.isAvailable(node) {
+			continue
+		}
+
+		// create new list only when unavailable slave exists
+		list := make([]*Node, i, len(c.slaves))
+		copy(list, c.slaves[:i])
+		for _, n := range c.slaves[i+1:] {
+			if c.isAvailable(n) {
+				list = append(list, n)
+			}
+		}
+		return list
+	}
+	return c.slaves
+}
+
+// isAvailable checks the slave node can be used for reading
+func (c StandardCluster) isAvailable(n *Node) bool {
+	return n.IsHealthy() && !n.isLagging(c.maxLag)
+}
+
+// Validate checks the master is registered
+func (c *StandardCluster) Validate() error {
+	if c.master == nil || c.master.db == nil {
+		return errors.NewErrValidation("standard", []error{errors.NewErrNoMaster()})
+	}
+	return nil
+}
+
 // SelectByKey is dummy method for interface
 func (c *StandardCluster) SelectByKey(v interface{}) *StandardCluster {
 	return c
 }
 
+// SetBalancer sets the balancer for slave selection
+func (c *StandardCluster) SetBalancer(b Balancer) {
+	c.balancer = b
+}
+
+// SetMaxLag sets the max replication lag of the slaves
+// the slave over the max lag is not selected. zero value disables this limit.
+func (c *StandardCluster) SetMaxLag(d time.Duration) {
+	c.maxLag = d
+}
+
 // RegisterMaster set new master node
 func (c *StandardCluster) RegisterMaster(db interface{}) {
-	c.master = &Node{db: db}
+	c.master = NewNode(db)
 }
 
 // RegisterSlave adds slave node
 func (c *StandardCluster) RegisterSlave(db interface{}) {
-	c.slaves = append(c.slaves, &Node{db: db})
+	c.slaves = append(c.slaves, NewNode(db))
+}
+
+// RegisterSlaveWithWeight adds slave node with the weight for WeightedBalancer
+func (c *StandardCluster) RegisterSlaveWithWeight(db interface{}, weight int) {
+	node := NewNode(db)
+	node.weight = weight
+	c.slaves = append(c.slaves, node)
 }
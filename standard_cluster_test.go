@@ -79,6 +79,27 @@ func TestStandardClusterSlave(t *testing.T) {
 	t.Error("Slave() should return different nodes")
 }
 
+func TestStandardClusterSlaveWithBalancer(t *testing.T) {
+	assert := assert.New(t)
+
+	var c *StandardCluster
+
+	c = NewCluster("master")
+	c.SetBalancer(NewRoundRobinBalancer())
+	assert.Equal("master", c.Slave().DB(), "Slave() shoud equal to master when no slaves")
+
+	c.RegisterSlave("slave01")
+	c.RegisterSlave("slave02")
+	assert.Equal("slave01", c.Slave().DB())
+	assert.Equal("slave02", c.Slave().DB())
+	assert.Equal("slave01", c.Slave().DB())
+
+	c = NewCluster("master")
+	c.SetBalancer(NewWeightedBalancer())
+	c.RegisterSlaveWithWeight("slave01", 0)
+	assert.Equal("master", c.Slave().DB(), "Slave() shoud equal to master when balancer returns nil")
+}
+
 func TestStandardClusterSelectByKey(t *testing.T) {
 	assert := assert.New(t)
 
@@ -122,3 +143,30 @@ func TestStandardClusterRegisterSlave(t *testing.T) {
 	assert.Equal("db3", c.slaves[1].db)
 	assert.Equal("db4", c.slaves[2].db)
 }
+
+func TestStandardClusterRegisterSlaveWithWeight(t *testing.T) {
+	assert := assert.New(t)
+
+	var c *StandardCluster
+
+	c = NewCluster("db")
+	c.RegisterSlave("db2")
+	c.RegisterSlaveWithWeight("db3", 5)
+
+	assert.Equal(1, c.slaves[0].Weight())
+	assert.Equal(5, c.slaves[1].Weight())
+}
+
+func TestStandardClusterNodes(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster("db")
+	c.RegisterSlave("db2")
+	c.RegisterSlave("db3")
+
+	nodes := c.Nodes()
+	assert.Len(nodes, 3)
+	assert.Equal(c.master, nodes[0])
+	assert.Equal(c.slaves[0], nodes[1])
+	assert.Equal(c.slaves[1], nodes[2])
+}
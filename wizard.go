@@ -1,6 +1,11 @@
 package wizard
 
 import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
 	"github.com/evalphobia/wizard/errors"
 )
 
@@ -14,57 +19,325 @@ type Cluster interface {
 }
 
 // Wizard manages all the database cluster for your app
+// the clusters are stored as the immutable snapshot, reading is lock-free and writing is copy-on-write.
 type Wizard struct {
+	mu       sync.Mutex   // lock for writing the topology
+	topology atomic.Value // *topology
+	strict   int32
+}
+
+// topology is the snapshot of the clusters and name mapping
+type topology struct {
 	clusters       map[interface{}]Cluster
 	defaultCluster Cluster
 }
 
+func newTopology() *topology {
+	return &topology{
+		clusters: make(map[interface{}]Cluster),
+	}
+}
+
+// clone returns the copy of the topology
+func (t *topology) clone() *topology {
+	newT := &topology{
+		clusters:       make(map[interface{}]Cluster, len(t.clusters)+1),
+		defaultCluster: t.defaultCluster,
+	}
+	for k, v := range t.clusters {
+		newT.clusters[k] = v
+	}
+	return newT
+}
+
+// validator is interface for the cluster which can validate its configuration
+type validator interface {
+	Validate() error
+}
+
 // NewWizard returns initialized empty Wizard
 func NewWizard() *Wizard {
-	return &Wizard{
-		clusters: make(map[interface{}]Cluster),
+	w := &Wizard{}
+	w.topology.Store(newTopology())
+	return w
+}
+
+// load returns the current snapshot of the clusters
+// the snapshot must not be changed
+func (w *Wizard) load() *topology {
+	t, ok := w.topology.Load().(*topology)
+	if !ok {
+		return newTopology()
 	}
+	return t
+}
+
+// update changes the copy of the current snapshot and stores it
+// the changes are stored even if fn returns error
+func (w *Wizard) update(fn func(*topology) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.load().clone()
+	err := fn(t)
+	w.topology.Store(t)
+	return err
 }
 
 // SetDefault set default cluster
 // if default is set, this cluster acts like catchall, handles all the other tables.
 func (w *Wizard) SetDefault(c Cluster) {
-	w.defaultCluster = c
+	w.update(func(t *topology) error {
+		t.defaultCluster = c
+		return nil
+	})
 }
 
 // HasDefault checks default cluster is set or not
 func (w *Wizard) HasDefault() bool {
-	return w.defaultCluster != nil
+	return w.load().defaultCluster != nil
+}
+
+// Reload replaces all of the clusters and name mapping with the ones of the given Wizard atomically
+// the nodes which are not used in the new clusters are returned to drain and close them.
+func (w *Wizard) Reload(next *Wizard) []*Node {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	oldTopology := w.load()
+	newTopology := next.load()
+	w.topology.Store(newTopology)
+	return removedNodes(oldTopology, newTopology)
+}
+
+// Nodes returns all of the nodes in the clusters
+func (w *Wizard) Nodes() []*Node {
+	return w.load().nodes()
+}
+
+// Masters returns all of the master nodes in the clusters
+func (w *Wizard) Masters() []*Node {
+	return w.load().masters()
+}
+
+// ShardIndex returns the index of the shard in the cluster whose master is the db
+// -1 is returned when the db is not the master of any cluster.
+func (w *Wizard) ShardIndex(db interface{}) int {
+	return w.load().shardIndex(db)
+}
+
+// shardIndex returns the index of the master node of the db in the cluster
+// the clusters are searched in the fixed order, so the same index is returned when the db is the master of multiple clusters.
+func (t *topology) shardIndex(db interface{}) int {
+	for _, c := range t.sortedClusters() {
+		for i, n := range c.Masters() {
+			if n != nil && n.DB() == db {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// sortedClusters returns the clusters in the fixed order
+// the sharded clusters come first, then the clusters are ordered by the name, and the default cluster is the last.
+func (t *topology) sortedClusters() []Cluster {
+	keys := make([]interface{}, 0, len(t.clusters))
+	for k := range t.clusters {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := clusterRank(t.clusters[keys[i]]), clusterRank(t.clusters[keys[j]])
+		if ri != rj {
+			return ri < rj
+		}
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+
+	clusters := make([]Cluster, 0, len(keys)+1)
+	for _, k := range keys {
+		clusters = append(clusters, t.clusters[k])
+	}
+	if t.defaultCluster != nil {
+		clusters = append(clusters, t.defaultCluster)
+	}
+	return clusters
+}
+
+// clusterRank returns the order of the cluster type in sortedClusters()
+func clusterRank(c Cluster) int {
+	switch c.(type) {
+	case *ShardCluster:
+		return 0
+	case *RangeCluster, *DirectoryCluster:
+		return 1
+	}
+	return 2
+}
+
+// nodes returns all of the nodes in the clusters without duplication
+func (t *topology) nodes() []*Node {
+	return t.collectNodes(clusterNodes)
+}
+
+// masters returns all of the master nodes in the clusters without duplication
+func (t *topology) masters() []*Node {
+	return t.collectNodes(func(c Cluster) []*Node {
+		return c.Masters()
+	})
+}
+
+// collectNodes returns the nodes of all clusters without duplication
+func (t *topology) collectNodes(fn func(Cluster) []*Node) []*Node {
+	seen := make(map[*Node]struct{})
+	var result []*Node
+	for _, c := range t.sortedClusters() {
+		for _, n := range fn(c) {
+			if _, ok := seen[n]; ok || n == nil {
+				continue
+			}
+			seen[n] = struct{}{}
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// removedNodes returns the nodes whose db is not used in the new topology
+func removedNodes(oldTopology, newTopology *topology) []*Node {
+	used := make(map[interface{}]struct{})
+	for _, n := range newTopology.nodes() {
+		used[n.DB()] = struct{}{}
+	}
+
+	var result []*Node
+	for _, n := range oldTopology.nodes() {
+		if _, ok := used[n.DB()]; ok {
+			continue
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// clusterNodes returns all of the nodes in the cluster
+func clusterNodes(c Cluster) []*Node {
+	if v, ok := c.(interface {
+		Nodes() []*Node
+	}); ok {
+		return v.Nodes()
+	}
+	return append(c.Masters(), c.Slaves()...)
+}
+
+// SetStrict sets strict mode
+// on strict mode, the invalid cluster is not used until its configuration is fixed.
+func (w *Wizard) SetStrict(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&w.strict, v)
+}
+
+// IsStrict checks strict mode is enabled or not
+func (w *Wizard) IsStrict() bool {
+	return atomic.LoadInt32(&w.strict) == 1
+}
+
+// Validate checks the configuration of all the clusters
+func (w *Wizard) Validate() error {
+	t := w.load()
+	names := make([]interface{}, 0, len(t.clusters))
+	for name := range t.clusters {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return fmt.Sprint(names[i]) < fmt.Sprint(names[j])
+	})
+
+	var problems []error
+	for _, name := range names {
+		if err := validateCluster(name, t.clusters[name]); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if t.defaultCluster != nil {
+		if err := validateCluster("default", t.defaultCluster); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.NewErrValidation("wizard", problems)
+	}
+	return nil
+}
+
+// validateCluster validates the cluster and set the name into the error
+func validateCluster(name interface{}, c Cluster) error {
+	v, ok := c.(validator)
+	if !ok {
+		return nil
+	}
+
+	err := v.Validate()
+	if e, ok := err.(errors.ErrValidation); ok {
+		return errors.NewErrValidation(name, e.Problems)
+	}
+	return err
 }
 
 // getCluster returns the cluster by name mapping
+// on strict mode, the invalid cluster is not returned
 func (w *Wizard) getCluster(obj interface{}) Cluster {
-	c, ok := w.clusters[NormalizeValue(obj)]
+	c, _ := w.lookupCluster(obj)
+	return c
+}
+
+// lookupCluster returns the cluster by name mapping
+// on strict mode, the invalid cluster is not returned and ErrValidation is returned instead.
+// the clusters cache the result of the validation, so it's not checked on every query.
+func (w *Wizard) lookupCluster(obj interface{}) (Cluster, error) {
+	t := w.load()
+	name := NormalizeValue(obj)
+	c, ok := t.clusters[name]
 	switch {
 	case ok:
-		return c
-	case w.HasDefault():
-		return w.defaultCluster
+	case t.defaultCluster != nil:
+		c = t.defaultCluster
 	default:
-		return nil
+		return nil, errors.NewErrNilDB(name)
 	}
+
+	if w.IsStrict() {
+		if err := validateCluster(name, c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
 // RegisterTables adds cluster and tables for name mapping
 func (w *Wizard) RegisterTables(c Cluster, list ...interface{}) error {
-	for _, obj := range list {
-		v := NormalizeValue(obj)
-		if _, ok := w.clusters[v]; ok {
-			return errors.NewErrAlreadyRegistared(v)
+	return w.update(func(t *topology) error {
+		for _, obj := range list {
+			v := NormalizeValue(obj)
+			if _, ok := t.clusters[v]; ok {
+				return errors.NewErrAlreadyRegistared(v)
+			}
+			t.clusters[v] = c
 		}
-		w.clusters[v] = c
-	}
-	return nil
+		return nil
+	})
 }
 
 // setCluster set the cluster with name mapping
 func (w *Wizard) setCluster(c Cluster, obj interface{}) {
-	w.clusters[NormalizeValue(obj)] = c
+	w.update(func(t *topology) error {
+		t.clusters[NormalizeValue(obj)] = c
+		return nil
+	})
 }
 
 // CreateCluster set and returns the new StandardCluster
@@ -86,24 +359,111 @@ func (w *Wizard) CreateShardCluster(obj interface{}, slot int64) *ShardCluster {
 	return c
 }
 
+// CreateShardClusterWithStrategy set and returns the new ShardCluster with the shard strategy
+// e.g. NewModuloStrategy(1023), NewHashRingStrategy(100)
+func (w *Wizard) CreateShardClusterWithStrategy(obj interface{}, strategy ShardStrategy) *ShardCluster {
+	c := NewShardCluster(strategy)
+	w.setCluster(c, obj)
+	return c
+}
+
+// CreateRangeCluster set and returns the new RangeCluster
+func (w *Wizard) CreateRangeCluster(obj interface{}) *RangeCluster {
+	c := NewRangeCluster()
+	w.setCluster(c, obj)
+	return c
+}
+
+// CreateDirectoryCluster set and returns the new DirectoryCluster
+func (w *Wizard) CreateDirectoryCluster(obj interface{}, dir ShardDirectory, cacheSize int) *DirectoryCluster {
+	c := NewDirectoryCluster(dir, cacheSize)
+	w.setCluster(c, obj)
+	return c
+}
+
 // Select returns StandardCluster by name mapping (and implicit hash slot from struct field)
 func (w *Wizard) Select(obj interface{}) *StandardCluster {
-	c := w.getCluster(obj)
+	c, _ := w.SelectErr(obj)
+	return c
+}
+
+// SelectErr returns StandardCluster by name mapping (and implicit hash slot from struct field)
+// the error of the lookup is returned, e.g. ErrRangeOutOfRange, ErrDirectoryNotFound
+func (w *Wizard) SelectErr(obj interface{}) (*StandardCluster, error) {
+	c, err := w.lookupCluster(obj)
+	if err != nil {
+		return nil, err
+	}
 	switch v := c.(type) {
 	case *StandardCluster:
-		return v
+		return v, nil
 	case *ShardCluster:
-		return v.SelectByKey(getShardKey(obj))
+		return selectByKey(obj, v, getShardKey(obj))
+	case *RangeCluster, *DirectoryCluster:
+		return selectByKey(obj, v, getShardKeyValue(obj))
 	default:
-		return nil
+		return nil, errors.NewErrNilDB(NormalizeValue(obj))
 	}
 }
 
 // SelectByKey returns StandardCluster by name mapping and shard key
 func (w *Wizard) SelectByKey(obj interface{}, key interface{}) *StandardCluster {
-	c := w.getCluster(obj)
-	if c == nil {
+	c, _ := w.SelectByKeyErr(obj, key)
+	return c
+}
+
+// SelectByKeyErr returns StandardCluster by name mapping and shard key
+// the error of the lookup is returned, e.g. ErrRangeOutOfRange, ErrDirectoryNotFound
+func (w *Wizard) SelectByKeyErr(obj interface{}, key interface{}) (*StandardCluster, error) {
+	c, err := w.lookupCluster(obj)
+	if err != nil {
+		return nil, err
+	}
+	return selectByKey(obj, c, key)
+}
+
+// lookuper is interface for the cluster reporting the reason of the failed selection
+type lookuper interface {
+	Lookup(interface{}) (*StandardCluster, error)
+}
+
+// selectByKey returns sharded cluster by the key with the error of the lookup
+func selectByKey(obj interface{}, c Cluster, key interface{}) (*StandardCluster, error) {
+	if l, ok := c.(lookuper); ok {
+		return l.Lookup(key)
+	}
+	s := c.SelectByKey(key)
+	if s == nil {
+		return nil, errors.NewErrNilDB(NormalizeValue(obj))
+	}
+	return s, nil
+}
+
+// SelectMigrationTargets returns the new clusters of the migrations for the object
+// writes for the object should be sent to these clusters in addition to Select()
+func (w *Wizard) SelectMigrationTargets(obj interface{}) []*StandardCluster {
+	c, ok := w.getCluster(obj).(*ShardCluster)
+	if !ok {
+		return nil
+	}
+	return c.MigrationTargets(getShardKey(obj))
+}
+
+// SelectAllMigrationTargets returns the new clusters of all of the migrations for the object
+// writes to all of the shards should be sent to these clusters in addition to the masters
+func (w *Wizard) SelectAllMigrationTargets(obj interface{}) []*StandardCluster {
+	c, ok := w.getCluster(obj).(*ShardCluster)
+	if !ok {
+		return nil
+	}
+	return c.AllMigrationTargets()
+}
+
+// SelectMigrationTargetsByKey returns the new clusters of the migrations for the shard key
+func (w *Wizard) SelectMigrationTargetsByKey(obj interface{}, key interface{}) []*StandardCluster {
+	c, ok := w.getCluster(obj).(*ShardCluster)
+	if !ok {
 		return nil
 	}
-	return c.SelectByKey(key)
+	return c.MigrationTargets(key)
 }
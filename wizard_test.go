@@ -1,9 +1,15 @@
 package wizard
 
 import (
+	stderrors "errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/evalphobia/wizard/errors"
 )
 
 func TestNewWizard(t *testing.T) {
@@ -11,22 +17,22 @@ func TestNewWizard(t *testing.T) {
 
 	wiz := NewWizard()
 	assert.NotNil(wiz)
-	assert.Empty(wiz.clusters)
+	assert.Empty(wiz.load().clusters)
 }
 
 func TestSetDefault(t *testing.T) {
 	assert := assert.New(t)
 
 	wiz := NewWizard()
-	assert.Nil(wiz.defaultCluster)
+	assert.Nil(wiz.load().defaultCluster)
 
 	c := NewCluster("db")
 	wiz.SetDefault(c)
-	assert.Equal(c, wiz.defaultCluster, "It can set StandardCluster")
+	assert.Equal(c, wiz.load().defaultCluster, "It can set StandardCluster")
 
 	s := &ShardCluster{}
 	wiz.SetDefault(s)
-	assert.Equal(s, wiz.defaultCluster, "It can set ShardCluster")
+	assert.Equal(s, wiz.load().defaultCluster, "It can set ShardCluster")
 }
 
 func TestHasDefault(t *testing.T) {
@@ -47,7 +53,7 @@ func TestGetCluster(t *testing.T) {
 	assert.Nil(wiz.getCluster("table name"))
 
 	c := NewCluster("db")
-	wiz.clusters["table name"] = c
+	wiz.load().clusters["table name"] = c
 	assert.Equal(c, wiz.getCluster("table name"))
 }
 
@@ -55,11 +61,11 @@ func TestSetCluster(t *testing.T) {
 	assert := assert.New(t)
 
 	wiz := NewWizard()
-	assert.Nil(wiz.clusters["table name"])
+	assert.Nil(wiz.load().clusters["table name"])
 
 	c := NewCluster("db")
 	wiz.setCluster(c, "table name")
-	assert.Equal(c, wiz.clusters["table name"])
+	assert.Equal(c, wiz.load().clusters["table name"])
 }
 
 func TestCreateCluster(t *testing.T) {
@@ -84,21 +90,38 @@ func TestCreateShardCluster(t *testing.T) {
 	assert.NotNil(s)
 	assert.Empty(s.List)
 	assert.Equal(int64(99), s.slotsize)
-	assert.Equal(s, wiz.clusters["table name"])
+	assert.Equal(s, wiz.load().clusters["table name"])
 
 	var slotsizeZero int64
 	s = wiz.CreateShardCluster("table name2", slotsizeZero)
 	assert.NotNil(s)
 	assert.Empty(s.List)
 	assert.Equal(int64(1), s.slotsize)
-	assert.Equal(s, wiz.clusters["table name2"])
+	assert.Equal(s, wiz.load().clusters["table name2"])
 
 	var slotsizeMinus int64 = -99
 	s = wiz.CreateShardCluster("table name", slotsizeMinus)
 	assert.NotNil(s)
 	assert.Empty(s.List)
 	assert.Equal(int64(1), s.slotsize)
-	assert.Equal(s, wiz.clusters["table name"])
+	assert.Equal(s, wiz.load().clusters["table name"])
+}
+
+func TestCreateShardClusterWithStrategy(t *testing.T) {
+	assert := assert.New(t)
+
+	var s *ShardCluster
+	wiz := NewWizard()
+
+	strategy := NewHashRingStrategy(10)
+	s = wiz.CreateShardClusterWithStrategy("table name", strategy)
+	assert.NotNil(s)
+	assert.Empty(s.List)
+	assert.Equal(strategy, s.strategy)
+	assert.Equal(s, wiz.load().clusters["table name"])
+
+	s.RegisterNamedShard("shard01", NewCluster("shard01-master"))
+	assert.Equal("shard01-master", wiz.UseMasterByKey("table name", 1))
 }
 
 func TestSelect(t *testing.T) {
@@ -143,6 +166,66 @@ func TestSelect(t *testing.T) {
 	assert.Nil(nilTable, "Select() returns nil when table name does not registered")
 }
 
+func TestSelectRangeCluster(t *testing.T) {
+	assert := assert.New(t)
+	wiz := NewWizard()
+
+	type myStruct struct {
+		CreatedAt time.Time `shard_key:"true"`
+	}
+	y2017 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r := wiz.CreateRangeCluster(myStruct{})
+	shardSet1 := NewCluster("shard01-master")
+	shardSet2 := NewCluster("shard02-master")
+	r.RegisterRange(Unbounded(), Open(y2017), shardSet1)
+	r.RegisterRange(Closed(y2017), Unbounded(), shardSet2)
+
+	assert.Equal(shardSet1, wiz.Select(&myStruct{CreatedAt: y2017.Add(-time.Second)}))
+	assert.Equal(shardSet2, wiz.Select(&myStruct{CreatedAt: y2017}))
+	assert.Equal(shardSet2, wiz.SelectByKey(myStruct{}, y2017))
+	assert.Nil(wiz.SelectByKey(myStruct{}, 1))
+
+	_, err := wiz.SelectByKeyErr(myStruct{}, 1)
+	assert.True(stderrors.Is(err, errors.ErrRangeKeyType))
+
+	bounded := wiz.CreateRangeCluster("bounded table")
+	bounded.RegisterRange(Closed(0), Open(100), shardSet1)
+	_, err = wiz.SelectByKeyErr("bounded table", 100)
+	assert.True(stderrors.Is(err, errors.ErrRangeOutOfRange))
+	_, err = wiz.SelectErr(&myStruct{})
+	assert.Nil(err)
+	_, err = wiz.SelectErr("not registered")
+	assert.True(stderrors.Is(err, errors.ErrNilDB))
+}
+
+func TestSelectDirectoryCluster(t *testing.T) {
+	assert := assert.New(t)
+	wiz := NewWizard()
+
+	type myStruct struct {
+		TenantID string `shard_key:"true"`
+	}
+
+	dir := NewMemoryDirectory()
+	dir.Assign("tenant-a", "shard01")
+	dir.Assign("tenant-b", "shard02")
+
+	d := wiz.CreateDirectoryCluster(myStruct{}, dir, 100)
+	shardSet1 := NewCluster("shard01-master")
+	shardSet2 := NewCluster("shard02-master")
+	d.RegisterShard("shard01", shardSet1)
+	d.RegisterShard("shard02", shardSet2)
+
+	assert.Equal(shardSet1, wiz.Select(&myStruct{TenantID: "tenant-a"}))
+	assert.Equal(shardSet2, wiz.Select(&myStruct{TenantID: "tenant-b"}))
+	assert.Equal(shardSet2, wiz.SelectByKey(myStruct{}, "tenant-b"))
+	assert.Nil(wiz.Select(&myStruct{TenantID: "tenant-c"}))
+
+	_, err := wiz.SelectErr(&myStruct{TenantID: "tenant-c"})
+	assert.True(stderrors.Is(err, errors.ErrDirectoryNotFound))
+}
+
 func TestSelectByKey(t *testing.T) {
 	assert := assert.New(t)
 
@@ -185,3 +268,223 @@ func TestSelectByKey(t *testing.T) {
 	nilTable := wiz.SelectByKey("not registered", 99)
 	assert.Nil(nilTable, "Select() returns nil when table name does not registered")
 }
+
+func TestSelectMigrationTargets(t *testing.T) {
+	assert := assert.New(t)
+	wiz := NewWizard()
+
+	type myStruct struct {
+		ID int64 `shard_key:"true"`
+	}
+	s := wiz.CreateShardCluster(myStruct{}, 100)
+	shardSet1 := NewCluster("shard01-master")
+	shardSet2 := NewCluster("shard02-master")
+	s.RegisterShard(0, 99, shardSet1)
+	s.StartMigration(50, 99, shardSet2)
+
+	assert.Nil(wiz.SelectMigrationTargets(&myStruct{ID: 1}))
+	assert.Equal([]*StandardCluster{shardSet2}, wiz.SelectMigrationTargets(&myStruct{ID: 50}))
+	assert.Equal([]*StandardCluster{shardSet2}, wiz.SelectMigrationTargetsByKey(myStruct{}, 150))
+	assert.Equal([]interface{}{"shard02-master"}, wiz.UseMigrationMasters(&myStruct{ID: 50}))
+	assert.Equal([]interface{}{"shard02-master"}, wiz.UseMigrationMastersByKey(myStruct{}, 50))
+	assert.Nil(wiz.UseMigrationMasters(&myStruct{ID: 1}))
+
+	wiz.CreateCluster("standard table", "db-master")
+	assert.Nil(wiz.SelectMigrationTargets("standard table"))
+	assert.Nil(wiz.SelectMigrationTargetsByKey("standard table", 1))
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := NewWizard()
+	assert.Nil(wiz.Validate())
+
+	wiz.CreateCluster("user", "db")
+	s := wiz.CreateShardCluster("item", 10)
+	s.RegisterShard(0, 4, NewCluster("shard01-master"))
+	wiz.CreateRangeCluster("log")
+
+	err := wiz.Validate()
+	assert.NotNil(err)
+	e, ok := err.(errors.ErrValidation)
+	assert.True(ok)
+	assert.Len(e.Problems, 2)
+	assert.Equal("item", e.Problems[0].(errors.ErrValidation).Name)
+	assert.Equal([]error{errors.NewErrSlotGap(5, 9)}, e.Problems[0].(errors.ErrValidation).Problems)
+	assert.Equal("log", e.Problems[1].(errors.ErrValidation).Name)
+	assert.Equal([]error{errors.NewErrNoShards()}, e.Problems[1].(errors.ErrValidation).Problems)
+
+	s.RegisterShard(5, 9, NewCluster("shard02-master"))
+	wiz.CreateRangeCluster("log").RegisterRange(Unbounded(), Unbounded(), NewCluster("log-master"))
+	assert.Nil(wiz.Validate())
+
+	wiz.SetDefault(&StandardCluster{})
+	assert.NotNil(wiz.Validate())
+}
+
+func TestStrict(t *testing.T) {
+	assert := assert.New(t)
+
+	type myStruct struct {
+		ID int64 `shard_key:"true"`
+	}
+
+	wiz := NewWizard()
+	s := wiz.CreateShardCluster(myStruct{}, 10)
+	shardSet1 := NewCluster("shard01-master")
+	s.RegisterShard(0, 4, shardSet1)
+	assert.Equal(shardSet1, wiz.Select(&myStruct{ID: 1}))
+
+	wiz.SetStrict(true)
+	assert.True(wiz.IsStrict())
+	assert.Nil(wiz.Select(&myStruct{ID: 1}), "Invalid cluster is not served on strict mode")
+	assert.Nil(wiz.SelectByKey(myStruct{}, 1))
+	assert.Empty(wiz.UseMasters(myStruct{}))
+
+	var ev errors.ErrValidation
+	_, err := wiz.SelectErr(&myStruct{ID: 1})
+	assert.True(stderrors.As(err, &ev), "the validation error is returned instead of ErrNilDB")
+	_, err = wiz.SelectByKeyErr(myStruct{}, 1)
+	assert.True(stderrors.As(err, &ev))
+
+	shardSet2 := NewCluster("shard02-master")
+	s.RegisterShard(5, 9, shardSet2)
+	assert.Equal(shardSet1, wiz.Select(&myStruct{ID: 1}))
+	assert.Equal(shardSet2, wiz.SelectByKey(myStruct{}, 5))
+
+	wiz.SetStrict(false)
+	assert.False(wiz.IsStrict())
+}
+
+func TestWizardNodes(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := NewWizard()
+	assert.Empty(wiz.Nodes())
+
+	c := wiz.CreateCluster("table1", "db1-master")
+	c.RegisterSlave("db1-slave")
+	wiz.RegisterTables(c, "table2")
+	s := wiz.CreateShardCluster("table3", 10)
+	s.RegisterShard(0, 9, NewCluster("shard01-master"))
+	s.StartMigration(0, 4, NewCluster("shard02-master"))
+	wiz.SetDefault(NewCluster("default-master"))
+
+	var dbs []interface{}
+	for _, n := range wiz.Nodes() {
+		dbs = append(dbs, n.DB())
+	}
+	assert.Len(dbs, 5, "same cluster is not duplicated")
+	assert.Contains(dbs, "db1-master")
+	assert.Contains(dbs, "db1-slave")
+	assert.Contains(dbs, "shard01-master")
+	assert.Contains(dbs, "shard02-master")
+	assert.Contains(dbs, "default-master")
+
+	dbs = nil
+	for _, n := range wiz.Masters() {
+		dbs = append(dbs, n.DB())
+	}
+	assert.Len(dbs, 3, "slaves and migration targets are not included")
+	assert.Contains(dbs, "db1-master")
+	assert.Contains(dbs, "shard01-master")
+	assert.Contains(dbs, "default-master")
+}
+
+func TestShardIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := NewWizard()
+	wiz.CreateCluster("table1", "db1-master").RegisterSlave("db1-slave")
+	s := wiz.CreateShardCluster("table2", 10)
+	s.RegisterShard(0, 4, NewCluster("shard01-master"))
+	s.RegisterShard(5, 9, NewCluster("shard02-master"))
+
+	assert.Equal(0, wiz.ShardIndex("db1-master"))
+	assert.Equal(0, wiz.ShardIndex("shard01-master"))
+	assert.Equal(1, wiz.ShardIndex("shard02-master"))
+	assert.Equal(-1, wiz.ShardIndex("db1-slave"), "slave is not the shard")
+	assert.Equal(-1, wiz.ShardIndex("unknown"))
+
+	// the master of multiple clusters
+	wiz.CreateCluster("table0", "shard02-master")
+	wiz.CreateCluster("table3", "shard02-master")
+	for i := 0; i < 20; i++ {
+		assert.Equal(1, wiz.ShardIndex("shard02-master"), "the shard cluster is preferred")
+	}
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := NewWizard()
+	c := wiz.CreateCluster("table1", "db1-master")
+	c.RegisterSlave("db1-slave")
+	wiz.CreateCluster("table2", "db2-master")
+
+	next := NewWizard()
+	next.CreateCluster("table1", "db1-master")
+	next.CreateCluster("table3", "db3-master")
+
+	removed := wiz.Reload(next)
+	assert.Len(removed, 2)
+	var dbs []interface{}
+	for _, n := range removed {
+		dbs = append(dbs, n.DB())
+	}
+	assert.Contains(dbs, "db1-slave")
+	assert.Contains(dbs, "db2-master")
+
+	assert.Equal("db1-master", wiz.UseMaster("table1"))
+	assert.Nil(wiz.UseMaster("table2"))
+	assert.Equal("db3-master", wiz.UseMaster("table3"))
+}
+
+func TestWizardConcurrentRegistration(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := NewWizard()
+	wiz.CreateCluster("table", "db-master")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprintf("table_%d_%d", i, j)
+				wiz.CreateCluster(name, name+"-master")
+				wiz.SetStrict(j%2 == 0)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Equal("db-master", wiz.UseMaster("table"))
+				wiz.HasDefault()
+				wiz.Validate()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(wiz.load().clusters, 201)
+	assert.Equal("table_9_19-master", wiz.UseMaster("table_9_19"))
+}
+
+func TestRegisterTables(t *testing.T) {
+	assert := assert.New(t)
+
+	wiz := NewWizard()
+	c := NewCluster("db")
+	assert.Nil(wiz.RegisterTables(c, "table1", "table2"))
+	assert.Equal(c, wiz.getCluster("table1"))
+	assert.Equal(c, wiz.getCluster("table2"))
+
+	before := wiz.load()
+	err := wiz.RegisterTables(c, "table3", "table1")
+	assert.NotNil(err)
+	assert.Equal(c, wiz.getCluster("table3"))
+	assert.Len(before.clusters, 2, "old snapshot is not changed")
+}
@@ -0,0 +1,48 @@
+package wizard
+
+import (
+	"sync"
+	"time"
+)
+
+// worker runs the function periodically on background
+type worker struct {
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// start runs fn on every interval until stop() is called
+// if the worker is already running, nothing happens
+func (w *worker) start(interval time.Duration, fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	w.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopWorker stops the running worker
+func (w *worker) stopWorker() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop == nil {
+		return
+	}
+	close(w.stop)
+	w.stop = nil
+}